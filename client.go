@@ -0,0 +1,755 @@
+package main
+
+import (
+	"bytes"
+	"cube/manager"
+	"cube/manifest"
+	"cube/node"
+	"cube/task"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+// clientFlags returns the flags shared by the commands that talk to the
+// manager, which read the "client" section of the config file.
+func clientFlags(name string) (*flags, *string) {
+	var addr string
+	f := newFlags(name, "client")
+	f.stringVar(&addr, "manager", "CUBE_MANAGER_ADDR", "localhost:5555", "host:port of the manager")
+
+	return f, &addr
+}
+
+func cmdRun(args []string, out io.Writer) error {
+	var (
+		name, image, healthCheck, restartPolicy, pullPolicy, workdir, user string
+		memory, disk                                                       int
+		cpu                                                                float64
+		env, expose, publish                                               listFlag
+	)
+
+	f, addr := clientFlags("run")
+	f.stringVar(&name, "name", "", "", "name of the task")
+	f.stringVar(&image, "image", "", "", "image to run")
+	f.Var(&env, "e", "environment variable KEY=VALUE, may be repeated")
+	f.Var(&expose, "expose", "container port to expose, port[/proto], may be repeated")
+	f.Var(&publish, "p", "port to publish, [ip:]hostport:port[/proto], may be repeated")
+	f.Float64Var(&cpu, "cpu", 0, "CPUs the task may use")
+	f.intVar(&memory, "memory", "", 0, "memory limit in MiB")
+	f.intVar(&disk, "disk", "", 0, "disk the task needs in MiB")
+	f.stringVar(&healthCheck, "health-check", "", "", "path polled on the task's first host port")
+	f.stringVar(&restartPolicy, "restart-policy", "", "", "docker restart policy")
+	f.stringVar(&pullPolicy, "pull-policy", "", "", "image pull policy, always, missing or never")
+	f.stringVar(&workdir, "workdir", "", "", "working directory inside the container")
+	f.stringVar(&user, "user", "", "", "user to run as inside the container")
+	err := f.parse(args)
+	if err != nil {
+		return err
+	}
+
+	if image == "" {
+		return errors.New("no image given, use -image")
+	}
+
+	t := task.Task{
+		ID:            uuid.New(),
+		Name:          name,
+		State:         task.Scheduled,
+		Image:         image,
+		PullPolicy:    pullPolicy,
+		Cmd:           f.Args(),
+		Env:           env,
+		WorkingDir:    workdir,
+		User:          user,
+		CPU:           cpu,
+		Memory:        int64(memory) << 20,
+		Disk:          int64(disk) << 20,
+		HealthCheck:   healthCheck,
+		RestartPolicy: restartPolicy,
+	}
+	if t.Name == "" {
+		t.Name = "task-" + t.ID.String()[:8]
+	}
+
+	if len(expose) > 0 {
+		t.ExposedPorts = nat.PortSet{}
+		for _, p := range expose {
+			proto, port := nat.SplitProtoPort(p)
+			np, err := nat.NewPort(proto, port)
+			if err != nil {
+				return fmt.Errorf("invalid -expose %q: %v", p, err)
+			}
+			t.ExposedPorts[np] = struct{}{}
+		}
+	}
+
+	if len(publish) > 0 {
+		t.PortBindings = map[string]string{}
+		for _, p := range publish {
+			cp, hp, err := parsePublish(p)
+			if err != nil {
+				return err
+			}
+			t.PortBindings[cp] = hp
+		}
+		_, err = task.ParsePortBindings(t.PortBindings)
+		if err != nil {
+			return err
+		}
+	}
+
+	te := task.TaskEvent{
+		ID:        uuid.New(),
+		State:     task.Running,
+		Timestamp: time.Now(),
+		Task:      t,
+	}
+	data, err := json.Marshal(te)
+	if err != nil {
+		return err
+	}
+
+	resp, err := managerDo(*addr, http.MethodPost, "/tasks", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	fmt.Fprintln(out, t.ID)
+
+	return nil
+}
+
+// parsePublish splits a -p value of the form [ip:]hostport:port[/proto]
+// into a container port and the host side of its binding.
+func parsePublish(p string) (string, string, error) {
+	i := strings.LastIndex(p, ":")
+	if i <= 0 || i == len(p)-1 {
+		return "", "", fmt.Errorf("invalid -p %q, want [ip:]hostport:port[/proto]", p)
+	}
+
+	cp := p[i+1:]
+	if !strings.Contains(cp, "/") {
+		cp += "/tcp"
+	}
+
+	return cp, p[:i], nil
+}
+
+func cmdApply(args []string, out io.Writer) error {
+	var (
+		file   string
+		dryRun bool
+	)
+
+	f, addr := clientFlags("apply")
+	f.StringVar(&file, "f", "", "YAML or JSON manifest to apply, - for standard input")
+	f.BoolVar(&dryRun, "dry-run", false, "only show what would change")
+	err := f.parse(args)
+	if err != nil {
+		return err
+	}
+
+	if file == "" {
+		return errors.New("no manifest given, use -f")
+	}
+
+	mf, err := manifest.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(mf)
+	if err != nil {
+		return err
+	}
+
+	resp, err := managerDo(*addr, http.MethodPost, fmt.Sprintf("/apply?dryRun=%v", dryRun), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	res := manager.ApplyResult{}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return err
+	}
+
+	suffix := ""
+	if dryRun {
+		suffix = " (dry run)"
+	}
+	for _, c := range []struct {
+		action string
+		names  []string
+	}{
+		{"created", res.Created},
+		{"updated", res.Updated},
+		{"scaled", res.Scaled},
+		{"stopped", res.Stopped},
+		{"unchanged", res.Unchanged},
+	} {
+		for _, name := range c.names {
+			fmt.Fprintf(out, "%s %s%s\n", name, c.action, suffix)
+		}
+	}
+
+	return nil
+}
+
+func cmdStop(args []string, out io.Writer) error {
+	f, addr := clientFlags("stop")
+	err := f.parse(args)
+	if err != nil {
+		return err
+	}
+
+	if f.NArg() != 1 {
+		return errors.New("usage: cube stop [flags] <task-id>")
+	}
+
+	resp, err := managerDo(*addr, http.MethodDelete, "/tasks/"+f.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	fmt.Fprintf(out, "Stopping task %s\n", f.Arg(0))
+
+	return nil
+}
+
+func cmdStatus(args []string, out io.Writer) error {
+	f, addr := clientFlags("status")
+	err := f.parse(args)
+	if err != nil {
+		return err
+	}
+
+	var tasks []*task.Task
+	err = managerGet(*addr, "/tasks", &tasks)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].Name != tasks[j].Name {
+			return tasks[i].Name < tasks[j].Name
+		}
+		return tasks[i].ID.String() < tasks[j].ID.String()
+	})
+
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tIMAGE\tSTATE\tCONTAINERS\tRESTARTS\tEXIT")
+	for _, t := range tasks {
+		exit := ""
+		if t.State == task.Completed || t.State == task.Failed {
+			exit = fmt.Sprint(t.ExitCode)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", t.ID, t.Name, t.Image, t.State, formatContainers(t), t.RestartCount, exit)
+	}
+
+	return w.Flush()
+}
+
+// formatContainers shows how many of the task's containers, leaving out
+// init containers, are running, naming the init container still running.
+func formatContainers(t *task.Task) string {
+	if t.Containers == nil {
+		if t.State == task.Running {
+			return "1/1"
+		}
+		return "0/1"
+	}
+
+	running, total, init := 0, 0, ""
+	for _, c := range t.Containers {
+		switch {
+		case c.Init && c.State == task.ContainerRunning:
+			init = c.Name
+		case c.Init:
+		case c.State == task.ContainerRunning:
+			running++
+			total++
+		default:
+			total++
+		}
+	}
+
+	if init != "" {
+		return fmt.Sprintf("%d/%d init:%s", running, total, init)
+	}
+	return fmt.Sprintf("%d/%d", running, total)
+}
+
+func cmdLogs(args []string, out io.Writer) error {
+	var (
+		follow, timestamps bool
+		tail, since        string
+	)
+
+	f, addr := clientFlags("logs")
+	f.BoolVar(&follow, "f", false, "follow the log output")
+	f.StringVar(&tail, "tail", "all", "number of lines to show from the end")
+	f.StringVar(&since, "since", "", "show logs since a timestamp or relative time such as 10m")
+	f.BoolVar(&timestamps, "timestamps", false, "show timestamps")
+	err := f.parse(args)
+	if err != nil {
+		return err
+	}
+
+	if f.NArg() != 1 {
+		return errors.New("usage: cube logs [flags] <task-id>")
+	}
+
+	q := url.Values{}
+	q.Set("follow", fmt.Sprint(follow))
+	q.Set("tail", tail)
+	q.Set("since", since)
+	q.Set("timestamps", fmt.Sprint(timestamps))
+
+	resp, err := managerDo(*addr, http.MethodGet, "/tasks/"+f.Arg(0)+"/logs?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+func cmdService(args []string, out io.Writer) error {
+	usage := errors.New("usage: cube service ls | scale <name> <replicas> | history <name> | rollback <name> [revision] | rm <name> [flags]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	f, addr := clientFlags("service " + args[0])
+	err := f.parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "ls" && f.NArg() == 0:
+		var services []manager.ServiceStatus
+		err = managerGet(*addr, "/services", &services)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "NAME\tIMAGE\tREPLICAS\tREADY\tREVISION\tROLLOUT")
+		for _, s := range services {
+			fmt.Fprintf(w, "%s\t%s\t%d/%d\t%d\t%d\t%s\n", s.Name, s.Template.Image, s.Running, s.Replicas, s.Ready, s.Rollout.Revision, s.Rollout.State)
+		}
+
+		return w.Flush()
+
+	case args[0] == "history" && f.NArg() == 1:
+		var revs []manager.Revision
+		err = managerGet(*addr, "/services/"+f.Arg(0)+"/revisions", &revs)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "REVISION\tIMAGE\tCREATED\tCAUSE")
+		for _, r := range revs {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", r.Number, r.Template.Image, r.Created.Format(time.RFC3339), r.Cause)
+		}
+
+		return w.Flush()
+
+	case args[0] == "rollback" && (f.NArg() == 1 || f.NArg() == 2):
+		req := manager.RollbackRequest{}
+		if f.NArg() == 2 {
+			_, err := fmt.Sscan(f.Arg(1), &req.Revision)
+			if err != nil {
+				return fmt.Errorf("invalid revision %q", f.Arg(1))
+			}
+		}
+
+		data, _ := json.Marshal(req)
+		resp, err := managerDo(*addr, http.MethodPost, "/services/"+f.Arg(0)+"/rollback", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		st := manager.ServiceStatus{}
+		err = json.NewDecoder(resp.Body).Decode(&st)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "service/%s rolling out revision %d\n", f.Arg(0), st.Rollout.Revision)
+		return nil
+
+	case args[0] == "scale" && f.NArg() == 2:
+		var replicas int
+		_, err := fmt.Sscan(f.Arg(1), &replicas)
+		if err != nil {
+			return fmt.Errorf("invalid replica count %q", f.Arg(1))
+		}
+
+		data, _ := json.Marshal(manager.ScaleRequest{Replicas: replicas})
+		resp, err := managerDo(*addr, http.MethodPut, "/services/"+f.Arg(0)+"/scale", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		fmt.Fprintf(out, "service/%s scaled to %d\n", f.Arg(0), replicas)
+		return nil
+
+	case args[0] == "rm" && f.NArg() == 1:
+		resp, err := managerDo(*addr, http.MethodDelete, "/services/"+f.Arg(0), nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		fmt.Fprintf(out, "service/%s removed\n", f.Arg(0))
+		return nil
+	}
+
+	return usage
+}
+
+func cmdDaemonSet(args []string, out io.Writer) error {
+	usage := errors.New("usage: cube daemonset ls | rm <name> [flags]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	f, addr := clientFlags("daemonset " + args[0])
+	err := f.parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "ls" && f.NArg() == 0:
+		var daemonSets []manager.DaemonSetStatus
+		err = managerGet(*addr, "/daemonsets", &daemonSets)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "NAME\tIMAGE\tSELECTOR\tDESIRED\tCURRENT\tREADY")
+		for _, d := range daemonSets {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", d.Name, d.Template.Image, formatLabels(d.NodeSelector), d.Desired, d.Current, d.Ready)
+		}
+
+		return w.Flush()
+
+	case args[0] == "rm" && f.NArg() == 1:
+		resp, err := managerDo(*addr, http.MethodDelete, "/daemonsets/"+f.Arg(0), nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		fmt.Fprintf(out, "daemonset/%s removed\n", f.Arg(0))
+		return nil
+	}
+
+	return usage
+}
+
+func cmdJob(args []string, out io.Writer) error {
+	usage := errors.New("usage: cube job ls | rm <name> [flags]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	f, addr := clientFlags("job " + args[0])
+	err := f.parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "ls" && f.NArg() == 0:
+		var jobs []manager.JobStatus
+		err = managerGet(*addr, "/jobs", &jobs)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "NAME\tIMAGE\tCOMPLETIONS\tACTIVE\tFAILED\tRUN\tSTATE\tMESSAGE")
+		for _, j := range jobs {
+			fmt.Fprintf(w, "%s\t%s\t%d/%d\t%d\t%d\t%d\t%s\t%s\n", j.Name, j.Template.Image, j.Run.Succeeded, j.Completions, j.Run.Active, j.Run.Failed, j.Run.Number, j.Run.State, j.Run.Message)
+		}
+
+		return w.Flush()
+
+	case args[0] == "rm" && f.NArg() == 1:
+		resp, err := managerDo(*addr, http.MethodDelete, "/jobs/"+f.Arg(0), nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		fmt.Fprintf(out, "job/%s removed\n", f.Arg(0))
+		return nil
+	}
+
+	return usage
+}
+
+func cmdCronJob(args []string, out io.Writer) error {
+	usage := errors.New("usage: cube cronjob ls | rm <name> [flags]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	f, addr := clientFlags("cronjob " + args[0])
+	err := f.parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "ls" && f.NArg() == 0:
+		var cronJobs []manager.CronJobStatus
+		err = managerGet(*addr, "/cronjobs", &cronJobs)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSCHEDULE\tTIMEZONE\tPOLICY\tJOBS\tLAST\tNEXT\tMESSAGE")
+		for _, c := range cronJobs {
+			tz := c.TimeZone
+			if tz == "" {
+				tz = "UTC"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", c.Name, c.Schedule, tz, c.ConcurrencyPolicy, len(c.Jobs),
+				c.LastScheduleTime.Format(time.RFC3339), c.NextScheduleTime.Format(time.RFC3339), c.Message)
+		}
+
+		return w.Flush()
+
+	case args[0] == "rm" && f.NArg() == 1:
+		resp, err := managerDo(*addr, http.MethodDelete, "/cronjobs/"+f.Arg(0), nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		fmt.Fprintf(out, "cronjob/%s removed\n", f.Arg(0))
+		return nil
+	}
+
+	return usage
+}
+
+func cmdWorkflow(args []string, out io.Writer) error {
+	usage := errors.New("usage: cube workflow ls | get <name> | rm <name> [flags]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	f, addr := clientFlags("workflow " + args[0])
+	err := f.parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "ls" && f.NArg() == 0:
+		var workflows []manager.WorkflowStatus
+		err = managerGet(*addr, "/workflows", &workflows)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSTEPS\tSTATE\tMESSAGE")
+		for _, wf := range workflows {
+			succeeded := 0
+			for _, s := range wf.Steps {
+				if s.State == manager.StepSucceeded {
+					succeeded++
+				}
+			}
+			fmt.Fprintf(w, "%s\t%d/%d\t%s\t%s\n", wf.Name, succeeded, len(wf.Steps), wf.State, wf.Message)
+		}
+
+		return w.Flush()
+
+	case args[0] == "get" && f.NArg() == 1:
+		wf := manager.WorkflowStatus{}
+		err = managerGet(*addr, "/workflows/"+f.Arg(0), &wf)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "workflow/%s %s %s\n", wf.Name, wf.State, wf.Message)
+		w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "STEP\tIMAGE\tDEPENDS ON\tFAILED\tSTATE\tMESSAGE")
+		for _, s := range wf.Steps {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d\t%s\t%s\n", s.Name, s.Template.Image, strings.Join(s.DependsOn, ","), s.Run.Failed, s.Retries+1, s.State, s.Run.Message)
+		}
+
+		return w.Flush()
+
+	case args[0] == "rm" && f.NArg() == 1:
+		resp, err := managerDo(*addr, http.MethodDelete, "/workflows/"+f.Arg(0), nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		fmt.Fprintf(out, "workflow/%s removed\n", f.Arg(0))
+		return nil
+	}
+
+	return usage
+}
+
+func cmdNode(args []string, out io.Writer) error {
+	usage := errors.New("usage: cube node ls | label <name> [key=value ...] | rm <name> [flags]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	f, addr := clientFlags("node " + args[0])
+	err := f.parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "ls" && f.NArg() == 0:
+		var nodes []*node.Node
+		err = managerGet(*addr, "/nodes", &nodes)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "NAME\tAPI\tROLE\tSTATUS\tLAST-SEEN\tCORES\tMEMORY\tDISK\tDISK-ALLOCATED\tTASKS\tLABELS")
+		for _, n := range nodes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%d\t%s\n", n.Name, n.Api, n.Role, n.Status, n.LastHeartbeat.Format(time.RFC3339), n.Cores,
+				formatBytes(int64(n.Memory)*1024), formatBytes(n.Disk), formatBytes(n.DiskAllocated), n.TaskCount, formatLabels(n.Labels))
+		}
+
+		return w.Flush()
+
+	case args[0] == "label" && f.NArg() >= 1:
+		labels := map[string]string{}
+		for _, l := range f.Args()[1:] {
+			k, v, ok := strings.Cut(l, "=")
+			if !ok || k == "" {
+				return fmt.Errorf("invalid label %q, want key=value", l)
+			}
+			labels[k] = v
+		}
+
+		data, _ := json.Marshal(labels)
+		resp, err := managerDo(*addr, http.MethodPut, "/nodes/"+f.Arg(0)+"/labels", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		fmt.Fprintf(out, "node/%s labeled %s\n", f.Arg(0), formatLabels(labels))
+		return nil
+
+	case args[0] == "rm" && f.NArg() == 1:
+		resp, err := managerDo(*addr, http.MethodDelete, "/nodes/"+f.Arg(0), nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		fmt.Fprintf(out, "node/%s removed\n", f.Arg(0))
+		return nil
+	}
+
+	return usage
+}
+
+// formatLabels prints labels as sorted key=value pairs.
+func formatLabels(labels map[string]string) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// managerDo sends a request to the manager and turns a response outside
+// 2xx into an error carrying the manager's message.
+func managerDo(addr string, method string, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://"+addr+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach manager at %s: %v", addr, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+
+		var e manager.ErrResponse
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(e.Message))
+		}
+
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return resp, nil
+}
+
+func managerGet(addr string, path string, v any) error {
+	resp, err := managerDo(addr, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
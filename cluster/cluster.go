@@ -0,0 +1,345 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"cube/manager"
+	"cube/manifest"
+	"cube/store"
+	"cube/task"
+	"cube/worker"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Cluster is an in-process manager with N workers, all backed by the Fake
+// runtime and served over loopback. Nothing runs in the background: Step
+// drives every loop once, so tests decide exactly when work happens.
+type Cluster struct {
+	Manager    *manager.Manager
+	ManagerApi *manager.Api
+	ManagerUrl string
+	Workers    []*worker.Worker
+	Runtimes   []*task.Fake
+
+	addrs         []string
+	servers       []*http.Server
+	managerServer *http.Server
+	workerServers []*http.Server
+	// workerListeners are closed explicitly on restart so the address is
+	// free again even if the server had not started serving yet.
+	workerListeners []net.Listener
+}
+
+// New boots a cluster of n workers. Where the platform allows it each
+// worker gets its own loopback address (127.0.0.2, 127.0.0.3, ...) so
+// fixed host ports behave as they would on separate machines.
+func New(n int) (*Cluster, error) {
+	return NewWithStore(n, store.NewMemory())
+}
+
+// NewWithStore boots a cluster of n workers whose manager keeps its state
+// in s.
+func NewWithStore(n int, s store.Store) (*Cluster, error) {
+	c := &Cluster{}
+
+	for i := 0; i < n; i++ {
+		err := c.startWorker()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	err := c.startManager(s)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// AddWorker boots another worker and has it register with the manager,
+// as a worker started with -manager does, returning its index.
+func (c *Cluster) AddWorker() (int, error) {
+	err := c.startWorker()
+	if err != nil {
+		return 0, err
+	}
+
+	i := len(c.Workers) - 1
+	w := c.Workers[i]
+	w.Manager = strings.TrimPrefix(c.ManagerUrl, "http://")
+	w.Address = c.addrs[i]
+
+	return i, w.SendHeartbeat(context.Background())
+}
+
+// RemoveWorker has the i'th worker leave the cluster and stops serving it,
+// as when its machine is taken away. Its runtime keeps what it ran.
+func (c *Cluster) RemoveWorker(i int) error {
+	c.workerServers[i].Close()
+	c.workerListeners[i].Close()
+
+	return c.Manager.RemoveWorker(c.addrs[i])
+}
+
+func (c *Cluster) startWorker() error {
+	i := len(c.Workers)
+	l, host, err := listenLoopback(i + 2)
+	if err != nil {
+		return err
+	}
+
+	rt := task.NewFake(host)
+	w, err := worker.New(context.Background(), fmt.Sprintf("worker-%d", i+1), rt, store.NewMemory())
+	if err != nil {
+		l.Close()
+		return err
+	}
+	api := &worker.Api{Worker: w}
+	api.InitRouter()
+
+	c.workerServers = append(c.workerServers, c.serve(l, api.Router))
+	c.workerListeners = append(c.workerListeners, l)
+	c.Workers = append(c.Workers, w)
+	c.Runtimes = append(c.Runtimes, rt)
+	c.addrs = append(c.addrs, l.Addr().String())
+
+	return nil
+}
+
+// RestartManager replaces the manager with a fresh one that restores its
+// state from s, as after a crash. The workers keep running.
+func (c *Cluster) RestartManager(s store.Store) error {
+	c.managerServer.Close()
+	c.Manager.Store.Close()
+
+	return c.startManager(s)
+}
+
+// RestartWorker replaces the i'th worker with a fresh one that restores its
+// tasks from s, as after a crash. Its runtime, and so its containers, keep
+// running and are adopted by the new worker, which serves on the same
+// address.
+func (c *Cluster) RestartWorker(i int, s store.Store) error {
+	c.workerServers[i].Close()
+	c.workerListeners[i].Close()
+	c.Workers[i].Store.Close()
+
+	w, err := worker.New(context.Background(), c.Workers[i].Name, c.Runtimes[i], s)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", c.addrs[i])
+	if err != nil {
+		return err
+	}
+
+	api := &worker.Api{Worker: w}
+	api.InitRouter()
+
+	c.Workers[i] = w
+	c.workerServers[i] = c.serve(l, api.Router)
+	c.workerListeners[i] = l
+
+	return nil
+}
+
+func (c *Cluster) startManager(s store.Store) error {
+	m, err := manager.New(c.addrs, "roundrobin", s)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	c.Manager = m
+	c.ManagerApi = &manager.Api{Manager: m}
+	c.ManagerApi.InitRouter()
+	c.ManagerUrl = fmt.Sprintf("http://%s", l.Addr().String())
+	c.managerServer = c.serve(l, c.ManagerApi.Router)
+
+	return nil
+}
+
+// Step runs one pass of every manager and worker loop in dependency order:
+// dispatch pending events, run queued tasks, refresh task state from the
+// runtimes and then from the workers, mark nodes not heard from NotReady,
+// reconcile applied specs and finally run health checks.
+func (c *Cluster) Step() {
+	ctx := context.Background()
+
+	for i := c.Manager.PendingLen(); i > 0; i-- {
+		c.Manager.SendWork(ctx)
+	}
+
+	for _, w := range c.Workers {
+		for w.QueueLen() > 0 {
+			w.RunTask(ctx)
+		}
+		w.SyncTasks(ctx)
+	}
+
+	c.Manager.SyncTasks(ctx)
+	c.Manager.CheckNodes()
+	c.Manager.Reconcile()
+	c.Manager.CheckTasksHealth(ctx)
+}
+
+// StepUntil steps the cluster until cond holds or the attempts run out.
+func (c *Cluster) StepUntil(attempts int, cond func() bool) bool {
+	for i := 0; i < attempts; i++ {
+		c.Step()
+		if cond() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Submit posts a task event to the manager API, the same way a user would.
+func (c *Cluster) Submit(te task.TaskEvent) error {
+	data, err := json.Marshal(te)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(c.ManagerUrl+"/tasks", "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status submitting task %v: %d", te.Task.ID, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Run submits t to be scheduled and returns the event that was sent.
+func (c *Cluster) Run(t task.Task) (task.TaskEvent, error) {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+	t.State = task.Scheduled
+
+	te := task.TaskEvent{
+		ID:        uuid.New(),
+		State:     task.Running,
+		Timestamp: time.Now(),
+		Task:      t,
+	}
+
+	return te, c.Submit(te)
+}
+
+// Stop asks the manager API to stop the task with the given ID.
+func (c *Cluster) Stop(id uuid.UUID) error {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/tasks/%s", c.ManagerUrl, id), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status stopping task %v: %d", id, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Apply posts a manifest to the manager API and returns what it changed.
+func (c *Cluster) Apply(mf manifest.Manifest, dryRun bool) (manager.ApplyResult, error) {
+	res := manager.ApplyResult{}
+
+	data, err := json.Marshal(mf)
+	if err != nil {
+		return res, err
+	}
+
+	resp, err := http.Post(fmt.Sprintf("%s/apply?dryRun=%v", c.ManagerUrl, dryRun), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("unexpected status applying manifest: %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
+
+// Task returns the manager's view of a task.
+func (c *Cluster) Task(id uuid.UUID) (task.Task, bool) {
+	return c.Manager.GetTask(id)
+}
+
+// Runtime returns the fake runtime of the worker the manager placed the
+// task on.
+func (c *Cluster) Runtime(id uuid.UUID) *task.Fake {
+	addr, ok := c.Manager.TaskWorker(id)
+	if !ok {
+		return nil
+	}
+
+	for i, n := range c.addrs {
+		if n == addr {
+			return c.Runtimes[i]
+		}
+	}
+
+	return nil
+}
+
+func (c *Cluster) Close() {
+	for _, s := range c.servers {
+		s.Close()
+	}
+
+	if c.Manager != nil {
+		c.Manager.Store.Close()
+	}
+	for _, w := range c.Workers {
+		w.Store.Close()
+	}
+}
+
+func (c *Cluster) serve(l net.Listener, h http.Handler) *http.Server {
+	s := &http.Server{Handler: h}
+	c.servers = append(c.servers, s)
+	go s.Serve(l)
+
+	return s
+}
+
+func listenLoopback(octet int) (net.Listener, string, error) {
+	host := fmt.Sprintf("127.0.0.%d", octet)
+	l, err := net.Listen("tcp", host+":0")
+	if err == nil {
+		return l, host, nil
+	}
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	return l, "127.0.0.1", err
+}
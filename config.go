@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// flags is a command's flag set whose flags may also be given by an
+// environment variable or in the command's section of a JSON config file.
+// The command line wins over the environment, which wins over the file.
+type flags struct {
+	*flag.FlagSet
+
+	section string
+	config  string
+	env     map[string]string
+}
+
+func newFlags(name string, section string) *flags {
+	f := &flags{
+		FlagSet: flag.NewFlagSet(name, flag.ContinueOnError),
+		section: section,
+		env:     make(map[string]string),
+	}
+	f.StringVar(&f.config, "config", os.Getenv("CUBE_CONFIG"), "JSON config file (env CUBE_CONFIG)")
+
+	return f
+}
+
+func (f *flags) stringVar(p *string, name string, env string, value string, usage string) {
+	f.StringVar(p, name, value, f.usage(usage, env))
+	f.bindEnv(name, env)
+}
+
+func (f *flags) intVar(p *int, name string, env string, value int, usage string) {
+	f.IntVar(p, name, value, f.usage(usage, env))
+	f.bindEnv(name, env)
+}
+
+func (f *flags) durationVar(p *time.Duration, name string, env string, value time.Duration, usage string) {
+	f.DurationVar(p, name, value, f.usage(usage, env))
+	f.bindEnv(name, env)
+}
+
+func (f *flags) bindEnv(name string, env string) {
+	if env != "" {
+		f.env[name] = env
+	}
+}
+
+func (f *flags) usage(usage string, env string) string {
+	if env == "" {
+		return usage
+	}
+
+	return fmt.Sprintf("%s (env %s)", usage, env)
+}
+
+// parse parses the command line and then fills in the flags it didn't set,
+// first from the config file and then from the environment.
+func (f *flags) parse(args []string) error {
+	err := f.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	f.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+
+	if f.config != "" {
+		values, err := loadConfig(f.config, f.section)
+		if err != nil {
+			return err
+		}
+
+		for name, value := range values {
+			if f.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown setting %q in section %q", f.config, name, f.section)
+			}
+			if set[name] {
+				continue
+			}
+
+			err := f.Set(name, value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid %s: %v", f.config, name, err)
+			}
+		}
+	}
+
+	for name, env := range f.env {
+		v := os.Getenv(env)
+		if set[name] || v == "" {
+			continue
+		}
+
+		err := f.Set(name, v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", env, v, err)
+		}
+	}
+
+	return nil
+}
+
+// loadConfig reads one section of a config file such as
+//
+//	{"worker": {"name": "worker-1", "port": 5556, "runtime": "docker"},
+//	 "manager": {"workers": ["10.0.0.2:5556", "10.0.0.3:5556"]},
+//	 "client": {"manager": "10.0.0.1:5555"}}
+//
+// as flag values. Lists become comma separated values.
+func loadConfig(path string, section string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Numbers are kept as written, so large ones don't turn into floats.
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	var file map[string]map[string]any
+	err = d.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	values := map[string]string{}
+	for name, v := range file[section] {
+		switch v := v.(type) {
+		case []any:
+			var items []string
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+
+	return values, nil
+}
+
+// listFlag collects a flag that may be repeated, such as -e.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			res = append(res, item)
+		}
+	}
+
+	return res
+}
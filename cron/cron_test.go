@@ -0,0 +1,171 @@
+package cron
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// next returns the first n times after from at which expr fires.
+func next(t *testing.T, expr string, from time.Time, n int) []time.Time {
+	t.Helper()
+
+	s, err := Parse(expr)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", expr, err)
+	}
+
+	var res []time.Time
+	for range n {
+		from = s.Next(from)
+		if from.IsZero() {
+			break
+		}
+		res = append(res, from)
+	}
+
+	return res
+}
+
+func checkTimes(t *testing.T, got []time.Time, want []string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d times %v, want %v", len(got), got, want)
+	}
+	for i, w := range want {
+		wt, err := time.Parse(time.RFC3339, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got[i].Equal(wt) {
+			t.Errorf("time %d is %s, want %s", i, got[i].Format(time.RFC3339), w)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	// A Sunday.
+	from := time.Date(2026, 5, 31, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"*/15 * * * *", []string{"2026-05-31T12:15:00Z", "2026-05-31T12:30:00Z", "2026-05-31T12:45:00Z"}},
+		{"5/20 * * * *", []string{"2026-05-31T12:05:00Z", "2026-05-31T12:25:00Z", "2026-05-31T12:45:00Z"}},
+		{"30 2 * * 1-5", []string{"2026-06-01T02:30:00Z", "2026-06-02T02:30:00Z", "2026-06-03T02:30:00Z"}},
+		{"0 0 1,15 * *", []string{"2026-06-01T00:00:00Z", "2026-06-15T00:00:00Z", "2026-07-01T00:00:00Z"}},
+		{"0 0 1 feb,MAR *", []string{"2027-02-01T00:00:00Z", "2027-03-01T00:00:00Z", "2028-02-01T00:00:00Z"}},
+		{"0 0 * * 7", []string{"2026-06-07T00:00:00Z", "2026-06-14T00:00:00Z", "2026-06-21T00:00:00Z"}},
+		{"0 0 * * sat,SUN", []string{"2026-06-06T00:00:00Z", "2026-06-07T00:00:00Z", "2026-06-13T00:00:00Z"}},
+		{"0 0 29 2 *", []string{"2028-02-29T00:00:00Z", "2032-02-29T00:00:00Z", "2036-02-29T00:00:00Z"}},
+		{"0 0 30 2 *", nil},
+		{"@hourly", []string{"2026-05-31T13:00:00Z", "2026-05-31T14:00:00Z", "2026-05-31T15:00:00Z"}},
+		{"@weekly", []string{"2026-06-07T00:00:00Z", "2026-06-14T00:00:00Z", "2026-06-21T00:00:00Z"}},
+		{"@Monthly", []string{"2026-06-01T00:00:00Z", "2026-07-01T00:00:00Z", "2026-08-01T00:00:00Z"}},
+
+		// With both day fields restricted a day matching either fires;
+		// a field starting with "*" leaves the other to decide.
+		{"0 0 1 * 1", []string{"2026-06-01T00:00:00Z", "2026-06-08T00:00:00Z", "2026-06-15T00:00:00Z"}},
+		{"0 0 */2 * 1", []string{"2026-06-01T00:00:00Z", "2026-06-15T00:00:00Z", "2026-06-29T00:00:00Z"}},
+		{"0 0 * * */3", []string{"2026-06-03T00:00:00Z", "2026-06-06T00:00:00Z", "2026-06-07T00:00:00Z"}},
+		{"0 0 13 * */5", []string{"2026-09-13T00:00:00Z", "2026-11-13T00:00:00Z", "2026-12-13T00:00:00Z"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			checkTimes(t, next(t, tt.expr, from, 3), tt.want)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@often",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a-b * * * *",
+		"* * * foo *",
+		"* * * * mon-",
+	}
+
+	for _, expr := range tests {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestNextInTimeZones(t *testing.T) {
+	load := func(name string) *time.Location {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc
+	}
+	newYork := load("America/New_York")
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want []string
+	}{
+		{
+			// 02:30 doesn't exist on the day clocks go forward.
+			name: "skipped by daylight saving",
+			expr: "30 2 * * *",
+			from: time.Date(2026, 3, 7, 12, 0, 0, 0, newYork),
+			want: []string{"2026-03-09T02:30:00-04:00", "2026-03-10T02:30:00-04:00"},
+		},
+		{
+			name: "hourly across daylight saving",
+			expr: "0 * * * *",
+			from: time.Date(2026, 3, 8, 0, 30, 0, 0, newYork),
+			want: []string{"2026-03-08T01:00:00-05:00", "2026-03-08T03:00:00-04:00", "2026-03-08T04:00:00-04:00"},
+		},
+		{
+			// 01:30 happens twice on the day clocks go back.
+			name: "repeated by standard time",
+			expr: "30 1 * * *",
+			from: time.Date(2026, 10, 31, 12, 0, 0, 0, newYork),
+			want: []string{"2026-11-01T01:30:00-04:00", "2026-11-01T01:30:00-05:00", "2026-11-02T01:30:00-05:00"},
+		},
+		{
+			name: "daily at midnight across standard time",
+			expr: "@daily",
+			from: time.Date(2026, 10, 31, 12, 0, 0, 0, newYork),
+			want: []string{"2026-11-01T00:00:00-04:00", "2026-11-02T00:00:00-05:00"},
+		},
+		{
+			name: "location of the start",
+			expr: "0 9 * * *",
+			from: time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC).In(load("Asia/Tokyo")),
+			want: []string{"2026-06-02T09:00:00+09:00", "2026-06-03T09:00:00+09:00"},
+		},
+		{
+			name: "half hour offset",
+			expr: "0 0 * * *",
+			from: time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC).In(load("Asia/Kolkata")),
+			want: []string{"2026-06-02T00:00:00+05:30"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkTimes(t, next(t, tt.expr, tt.from, len(tt.want)), tt.want)
+		})
+	}
+}
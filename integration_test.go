@@ -1 +1,2315 @@
 package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"cube/cluster"
+	"cube/manager"
+	"cube/manifest"
+	"cube/node"
+	"cube/scheduler"
+	"cube/store"
+	"cube/task"
+	"cube/worker"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+func newCluster(t *testing.T, workers int) *cluster.Cluster {
+	t.Helper()
+
+	c, err := cluster.New(workers)
+	if err != nil {
+		t.Fatalf("unable to start cluster: %v", err)
+	}
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+func runTask(t *testing.T, c *cluster.Cluster, tk task.Task) uuid.UUID {
+	t.Helper()
+
+	te, err := c.Run(tk)
+	if err != nil {
+		t.Fatalf("unable to submit task: %v", err)
+	}
+
+	return te.Task.ID
+}
+
+func taskState(c *cluster.Cluster, id uuid.UUID) task.TaskState {
+	tk, _ := c.Task(id)
+	return tk.State
+}
+
+func taskWorker(c *cluster.Cluster, id uuid.UUID) string {
+	w, _ := c.Manager.TaskWorker(id)
+	return w
+}
+
+func TestTasksAreScheduledAcrossWorkers(t *testing.T) {
+	c := newCluster(t, 3)
+
+	var ids []uuid.UUID
+	for _, name := range []string{"web-1", "web-2", "web-3"} {
+		ids = append(ids, runTask(t, c, task.Task{Name: name, Image: "web"}))
+	}
+
+	c.Step()
+
+	workers := map[string]bool{}
+	for _, id := range ids {
+		if s := taskState(c, id); s != task.Running {
+			t.Fatalf("task %v is in state %d, want Running", id, s)
+		}
+		workers[taskWorker(c, id)] = true
+	}
+
+	if len(workers) != 3 {
+		t.Fatalf("tasks landed on %d workers, want 3", len(workers))
+	}
+}
+
+func TestStoppedTaskIsCompleted(t *testing.T) {
+	c := newCluster(t, 1)
+	id := runTask(t, c, task.Task{
+		Name:         "web",
+		Image:        "web",
+		ExposedPorts: nat.PortSet{"80/tcp": struct{}{}},
+		StopSignal:   "SIGQUIT",
+		StopTimeout:  30,
+		PreStopHook:  "/drain",
+	})
+	c.Step()
+
+	if err := c.Stop(id); err != nil {
+		t.Fatal(err)
+	}
+	c.Step()
+
+	if s := taskState(c, id); s != task.Completed {
+		t.Fatalf("task is in state %d, want Completed", s)
+	}
+
+	ctr, ok := c.Runtimes[0].Container("web")
+	if !ok || ctr.Status != "exited" {
+		t.Fatal("stopped container was not retained")
+	}
+	// What the pre-stop hook took is taken off the grace period.
+	if ctr.StopOptions.Signal != "SIGQUIT" || ctr.StopOptions.Timeout >= 30*time.Second || ctr.StopOptions.Timeout < 29*time.Second {
+		t.Fatalf("container was stopped with %+v", ctr.StopOptions)
+	}
+	if len(ctr.Requests) == 0 || ctr.Requests[len(ctr.Requests)-1] != "/drain" {
+		t.Fatalf("pre-stop hook was not called, requests: %v", ctr.Requests)
+	}
+
+	// A new task of the same name gets a container of its own rather than
+	// the retained one.
+	next := runTask(t, c, task.Task{Name: "web", Image: "web", Env: []string{"VERSION=2"}})
+	c.StepUntil(3, func() bool { return taskState(c, next) == task.Running })
+	nctr, _ := c.Runtimes[0].Container("web")
+	if nctr.ID == ctr.ID || nctr.Config.Labels[task.LabelTaskID] != next.String() || !slices.Equal(nctr.Config.Env, []string{"VERSION=2"}) {
+		t.Fatalf("new task runs in container %s with config %+v, want a new container", nctr.ID, nctr.Config)
+	}
+	if err := c.Stop(next); err != nil {
+		t.Fatal(err)
+	}
+	c.Step()
+
+	c.Workers[0].Retention = 0
+	c.Step()
+
+	if n := len(c.Runtimes[0].Containers()); n != 0 {
+		t.Fatalf("runtime still has %d containers after retention", n)
+	}
+}
+
+func TestCrashedTaskIsRestarted(t *testing.T) {
+	c := newCluster(t, 2)
+	id := runTask(t, c, task.Task{Name: "crashy", Image: "web"})
+	c.Step()
+
+	tk, _ := c.Task(id)
+	rt := c.Runtime(id)
+	if err := rt.Crash(tk.ContainerId); err != nil {
+		t.Fatal(err)
+	}
+
+	running := c.StepUntil(3, func() bool {
+		tk, _ := c.Task(id)
+		return tk.State == task.Running && tk.RestartCount == 1
+	})
+	if !running {
+		tk, _ := c.Task(id)
+		t.Fatalf("task was not restarted: state %d, restarts %d", tk.State, tk.RestartCount)
+	}
+
+	ctr, _ := rt.Container("crashy")
+	if ctr.Starts != 2 {
+		t.Fatalf("container started %d times, want 2", ctr.Starts)
+	}
+}
+
+func TestRestartThatCannotReachItsWorkerIsPlacedAgain(t *testing.T) {
+	c := newCluster(t, 1)
+	id := runTask(t, c, task.Task{Name: "crashy", Image: "web"})
+	c.Step()
+
+	tk, _ := c.Task(id)
+	if err := c.Runtime(id).Crash(tk.ContainerId); err != nil {
+		t.Fatal(err)
+	}
+	c.Workers[0].SyncTasks(context.Background())
+	c.Manager.SyncTasks(context.Background())
+	if s := taskState(c, id); s != task.Failed {
+		t.Fatalf("task is %v, want Failed", s)
+	}
+
+	// The restart's request to the worker fails, as when the worker is
+	// briefly unreachable.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Manager.CheckTasksHealth(ctx)
+
+	running := c.StepUntil(3, func() bool {
+		tk, _ := c.Task(id)
+		return tk.State == task.Running && tk.RestartCount == 1
+	})
+	if !running {
+		tk, _ := c.Task(id)
+		t.Fatalf("task was not restarted: state %v, restarts %d", tk.State, tk.RestartCount)
+	}
+}
+
+func TestFailingHealthCheckRestartsTask(t *testing.T) {
+	c := newCluster(t, 1)
+	id := runTask(t, c, task.Task{
+		Name:         "health",
+		Image:        "web",
+		ExposedPorts: nat.PortSet{"7777/tcp": struct{}{}},
+		HealthCheck:  "/health",
+	})
+	c.Step()
+
+	tk, _ := c.Task(id)
+	if tk.RestartCount != 0 {
+		t.Fatalf("healthy task was restarted %d times", tk.RestartCount)
+	}
+
+	c.Runtimes[0].SetHealthy(tk.ContainerId, false)
+	c.Step()
+
+	tk, _ = c.Task(id)
+	if tk.RestartCount != 1 {
+		t.Fatalf("unhealthy task restarted %d times, want 1", tk.RestartCount)
+	}
+}
+
+func TestImagePullFailureFailsTask(t *testing.T) {
+	c := newCluster(t, 1)
+	c.Runtimes[0].SetBehavior("missing", task.FakeBehavior{PullError: errors.New("pull access denied")})
+	id := runTask(t, c, task.Task{Name: "broken", Image: "missing"})
+	c.Step()
+
+	tk, _ := c.Task(id)
+	if tk.State == task.Running || tk.FailureReason != task.ReasonImagePull {
+		t.Fatalf("task with an unpullable image is in state %d with reason %q", tk.State, tk.FailureReason)
+	}
+	if n := len(c.Runtimes[0].Containers()); n != 0 {
+		t.Fatalf("runtime has %d containers, want none", n)
+	}
+}
+
+func TestPullPolicyNeverRequiresLocalImage(t *testing.T) {
+	c := newCluster(t, 1)
+	missing := runTask(t, c, task.Task{Name: "missing", Image: "absent", PullPolicy: task.PullNever})
+	c.Runtimes[0].Pulled("present")
+	present := runTask(t, c, task.Task{Name: "present", Image: "present", PullPolicy: task.PullNever})
+	c.Step()
+
+	if tk, _ := c.Task(missing); tk.FailureReason != task.ReasonImagePull {
+		t.Fatalf("task without a local image has reason %q", tk.FailureReason)
+	}
+	if s := taskState(c, present); s != task.Running {
+		t.Fatalf("task with a local image is in state %d", s)
+	}
+}
+
+func TestTaskCommandAndEnvironmentReachRuntime(t *testing.T) {
+	c := newCluster(t, 1)
+	runTask(t, c, task.Task{
+		Name:       "cmd",
+		Image:      "web",
+		Entrypoint: []string{"/bin/server"},
+		Cmd:        []string{"--port", "8080"},
+		Env:        []string{"MODE=test"},
+		WorkingDir: "/srv",
+		User:       "nobody",
+	})
+	c.Step()
+
+	ctr, ok := c.Runtimes[0].Container("cmd")
+	if !ok {
+		t.Fatal("container was not created")
+	}
+
+	cfg := ctr.Config
+	if cfg.Entrypoint[0] != "/bin/server" || len(cfg.Cmd) != 2 || cfg.Env[0] != "MODE=test" || cfg.WorkingDir != "/srv" || cfg.User != "nobody" {
+		t.Fatalf("runtime got config %+v", cfg)
+	}
+}
+
+func TestTasksWithSameHostPortAreSpreadAcrossNodes(t *testing.T) {
+	c := newCluster(t, 2)
+	port := freePort(t)
+
+	newTask := func(name string) task.Task {
+		return task.Task{
+			Name:         name,
+			Image:        "web",
+			ExposedPorts: nat.PortSet{"7777/tcp": struct{}{}},
+			PortBindings: map[string]string{"7777/tcp": port},
+		}
+	}
+
+	first := runTask(t, c, newTask("bound-1"))
+	second := runTask(t, c, newTask("bound-2"))
+	third := runTask(t, c, newTask("bound-3"))
+	c.Step()
+
+	if taskWorker(c, first) == taskWorker(c, second) {
+		t.Fatalf("tasks binding host port %s were placed on the same node", port)
+	}
+
+	for _, id := range []uuid.UUID{first, second} {
+		tk, _ := c.Task(id)
+		if tk.State != task.Running || tk.HostPorts["7777/tcp"][0].HostPort != port {
+			t.Fatalf("task %v is in state %d with ports %v", id, tk.State, tk.HostPorts)
+		}
+	}
+
+	// A task no node can take stays pending, and is placed once one can
+	// and its backoff has passed.
+	if tk, ok := c.Task(third); !ok || tk.State != task.Pending {
+		t.Fatalf("a third task is %v although every node holds the host port, want Pending", tk.State)
+	}
+
+	if err := c.Stop(first); err != nil {
+		t.Fatal(err)
+	}
+	c.Step()
+	if st := taskState(c, third); st != task.Pending {
+		t.Fatalf("task is %v before its backoff passed, want Pending", st)
+	}
+
+	c.Manager.Now = func() time.Time { return time.Now().Add(manager.DefaultRetryInterval) }
+	ok := c.StepUntil(3, func() bool { return taskState(c, third) == task.Running })
+	if !ok {
+		t.Fatalf("pending task is %v after a node freed up, want Running", taskState(c, third))
+	}
+	if taskWorker(c, third) != taskWorker(c, first) {
+		t.Fatal("pending task was not placed on the node that freed up")
+	}
+
+	// Binding host port 0 asks for a random one, which holds no port.
+	var random []uuid.UUID
+	for i := range 3 {
+		random = append(random, runTask(t, c, task.Task{
+			Name:         fmt.Sprintf("random-%d", i),
+			Image:        "web",
+			PortBindings: map[string]string{"8080/tcp": "0"},
+		}))
+	}
+	ok = c.StepUntil(3, func() bool {
+		return !slices.ContainsFunc(random, func(id uuid.UUID) bool { return taskState(c, id) != task.Running })
+	})
+	if !ok {
+		t.Fatal("tasks binding random host ports were not all placed")
+	}
+
+	data, _ := json.Marshal(task.TaskEvent{ID: uuid.New(), State: task.Running, Task: task.Task{
+		ID:           uuid.New(),
+		Name:         "invalid",
+		Image:        "web",
+		PortBindings: map[string]string{"8080/tcp": "http"},
+	}})
+	resp, err := http.Post(c.ManagerUrl+"/tasks", "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("task with an invalid port binding returned %d, want 400", resp.StatusCode)
+	}
+}
+
+// freePort returns a port free on each of the loopback addresses the
+// cluster's workers may listen on, which an ephemeral port on one of them,
+// such as a worker's API, might otherwise hold.
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	for range 10 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+
+		free := true
+		for i := 2; i <= 9 && free; i++ {
+			ol, err := net.Listen("tcp", net.JoinHostPort(fmt.Sprintf("127.0.0.%d", i), port))
+			if err != nil {
+				free = !errors.Is(err, syscall.EADDRINUSE)
+				continue
+			}
+			ol.Close()
+		}
+		l.Close()
+
+		if free {
+			return port
+		}
+	}
+
+	t.Fatal("no port free on every loopback address")
+	return ""
+}
+
+func TestNamedVolumesFollowTaskLifecycle(t *testing.T) {
+	c := newCluster(t, 1)
+	c.Workers[0].Retention = 0
+	id := runTask(t, c, task.Task{
+		Name:  "db",
+		Image: "postgres",
+		Disk:  1024,
+		Mounts: []task.Mount{
+			{Type: task.MountVolume, Source: "db-data", Target: "/var/lib/postgresql/data"},
+			{Type: task.MountTmpfs, Target: "/tmp", Size: 64},
+		},
+	})
+	c.Step()
+
+	rt := c.Runtimes[0]
+	if v := rt.Volumes(); len(v) != 1 || v[0] != "db-data" {
+		t.Fatalf("runtime has volumes %v, want [db-data]", v)
+	}
+	if n := c.Manager.NodeDiskAllocated(c.Manager.Workers[0]); n != 1024 {
+		t.Fatalf("node has %d bytes of disk allocated, want 1024", n)
+	}
+
+	if err := c.Stop(id); err != nil {
+		t.Fatal(err)
+	}
+	c.Step()
+
+	if v := rt.Volumes(); len(v) != 0 {
+		t.Fatalf("volumes %v were not removed", v)
+	}
+	if n := c.Manager.NodeDiskAllocated(c.Manager.Workers[0]); n != 0 {
+		t.Fatalf("node still has %d bytes of disk allocated", n)
+	}
+}
+
+// statsScheduler stands in for a scheduler that asks the nodes it scores
+// for their stats, as the epvm one does.
+type statsScheduler struct {
+	scheduler.RoundRobin
+	disk int64
+}
+
+func (s *statsScheduler) Score(t task.Task, nodes []*node.Node) map[string]float64 {
+	for _, n := range nodes {
+		n.Disk = s.disk
+		n.Memory = 1 << 20
+	}
+
+	return s.RoundRobin.Score(t, nodes)
+}
+
+func TestNodeCapacityLearnedWhileSchedulingIsKept(t *testing.T) {
+	c := newCluster(t, 1)
+	c.Manager.Scheduler = &statsScheduler{disk: 2048}
+	volumeTask := func(name string, disk int64) task.Task {
+		return task.Task{
+			Name:   name,
+			Image:  "postgres",
+			Disk:   disk,
+			Mounts: []task.Mount{{Type: task.MountVolume, Source: name + "-data", Target: "/data"}},
+		}
+	}
+
+	first := runTask(t, c, volumeTask("first", 1024))
+	c.Step()
+	if s := taskState(c, first); s != task.Running {
+		t.Fatalf("first task is %v, want Running", s)
+	}
+	if n := c.Manager.GetNodes()[0]; n.Disk != 2048 || n.Memory != 1<<20 {
+		t.Fatalf("node has %d bytes of disk and %d of memory, want what the scheduler learned", n.Disk, n.Memory)
+	}
+
+	// Without a heartbeat, the node's disk is known only from scheduling,
+	// and now holds a volume task to it.
+	second := runTask(t, c, volumeTask("second", 2048))
+	c.Step()
+	if s := taskState(c, second); s != task.Pending {
+		t.Fatalf("second task is %v, want it Pending for lack of disk", s)
+	}
+}
+
+func TestTaskLogsAreProxiedThroughManager(t *testing.T) {
+	c := newCluster(t, 2)
+	for _, rt := range c.Runtimes {
+		rt.SetBehavior("chatty", task.FakeBehavior{Stdout: "hello\n", Stderr: "oops\n"})
+	}
+	id := runTask(t, c, task.Task{Name: "chatty", Image: "chatty"})
+	c.Step()
+
+	resp, err := http.Get(fmt.Sprintf("%s/tasks/%s/logs?tail=10", c.ManagerUrl, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello\noops\n" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("%s/tasks/%s/logs", c.ManagerUrl, uuid.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("logs of an unknown task returned %d", resp.StatusCode)
+	}
+}
+
+func TestExecInTaskThroughManager(t *testing.T) {
+	c := newCluster(t, 1)
+	c.Runtimes[0].SetBehavior("shell", task.FakeBehavior{
+		Exec: func(opts task.ExecOptions, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+			if stdin != nil {
+				io.Copy(stdout, stdin)
+				return 0
+			}
+			io.WriteString(stderr, "no such file\n")
+			return 2
+		},
+	})
+	id := runTask(t, c, task.Task{Name: "shell", Image: "shell"})
+	c.Step()
+
+	body := strings.NewReader(`{"Cmd": ["cat", "/missing"]}`)
+	resp, err := http.Post(fmt.Sprintf("%s/tasks/%s/exec", c.ManagerUrl, id), "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	res := worker.ExecResponse{}
+	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != http.StatusOK || res.ExitCode != 2 || res.Stderr != "no such file\n" {
+		t.Fatalf("got %d %+v", resp.StatusCode, res)
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(c.ManagerUrl, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/tasks/%s/exec?interactive=true", c.ManagerUrl, id), strings.NewReader(`{"Cmd": ["cat"]}`))
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	req.Write(conn)
+
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, req)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("interactive exec was not upgraded: %v %v", resp, err)
+	}
+
+	io.WriteString(conn, "ping\n")
+	conn.(*net.TCPConn).CloseWrite()
+
+	out, _ := io.ReadAll(br)
+	if string(out) != "ping\n" {
+		t.Fatalf("interactive exec returned %q", out)
+	}
+}
+
+func TestManagerStateSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manager.db")
+	s, err := store.NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := cluster.NewWithStore(2, s)
+	if err != nil {
+		t.Fatalf("unable to start cluster: %v", err)
+	}
+	t.Cleanup(c.Close)
+
+	running := []uuid.UUID{
+		runTask(t, c, task.Task{Name: "web-1", Image: "web"}),
+		runTask(t, c, task.Task{Name: "web-2", Image: "web"}),
+	}
+	c.Step()
+	assigned := map[uuid.UUID]string{}
+	for _, id := range running {
+		assigned[id] = taskWorker(c, id)
+	}
+
+	pending := runTask(t, c, task.Task{Name: "web-3", Image: "web"})
+
+	// Every write is synced, so reopening the file sees exactly what the
+	// old manager left on disk.
+	s, err = store.NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RestartManager(s); err != nil {
+		t.Fatalf("unable to restart manager: %v", err)
+	}
+
+	for _, id := range running {
+		if st := taskState(c, id); st != task.Running {
+			t.Fatalf("task %v is in state %d after restart, want Running", id, st)
+		}
+		if w := taskWorker(c, id); w != assigned[id] {
+			t.Fatalf("task %v is assigned to %q after restart, want %q", id, w, assigned[id])
+		}
+	}
+	if n := c.Manager.PendingLen(); n != 1 {
+		t.Fatalf("manager has %d pending events after restart, want 1", n)
+	}
+
+	c.Step()
+
+	if st := taskState(c, pending); st != task.Running {
+		t.Fatalf("pending task is in state %d, want Running", st)
+	}
+}
+
+func TestRestartedWorkerAdoptsItsContainers(t *testing.T) {
+	c := newCluster(t, 1)
+
+	path := filepath.Join(t.TempDir(), "worker-1.db")
+	s, err := store.NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RestartWorker(0, s); err != nil {
+		t.Fatalf("unable to restart worker: %v", err)
+	}
+
+	live := runTask(t, c, task.Task{Name: "live", Image: "web"})
+	gone := runTask(t, c, task.Task{Name: "gone", Image: "web"})
+	done := runTask(t, c, task.Task{Name: "done", Image: "web", RunToCompletion: true})
+	crashed := runTask(t, c, task.Task{Name: "crashed", Image: "web", RunToCompletion: true})
+	c.Step()
+
+	liveCtr, _ := c.Task(live)
+	goneCtr, _ := c.Task(gone)
+	if err := c.Runtimes[0].Remove(context.Background(), goneCtr.ContainerId); err != nil {
+		t.Fatal(err)
+	}
+
+	// Jobs finish whether or not their worker is up to see it.
+	doneCtr, _ := c.Task(done)
+	crashedCtr, _ := c.Task(crashed)
+	c.Runtimes[0].Exit(doneCtr.ContainerId, 0)
+	c.Runtimes[0].Exit(crashedCtr.ContainerId, 3)
+
+	s, err = store.NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RestartWorker(0, s); err != nil {
+		t.Fatalf("unable to restart worker: %v", err)
+	}
+
+	if tk, ok := c.Workers[0].GetTask(live); !ok || tk.State != task.Running || tk.ContainerId != liveCtr.ContainerId {
+		t.Fatalf("live task was not adopted: %+v", tk)
+	}
+	if tk, ok := c.Workers[0].GetTask(gone); !ok || tk.State != task.Failed {
+		t.Fatalf("task with vanished container was not failed: %+v", tk)
+	}
+	if tk, ok := c.Workers[0].GetTask(done); !ok || tk.State != task.Completed || tk.ExitCode != 0 {
+		t.Fatalf("job task that exited 0 was not completed: %+v", tk)
+	}
+	if tk, ok := c.Workers[0].GetTask(crashed); !ok || tk.State != task.Failed || tk.ExitCode != 3 {
+		t.Fatalf("job task that exited 3 was not failed: %+v", tk)
+	}
+
+	c.Step()
+	if st := taskState(c, live); st != task.Running {
+		t.Fatalf("live task is in state %d, want Running", st)
+	}
+	if st := taskState(c, done); st != task.Completed {
+		t.Fatalf("job task is in state %d, want Completed", st)
+	}
+
+	// A worker that lost its state still adopts the running containers.
+	if err := c.RestartWorker(0, store.NewMemory()); err != nil {
+		t.Fatalf("unable to restart worker: %v", err)
+	}
+	if tk, ok := c.Workers[0].GetTask(live); !ok || tk.State != task.Running || tk.Name != "live" {
+		t.Fatalf("unknown container was not adopted: %+v", tk)
+	}
+}
+
+// TestConcurrentApiAndLoops runs every manager and worker loop in its own
+// goroutine while clients hammer both APIs. Run it with -race.
+func TestConcurrentApiAndLoops(t *testing.T) {
+	c := newCluster(t, 3)
+
+	done := make(chan struct{})
+	var loops sync.WaitGroup
+	loop := func(f func()) {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					f()
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+		}()
+	}
+
+	ctx := t.Context()
+	loop(func() { c.Manager.SendWork(ctx) })
+	loop(func() { c.Manager.SyncTasks(ctx) })
+	loop(func() { c.Manager.CheckTasksHealth(ctx) })
+	for _, w := range c.Workers {
+		loop(func() { w.RunTask(ctx) })
+		loop(func() { w.SyncTasks(ctx) })
+	}
+
+	const clients, perClient = 4, 20
+	var mu sync.Mutex
+	submitted := map[uuid.UUID]bool{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perClient; j++ {
+				te, err := c.Run(task.Task{Name: fmt.Sprintf("web-%d-%d", i, j), Image: "web"})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				submitted[te.Task.ID] = true
+				mu.Unlock()
+
+				for _, url := range append([]string{c.ManagerUrl}, c.Manager.Workers...) {
+					if !strings.HasPrefix(url, "http://") {
+						url = "http://" + url
+					}
+					resp, err := http.Get(url + "/tasks")
+					if err == nil {
+						resp.Body.Close()
+					}
+				}
+
+				resp, err := http.Get(fmt.Sprintf("%s/tasks/%s/logs", c.ManagerUrl, te.Task.ID))
+				if err == nil {
+					resp.Body.Close()
+				}
+
+				// The task may not have been scheduled yet, in which
+				// case the manager doesn't know it and the stop fails.
+				if j%4 == 0 {
+					c.Stop(te.Task.ID)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	close(done)
+	loops.Wait()
+
+	settled := c.StepUntil(20, func() bool {
+		for id := range submitted {
+			if s := taskState(c, id); s != task.Running && s != task.Completed {
+				return false
+			}
+		}
+		return true
+	})
+	if !settled {
+		for id := range submitted {
+			if s := taskState(c, id); s != task.Running && s != task.Completed {
+				t.Errorf("task %v is in state %d", id, s)
+			}
+		}
+		t.Fatal("tasks did not settle")
+	}
+
+	if n := len(c.Manager.GetTasks()); n != clients*perClient {
+		t.Fatalf("manager knows %d tasks, want %d", n, clients*perClient)
+	}
+}
+
+func TestEventsAreDispatchedWithoutWaiting(t *testing.T) {
+	c := newCluster(t, 2)
+	go c.Manager.ProcessTasks(t.Context())
+	for _, w := range c.Workers {
+		go w.RunTasks(t.Context())
+	}
+
+	var ids []uuid.UUID
+	for i := 0; i < 50; i++ {
+		ids = append(ids, runTask(t, c, task.Task{Name: fmt.Sprintf("web-%d", i), Image: "web"}))
+	}
+
+	workerState := func(id uuid.UUID) task.TaskState {
+		for _, w := range c.Workers {
+			if tk, ok := w.GetTask(id); ok {
+				return tk.State
+			}
+		}
+		return task.Pending
+	}
+	waitFor := func(ids []uuid.UUID, want task.TaskState) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for _, id := range ids {
+			for workerState(id) != want {
+				if time.Now().After(deadline) {
+					t.Fatalf("task %v is in state %d on its worker, want %d", id, workerState(id), want)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}
+
+	waitFor(ids, task.Running)
+
+	// Let the manager see the tasks running before stopping some of them.
+	c.Step()
+	for _, id := range ids[:10] {
+		if err := c.Stop(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(ids[:10], task.Completed)
+}
+
+func TestShutdownStopsLoopsAndAppliesPolicy(t *testing.T) {
+	c := newCluster(t, 2)
+	c.Workers[0].ShutdownPolicy = worker.ShutdownStopTasks
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	for _, f := range []func(context.Context){
+		c.Manager.ProcessTasks,
+		c.Manager.UpdateTasks,
+		c.Manager.DoHealthChecks,
+		c.Workers[0].RunTasks,
+		c.Workers[0].UpdateTasks,
+		c.Workers[1].RunTasks,
+		c.Workers[1].UpdateTasks,
+	} {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			f(ctx)
+		}()
+	}
+
+	ids := []uuid.UUID{
+		runTask(t, c, task.Task{Name: "web-1", Image: "web"}),
+		runTask(t, c, task.Task{Name: "web-2", Image: "web"}),
+	}
+	if !c.StepUntil(20, func() bool {
+		return taskState(c, ids[0]) == task.Running && taskState(c, ids[1]) == task.Running
+	}) {
+		t.Fatal("tasks did not start")
+	}
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		loops.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loops did not stop after cancellation")
+	}
+
+	for i, w := range c.Workers {
+		if err := w.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		ctrs := c.Runtimes[i].Containers()
+		if len(ctrs) != 1 {
+			t.Fatalf("%s has %d containers, want 1", w.Name, len(ctrs))
+		}
+		for _, ctr := range ctrs {
+			want := "running"
+			if w.ShutdownPolicy == worker.ShutdownStopTasks {
+				want = "exited"
+			}
+			if ctr.Status != want {
+				t.Fatalf("container %s on %s is %s after shutdown, want %s", ctr.Name, w.Name, ctr.Status, want)
+			}
+		}
+
+		// Tasks stopped on shutdown neither ran to completion nor were
+		// asked to stop, so they fail.
+		for _, tk := range w.GetTasks() {
+			if w.ShutdownPolicy != worker.ShutdownStopTasks {
+				if tk.State != task.Running {
+					t.Fatalf("task %v on %s is %v after shutdown, want Running", tk.ID, w.Name, tk.State)
+				}
+				continue
+			}
+			if tk.State != task.Failed || tk.FailureReason != task.ReasonWorkerShutdown || tk.Stopped {
+				t.Fatalf("task %v on %s is %v (%q) after shutdown, want Failed (%q)", tk.ID, w.Name, tk.State, tk.FailureReason, task.ReasonWorkerShutdown)
+			}
+		}
+	}
+}
+
+func TestCliRunStatusNodesAndStop(t *testing.T) {
+	c := newCluster(t, 2)
+	addr := strings.TrimPrefix(c.ManagerUrl, "http://")
+
+	var out strings.Builder
+	err := cmdRun([]string{"-manager", addr, "-name", "cli", "-image", "web", "-e", "A=1", "-p", "8080:80", "--", "serve", "-v"}, &out)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	id, err := uuid.Parse(strings.TrimSpace(out.String()))
+	if err != nil {
+		t.Fatalf("run printed %q, want a task ID", out.String())
+	}
+
+	c.Step()
+
+	tk, _ := c.Task(id)
+	if tk.State != task.Running || tk.PortBindings["80/tcp"] != "8080" || strings.Join(tk.Cmd, " ") != "serve -v" {
+		t.Fatalf("task is %+v, want it Running with its port and command", tk)
+	}
+
+	out.Reset()
+	err = cmdStatus([]string{"-manager", addr}, &out)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if !strings.Contains(out.String(), id.String()) || !strings.Contains(out.String(), "Running") {
+		t.Fatalf("status printed %q, want the running task", out.String())
+	}
+
+	out.Reset()
+	err = cmdNode([]string{"ls", "-manager", addr}, &out)
+	if err != nil {
+		t.Fatalf("node ls: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 {
+		t.Fatalf("node ls printed %q, want a header and 2 nodes", out.String())
+	}
+
+	err = cmdStop([]string{"-manager", addr, id.String()}, io.Discard)
+	if err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	c.Step()
+
+	if s := taskState(c, id); s != task.Completed {
+		t.Fatalf("task is in state %v after stop, want Completed", s)
+	}
+
+	err = cmdStop([]string{"-manager", addr, uuid.NewString()}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("stopping an unknown task returned %v, want a 404", err)
+	}
+}
+
+func TestFlagsPreferCommandLineThenEnvThenConfig(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "cube.json")
+	err := os.WriteFile(config, []byte(`{"manager": {"workers": ["a:1", "b:2"], "port": 6000}}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CUBE_MANAGER_PORT", "7000")
+	t.Setenv("CUBE_SCHEDULER", "epvm")
+
+	var (
+		workers, scheduler string
+		port               int
+	)
+	f := newFlags("manager", "manager")
+	f.stringVar(&workers, "workers", "CUBE_WORKERS", "", "")
+	f.stringVar(&scheduler, "scheduler", "CUBE_SCHEDULER", "roundrobin", "")
+	f.intVar(&port, "port", "CUBE_MANAGER_PORT", 5555, "")
+	err = f.parse([]string{"-config", config, "-workers", "c:3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if workers != "c:3" || port != 7000 || scheduler != "epvm" {
+		t.Fatalf("got workers %q, port %d, scheduler %q", workers, port, scheduler)
+	}
+}
+
+func ownedTasks(c *cluster.Cluster, owner string, state task.TaskState) []*task.Task {
+	var res []*task.Task
+	for _, tk := range c.Manager.GetTasks() {
+		if tk.Owner == owner && tk.State == state {
+			res = append(res, tk)
+		}
+	}
+
+	return res
+}
+
+func TestApplyConvergesOnManifest(t *testing.T) {
+	c := newCluster(t, 1)
+	addr := strings.TrimPrefix(c.ManagerUrl, "http://")
+	port := freePort(t)
+	path := filepath.Join(t.TempDir(), "app.yaml")
+
+	apply := func(manifest string, dryRun bool) string {
+		t.Helper()
+
+		err := os.WriteFile(path, []byte(manifest), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out strings.Builder
+		err = cmdApply([]string{"-manager", addr, "-f", path, fmt.Sprintf("-dry-run=%v", dryRun)}, &out)
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+
+		return out.String()
+	}
+
+	v1 := fmt.Sprintf(`
+tasks:
+  - name: web
+    image: web
+    env: [VERSION=1]
+    ports: {"7777/tcp": "%s"}
+  - name: db
+    image: db
+`, port)
+
+	if out := apply(v1, false); out != "task/db created\ntask/web created\n" {
+		t.Fatalf("first apply printed %q", out)
+	}
+	c.Step()
+
+	web := ownedTasks(c, "task/web", task.Running)
+	if len(web) != 1 || len(ownedTasks(c, "task/db", task.Running)) != 1 {
+		t.Fatalf("web and db are not running once each: %+v", c.Manager.GetTasks())
+	}
+
+	if out := apply(v1, false); out != "task/db unchanged\ntask/web unchanged\n" {
+		t.Fatalf("reapplying printed %q", out)
+	}
+
+	v2 := fmt.Sprintf(`
+tasks:
+  - name: web
+    image: web
+    env: [VERSION=2]
+    ports: {"7777/tcp": "%s"}
+`, port)
+
+	if out := apply(v2, true); out != "task/web updated (dry run)\ntask/db stopped (dry run)\n" {
+		t.Fatalf("dry run printed %q", out)
+	}
+	c.Step()
+	if got := ownedTasks(c, "task/web", task.Running); len(got) != 1 || got[0].ID != web[0].ID {
+		t.Fatal("a dry run changed the running tasks")
+	}
+
+	if out := apply(v2, false); out != "task/web updated\ntask/db stopped\n" {
+		t.Fatalf("update printed %q", out)
+	}
+
+	// The new web task needs the host port the old one holds on the only
+	// node, so it is placed once the old one has stopped.
+	ok := c.StepUntil(5, func() bool {
+		got := ownedTasks(c, "task/web", task.Running)
+		return len(got) == 1 && got[0].ID != web[0].ID
+	})
+	if !ok {
+		t.Fatalf("web was not replaced: %+v", c.Manager.GetTasks())
+	}
+
+	if tk, _ := c.Task(web[0].ID); tk.State != task.Completed {
+		t.Fatalf("old web task is in state %v, want Completed", tk.State)
+	}
+	if n := len(ownedTasks(c, "task/db", task.Running)); n != 0 {
+		t.Fatalf("%d db tasks still running after it was removed from the manifest", n)
+	}
+
+	newWeb := ownedTasks(c, "task/web", task.Running)[0]
+	ctr, _ := c.Runtime(newWeb.ID).Container(newWeb.Name)
+	if env := strings.Join(ctr.Config.Env, ","); env != "VERSION=2" {
+		t.Fatalf("new web task runs with env %q", env)
+	}
+}
+
+func TestManifestParsesYamlAndJson(t *testing.T) {
+	fromYaml, err := manifest.Parse([]byte("tasks:\n  - name: web\n    image: web\n    exposedPorts: [80]\n    mounts:\n      - type: bind\n        source: /srv\n        target: /data\n        readOnly: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJson, err := manifest.Parse([]byte(`{"tasks": [{"name": "web", "image": "web", "exposedPorts": ["80"], "mounts": [{"type": "bind", "source": "/srv", "target": "/data", "readOnly": true}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromYaml.Tasks[0].Hash() != fromJson.Tasks[0].Hash() {
+		t.Fatalf("YAML and JSON manifests differ: %+v and %+v", fromYaml, fromJson)
+	}
+	if m := fromYaml.Tasks[0].Mounts; len(m) != 1 || !m[0].ReadOnly {
+		t.Fatalf("mounts parsed as %+v, want a read-only bind mount", m)
+	}
+
+	for _, bad := range []string{
+		"tasks:\n  - name: web\n    image: web\n    imgae: typo\n",
+		"tasks:\n  - name: web\n",
+		"tasks:\n  - name: web\n    image: a\n  - name: web\n    image: b\n",
+		"jobs:\n  - name: backup\n    template:\n      image: backup\n      restartPolicy: always\n",
+		"workflows:\n  - name: etl\n    steps:\n      - name: load\n        dependsOn: [extract]\n        template:\n          image: load\n",
+		"workflows:\n  - name: etl\n    steps:\n      - name: a\n        dependsOn: [b]\n        template:\n          image: a\n      - name: b\n        dependsOn: [a]\n        template:\n          image: b\n",
+		"tasks:\n  - name: web\n    image: web\n    sidecars:\n      - name: main\n        image: proxy\n",
+		"tasks:\n  - name: web\n    image: web\n    initContainers:\n      - name: migrate\n",
+	} {
+		if _, err := manifest.Parse([]byte(bad)); err == nil {
+			t.Fatalf("manifest %q was accepted", bad)
+		}
+	}
+}
+
+func TestServiceKeepsReplicasAndScales(t *testing.T) {
+	c := newCluster(t, 2)
+	addr := strings.TrimPrefix(c.ManagerUrl, "http://")
+
+	res, err := c.Apply(manifest.Manifest{Services: []manifest.Service{
+		{Name: "web", Replicas: 3, Template: manifest.TaskSpec{Image: "web"}},
+	}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Created, ",") != "service/web" {
+		t.Fatalf("apply returned %+v, want service/web created", res)
+	}
+	c.Step()
+
+	replicas := ownedTasks(c, "service/web", task.Running)
+	if len(replicas) != 3 {
+		t.Fatalf("%d replicas running, want 3", len(replicas))
+	}
+
+	// A replica that is stopped behind the service's back is replaced, and
+	// so is one that keeps crashing once its restarts run out.
+	if err := c.Stop(replicas[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	crashing := replicas[1]
+	ok := c.StepUntil(10, func() bool {
+		if tk, _ := c.Task(crashing.ID); tk.State == task.Running {
+			c.Runtime(crashing.ID).Crash(tk.ContainerId)
+		}
+		tk, _ := c.Task(crashing.ID)
+		return tk.State == task.Failed && tk.RestartCount >= 3 && len(ownedTasks(c, "service/web", task.Running)) == 3
+	})
+	if !ok {
+		t.Fatalf("replicas were not replaced: %+v", c.Manager.GetTasks())
+	}
+	for _, tk := range ownedTasks(c, "service/web", task.Running) {
+		if tk.ID == replicas[0].ID || tk.ID == crashing.ID {
+			t.Fatalf("replica %v counts as running after it was stopped or gave up", tk.ID)
+		}
+	}
+
+	var out strings.Builder
+	err = cmdService([]string{"scale", "-manager", addr, "web", "1"}, &out)
+	if err != nil {
+		t.Fatalf("scale: %v", err)
+	}
+	c.Step()
+	if n := len(ownedTasks(c, "service/web", task.Running)); n != 1 {
+		t.Fatalf("%d replicas running after scaling to 1", n)
+	}
+
+	err = cmdService([]string{"scale", "-manager", addr, "web", "2"}, io.Discard)
+	if err != nil {
+		t.Fatalf("scale: %v", err)
+	}
+	c.Step()
+
+	out.Reset()
+	err = cmdService([]string{"ls", "-manager", addr}, &out)
+	if err != nil {
+		t.Fatalf("service ls: %v", err)
+	}
+	if !strings.Contains(out.String(), "2/2") {
+		t.Fatalf("service ls printed %q, want 2/2 replicas", out.String())
+	}
+
+	err = cmdService([]string{"scale", "-manager", addr, "api", "2"}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("scaling an unknown service returned %v, want a 404", err)
+	}
+
+	err = cmdService([]string{"rm", "-manager", addr, "web"}, io.Discard)
+	if err != nil {
+		t.Fatalf("service rm: %v", err)
+	}
+	c.Step()
+	if n := len(ownedTasks(c, "service/web", task.Running)); n != 0 {
+		t.Fatalf("%d replicas still running after the service was removed", n)
+	}
+}
+
+func TestApplyLeavesApiObjectsAlone(t *testing.T) {
+	c := newCluster(t, 1)
+	addr := strings.TrimPrefix(c.ManagerUrl, "http://")
+
+	data, _ := json.Marshal(manifest.Service{Name: "api", Replicas: 1, Template: manifest.TaskSpec{Image: "api"}})
+	resp, err := http.Post(c.ManagerUrl+"/services", "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating service returned %d", resp.StatusCode)
+	}
+
+	res, err := c.Apply(manifest.Manifest{Services: []manifest.Service{
+		{Name: "web", Replicas: 1, Template: manifest.TaskSpec{Image: "web"}},
+		{Name: "db", Replicas: 1, Template: manifest.TaskSpec{Image: "db"}},
+	}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Stopped) != 0 {
+		t.Fatalf("apply stopped %v, want the service made through the API left alone", res.Stopped)
+	}
+	c.Step()
+	if n := len(ownedTasks(c, "service/api", task.Running)); n != 1 {
+		t.Fatalf("%d replicas of the service made through the API running, want 1", n)
+	}
+
+	// A service changed through the API is no longer the manifest's to
+	// remove.
+	err = cmdService([]string{"scale", "-manager", addr, "db", "2"}, io.Discard)
+	if err != nil {
+		t.Fatalf("scale: %v", err)
+	}
+	res, err = c.Apply(manifest.Manifest{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Step()
+	if strings.Join(res.Stopped, ",") != "service/web" {
+		t.Fatalf("apply stopped %v, want only service/web", res.Stopped)
+	}
+	for owner, want := range map[string]int{"service/api": 1, "service/db": 2, "service/web": 0} {
+		if n := len(ownedTasks(c, owner, task.Running)); n != want {
+			t.Fatalf("%d tasks of %s running, want %d", n, owner, want)
+		}
+	}
+}
+
+func serviceStatus(t *testing.T, c *cluster.Cluster, name string) manager.ServiceStatus {
+	t.Helper()
+
+	st, ok := c.Manager.GetService(name)
+	if !ok {
+		t.Fatalf("no service %s", name)
+	}
+
+	return st
+}
+
+func webService(image string) manifest.Manifest {
+	return manifest.Manifest{Services: []manifest.Service{{
+		Name:     "web",
+		Replicas: 3,
+		Template: manifest.TaskSpec{Image: image, ExposedPorts: []string{"7777/tcp"}, HealthCheck: "/health"},
+	}}}
+}
+
+func TestServiceRollsOutInBatches(t *testing.T) {
+	c := newCluster(t, 2)
+
+	if _, err := c.Apply(webService("web:1"), false); err != nil {
+		t.Fatal(err)
+	}
+	ok := c.StepUntil(5, func() bool {
+		st := serviceStatus(t, c, "web")
+		return st.Ready == 3 && st.Rollout.State == manager.RolloutComplete
+	})
+	if !ok {
+		t.Fatalf("first revision was not rolled out: %+v", serviceStatus(t, c, "web"))
+	}
+
+	if _, err := c.Apply(webService("web:2"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// With the default strategy one extra replica may run and none may be
+	// missing while the old ones are replaced.
+	ok = c.StepUntil(20, func() bool {
+		st := serviceStatus(t, c, "web")
+		if st.Ready < 3 || len(st.Tasks) > 4 {
+			t.Fatalf("rollout broke its bounds: %d ready, %d replicas", st.Ready, len(st.Tasks))
+		}
+		return st.Rollout.Revision == 2 && st.Rollout.State == manager.RolloutComplete
+	})
+	if !ok {
+		t.Fatalf("second revision was not rolled out: %+v", serviceStatus(t, c, "web"))
+	}
+
+	for _, id := range serviceStatus(t, c, "web").Tasks {
+		if tk, _ := c.Task(id); tk.Image != "web:2" || tk.Revision != 2 {
+			t.Fatalf("replica %v runs %s from revision %d after the rollout", id, tk.Image, tk.Revision)
+		}
+	}
+	if n := len(ownedTasks(c, "service/web", task.Running)); n != 3 {
+		t.Fatalf("%d replicas running after the rollout, want 3", n)
+	}
+
+	revs, err := c.Manager.GetRevisions("web")
+	if err != nil || len(revs) != 2 || revs[1].Template.Image != "web:2" {
+		t.Fatalf("revision history is %+v, %v", revs, err)
+	}
+}
+
+func TestFailedRolloutIsRolledBack(t *testing.T) {
+	c := newCluster(t, 2)
+	addr := strings.TrimPrefix(c.ManagerUrl, "http://")
+	for _, rt := range c.Runtimes {
+		rt.SetBehavior("web:bad", task.FakeBehavior{Unhealthy: true})
+	}
+
+	if _, err := c.Apply(webService("web:1"), false); err != nil {
+		t.Fatal(err)
+	}
+	c.StepUntil(5, func() bool { return serviceStatus(t, c, "web").Rollout.State == manager.RolloutComplete })
+	before := serviceStatus(t, c, "web").Tasks
+
+	if _, err := c.Apply(webService("web:bad"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	ok := c.StepUntil(10, func() bool {
+		r := serviceStatus(t, c, "web").Rollout
+		return r.Revision == 3 && r.Rollback && r.State == manager.RolloutComplete
+	})
+	if !ok {
+		t.Fatalf("failed revision was not rolled back: %+v", serviceStatus(t, c, "web"))
+	}
+
+	// The new replica never became ready, so no old one was stopped.
+	st := serviceStatus(t, c, "web")
+	if fmt.Sprint(st.Tasks) != fmt.Sprint(before) || st.Template.Image != "web:1" {
+		t.Fatalf("service is %+v after the rollback, want the replicas %v of web:1", st, before)
+	}
+
+	var out strings.Builder
+	err := cmdService([]string{"history", "-manager", addr, "web"}, &out)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if !strings.Contains(out.String(), "rollback to revision 1") {
+		t.Fatalf("history printed %q, want the rollback", out.String())
+	}
+
+	// Rolling back by hand to the bad revision fails again, and as that
+	// was a rollback itself the rollout pauses instead.
+	err = cmdService([]string{"rollback", "-manager", addr, "web", "2"}, io.Discard)
+	if err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	ok = c.StepUntil(10, func() bool {
+		return serviceStatus(t, c, "web").Rollout.State == manager.RolloutPaused
+	})
+	if !ok {
+		t.Fatalf("failing rollback was not paused: %+v", serviceStatus(t, c, "web"))
+	}
+	if n := len(ownedTasks(c, "service/web", task.Running)); n < 3 {
+		t.Fatalf("%d replicas running while the rollout is paused, want at least 3", n)
+	}
+
+	err = cmdService([]string{"rollback", "-manager", addr, "web", "9"}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("rolling back to an unknown revision returned %v, want a 404", err)
+	}
+}
+
+func jobStatus(t *testing.T, c *cluster.Cluster, name string) manager.JobStatus {
+	t.Helper()
+
+	j, ok := c.Manager.GetJob(name)
+	if !ok {
+		t.Fatalf("job %s not found", name)
+	}
+
+	return j
+}
+
+func TestJobRunsToCompletion(t *testing.T) {
+	c := newCluster(t, 2)
+	addr := strings.TrimPrefix(c.ManagerUrl, "http://")
+	c.Manager.JobBackoff = 0
+
+	mf := manifest.Manifest{Jobs: []manifest.Job{
+		{Name: "batch", Completions: 3, Parallelism: 2, BackoffLimit: 1, Template: manifest.TaskSpec{Image: "batch"}},
+	}}
+	res, err := c.Apply(mf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Created, ",") != "job/batch" {
+		t.Fatalf("apply returned %+v, want job/batch created", res)
+	}
+	c.Step()
+
+	running := ownedTasks(c, "job/batch", task.Running)
+	if len(running) != 2 {
+		t.Fatalf("%d tasks running, want 2", len(running))
+	}
+
+	// A task exiting 0 completes, one exiting otherwise fails and is
+	// replaced rather than restarted.
+	c.Runtime(running[0].ID).Exit(running[0].ContainerId, 0)
+	c.Runtime(running[1].ID).Exit(running[1].ContainerId, 3)
+	ok := c.StepUntil(5, func() bool { return len(ownedTasks(c, "job/batch", task.Running)) == 2 })
+	if !ok {
+		t.Fatalf("finished tasks were not replaced: %+v", jobStatus(t, c, "batch"))
+	}
+	if tk, _ := c.Task(running[0].ID); tk.State != task.Completed || tk.ExitCode != 0 {
+		t.Fatalf("task that exited 0 is %v with exit code %d, want Completed", tk.State, tk.ExitCode)
+	}
+	if tk, _ := c.Task(running[1].ID); tk.State != task.Failed || tk.ExitCode != 3 || tk.RestartCount != 0 {
+		t.Fatalf("task that exited 3 is %v with exit code %d and %d restarts, want Failed and not restarted", tk.State, tk.ExitCode, tk.RestartCount)
+	}
+
+	for _, tk := range ownedTasks(c, "job/batch", task.Running) {
+		c.Runtime(tk.ID).Exit(tk.ContainerId, 0)
+	}
+	ok = c.StepUntil(5, func() bool { return jobStatus(t, c, "batch").Run.State == manager.JobComplete })
+	if !ok {
+		t.Fatalf("job did not complete: %+v", jobStatus(t, c, "batch"))
+	}
+	c.Step()
+
+	st := jobStatus(t, c, "batch")
+	if st.Run.Succeeded != 3 || st.Run.Failed != 1 || len(st.Tasks) != 4 {
+		t.Fatalf("job is %+v, want 3 succeeded, 1 failed and 4 tasks", st)
+	}
+	if n := len(ownedTasks(c, "job/batch", task.Running)); n != 0 {
+		t.Fatalf("%d tasks running after the job completed", n)
+	}
+
+	// Applying the same job again leaves the finished run be.
+	res, err = c.Apply(mf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Unchanged, ",") != "job/batch" {
+		t.Fatalf("reapplying returned %+v, want job/batch unchanged", res)
+	}
+
+	// A job whose tasks keep failing fails once past its backoff limit.
+	mf.Jobs = append(mf.Jobs, manifest.Job{Name: "flaky", BackoffLimit: 1, Template: manifest.TaskSpec{Image: "flaky"}})
+	if _, err := c.Apply(mf, false); err != nil {
+		t.Fatal(err)
+	}
+	ok = c.StepUntil(10, func() bool {
+		for _, tk := range ownedTasks(c, "job/flaky", task.Running) {
+			c.Runtime(tk.ID).Exit(tk.ContainerId, 1)
+		}
+		return jobStatus(t, c, "flaky").Run.State == manager.JobFailed
+	})
+	if !ok {
+		t.Fatalf("job did not fail: %+v", jobStatus(t, c, "flaky"))
+	}
+	if st := jobStatus(t, c, "flaky"); st.Run.Failed != 2 || len(st.Tasks) != 2 {
+		t.Fatalf("job is %+v, want 2 failed tasks", st)
+	}
+
+	var out strings.Builder
+	err = cmdJob([]string{"ls", "-manager", addr}, &out)
+	if err != nil {
+		t.Fatalf("job ls: %v", err)
+	}
+	if !strings.Contains(out.String(), "3/3") {
+		t.Fatalf("job ls printed %q, want 3/3 completions", out.String())
+	}
+	if !strings.Contains(out.String(), "Complete") || !strings.Contains(out.String(), "backoff limit is 1") {
+		t.Fatalf("job ls printed %q, want one complete and one failed job", out.String())
+	}
+
+	err = cmdJob([]string{"rm", "-manager", addr, "flaky"}, io.Discard)
+	if err != nil {
+		t.Fatalf("job rm: %v", err)
+	}
+	if _, ok := c.Manager.GetJob("flaky"); ok {
+		t.Fatal("job flaky still exists after rm")
+	}
+}
+
+func TestJobRetriesByTheManagersClock(t *testing.T) {
+	c := newCluster(t, 1)
+	// The manager's clock runs well ahead of the worker's.
+	now := time.Now().Add(time.Hour)
+	c.Manager.Now = func() time.Time { return now }
+
+	mf := manifest.Manifest{Jobs: []manifest.Job{
+		{Name: "retry", BackoffLimit: 2, Template: manifest.TaskSpec{Image: "retry"}},
+	}}
+	if _, err := c.Apply(mf, false); err != nil {
+		t.Fatal(err)
+	}
+	c.Step()
+
+	running := ownedTasks(c, "job/retry", task.Running)
+	if len(running) != 1 {
+		t.Fatalf("%d tasks running, want 1", len(running))
+	}
+	c.Runtime(running[0].ID).Exit(running[0].ContainerId, 1)
+
+	// The failed task isn't replaced until the backoff has passed on the
+	// manager's clock, however long the cluster runs in the meantime.
+	for range 3 {
+		c.Step()
+	}
+	if n := len(ownedTasks(c, "job/retry", task.Running)); n != 0 {
+		t.Fatalf("%d tasks running during the backoff, want 0", n)
+	}
+
+	now = now.Add(manager.DefaultJobBackoff + time.Minute)
+	ok := c.StepUntil(5, func() bool { return len(ownedTasks(c, "job/retry", task.Running)) == 1 })
+	if !ok {
+		t.Fatalf("failed task was not replaced after the backoff: %+v", jobStatus(t, c, "retry"))
+	}
+}
+
+func cronJobStatus(t *testing.T, c *cluster.Cluster, name string) manager.CronJobStatus {
+	t.Helper()
+
+	cj, ok := c.Manager.GetCronJob(name)
+	if !ok {
+		t.Fatalf("cron job %s not found", name)
+	}
+
+	return cj
+}
+
+func TestStoppedJobTaskDoesNotSucceed(t *testing.T) {
+	c := newCluster(t, 1)
+
+	mf := manifest.Manifest{Jobs: []manifest.Job{
+		{Name: "once", Template: manifest.TaskSpec{Image: "once"}},
+	}}
+	if _, err := c.Apply(mf, false); err != nil {
+		t.Fatal(err)
+	}
+	c.Step()
+
+	running := ownedTasks(c, "job/once", task.Running)
+	if len(running) != 1 {
+		t.Fatalf("%d tasks running, want 1", len(running))
+	}
+	if err := c.Stop(running[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	c.Step()
+
+	// Stopping a job's task doesn't complete the job, and the task keeps
+	// the code its container exited with.
+	tk, _ := c.Task(running[0].ID)
+	if tk.State != task.Completed || !tk.Stopped || tk.ExitCode != 143 {
+		t.Fatalf("stopped task is %v with exit code %d, stopped %v, want Completed, 143 and stopped", tk.State, tk.ExitCode, tk.Stopped)
+	}
+	c.Step()
+	if st := jobStatus(t, c, "once"); st.Run.Succeeded != 0 || st.Run.State == manager.JobComplete {
+		t.Fatalf("job is %+v, want nothing succeeded", st.Run)
+	}
+}
+
+func TestSetCronJobStartsDueRunAtOnce(t *testing.T) {
+	c := newCluster(t, 1)
+	now := time.Date(2026, 3, 1, 12, 5, 0, 0, time.UTC)
+	c.Manager.Now = func() time.Time { return now }
+
+	tick := manifest.CronJob{Name: "tick", Schedule: "*/10 * * * *", Job: manifest.Job{Template: manifest.TaskSpec{Image: "tick"}}}
+	if err := c.Manager.SetCronJob(tick); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing a cron job that is due starts its run right away, the job's
+	// task queued without waiting for the next reconcile.
+	now = time.Date(2026, 3, 1, 12, 10, 0, 0, time.UTC)
+	tick.Job.Template.Image = "tock"
+	if err := c.Manager.SetCronJob(tick); err != nil {
+		t.Fatal(err)
+	}
+	var queued []*task.Task
+	for _, tk := range c.Manager.GetTasks() {
+		if strings.HasPrefix(tk.Owner, "job/cronjob/tick/") {
+			queued = append(queued, tk)
+		}
+	}
+	if len(queued) != 1 || queued[0].State != task.Pending || queued[0].Image != "tock" {
+		t.Fatalf("tasks of the cron job are %+v, want one pending tock task", queued)
+	}
+}
+
+func TestCronJobStartsJobsOnSchedule(t *testing.T) {
+	c := newCluster(t, 1)
+	addr := strings.TrimPrefix(c.ManagerUrl, "http://")
+	now := time.Date(2026, 3, 1, 12, 5, 0, 0, time.UTC)
+	c.Manager.Now = func() time.Time { return now }
+	at := func(hour, minute int) {
+		now = time.Date(2026, 3, 1, hour, minute, 0, 0, time.UTC)
+		c.Step()
+		c.Step()
+	}
+	finish := func() {
+		for _, tk := range c.Manager.GetTasks() {
+			if strings.HasPrefix(tk.Owner, "job/cronjob/report/") && tk.State == task.Running {
+				c.Runtime(tk.ID).Exit(tk.ContainerId, 0)
+			}
+		}
+		c.Step()
+		c.Step()
+	}
+
+	report := manifest.CronJob{
+		Name:                       "report",
+		Schedule:                   "*/10 * * * *",
+		ConcurrencyPolicy:          manifest.ForbidConcurrent,
+		SuccessfulJobsHistoryLimit: 2,
+		Job:                        manifest.Job{Template: manifest.TaskSpec{Image: "report"}},
+	}
+	res, err := c.Apply(manifest.Manifest{CronJobs: []manifest.CronJob{report}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Created, ",") != "cronjob/report" {
+		t.Fatalf("apply returned %+v, want cronjob/report created", res)
+	}
+	c.Step()
+
+	// A new cron job waits for its next scheduled time.
+	cj := cronJobStatus(t, c, "report")
+	if len(cj.Jobs) != 0 || !cj.NextScheduleTime.Equal(time.Date(2026, 3, 1, 12, 10, 0, 0, time.UTC)) {
+		t.Fatalf("new cron job is %+v, want no jobs and a run due at 12:10", cj)
+	}
+
+	// Of the runs missed while the manager was down only the latest starts.
+	at(12, 47)
+	cj = cronJobStatus(t, c, "report")
+	if len(cj.Jobs) != 1 || len(cj.Jobs[0].Tasks) != 1 || cj.Jobs[0].CronJob != "report" || !cj.LastScheduleTime.Equal(time.Date(2026, 3, 1, 12, 40, 0, 0, time.UTC)) {
+		t.Fatalf("cron job is %+v, want one job for 12:40", cj)
+	}
+
+	// While it runs, the next run is skipped.
+	at(12, 51)
+	cj = cronJobStatus(t, c, "report")
+	if len(cj.Jobs) != 1 || !strings.Contains(cj.Message, "still running") {
+		t.Fatalf("cron job is %+v, want the run skipped", cj)
+	}
+
+	// Only the last two complete jobs are kept.
+	for _, minute := range []int{0, 10, 20} {
+		finish()
+		at(13, minute)
+	}
+	finish()
+	cj = cronJobStatus(t, c, "report")
+	if len(cj.Jobs) != 2 || cj.Jobs[0].Run.State != manager.JobComplete || cj.Jobs[1].Run.State != manager.JobComplete {
+		t.Fatalf("cron job is %+v, want 2 complete jobs kept", cj)
+	}
+
+	// With the replace policy a running job makes way for the next.
+	report.ConcurrencyPolicy = manifest.ReplaceConcurrent
+	res, err = c.Apply(manifest.Manifest{CronJobs: []manifest.CronJob{report}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Updated, ",") != "cronjob/report" {
+		t.Fatalf("apply returned %+v, want cronjob/report updated", res)
+	}
+	at(13, 30)
+	replaced := cronJobStatus(t, c, "report").Jobs[2]
+	at(13, 40)
+	cj = cronJobStatus(t, c, "report")
+	if len(cj.Jobs) != 3 || cj.Jobs[2].Name == replaced.Name || cj.Jobs[2].Run.Active != 1 {
+		t.Fatalf("cron job is %+v, want job %s replaced by a running one", cj, replaced.Name)
+	}
+	for _, id := range replaced.Tasks {
+		if tk, _ := c.Task(id); tk.State != task.Completed {
+			t.Fatalf("task %v of the replaced job is %v, want it stopped", id, tk.State)
+		}
+	}
+
+	// Schedules are read in the cron job's time zone, and a run that is
+	// too late for its starting deadline is skipped.
+	nightly := manifest.CronJob{
+		Name:             "nightly",
+		Schedule:         "0 3 * * *",
+		TimeZone:         "America/New_York",
+		StartingDeadline: 60,
+		Job:              manifest.Job{Template: manifest.TaskSpec{Image: "nightly"}},
+	}
+	if _, err := c.Apply(manifest.Manifest{CronJobs: []manifest.CronJob{report, nightly}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if cj := cronJobStatus(t, c, "nightly"); !cj.NextScheduleTime.Equal(time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)) {
+		t.Fatalf("cron job is %+v, want a run due at 3am in New York", cj)
+	}
+	now = time.Date(2026, 3, 2, 8, 5, 0, 0, time.UTC)
+	c.Step()
+	if cj := cronJobStatus(t, c, "nightly"); len(cj.Jobs) != 0 || !strings.Contains(cj.Message, "late") {
+		t.Fatalf("cron job is %+v, want the late run skipped", cj)
+	}
+
+	var out strings.Builder
+	err = cmdCronJob([]string{"ls", "-manager", addr}, &out)
+	if err != nil {
+		t.Fatalf("cronjob ls: %v", err)
+	}
+	if !strings.Contains(out.String(), "America/New_York") || !strings.Contains(out.String(), "Replace") {
+		t.Fatalf("cronjob ls printed %q, want both cron jobs", out.String())
+	}
+
+	err = cmdCronJob([]string{"rm", "-manager", addr, "report"}, io.Discard)
+	if err != nil {
+		t.Fatalf("cronjob rm: %v", err)
+	}
+	c.Step()
+	for _, tk := range c.Manager.GetTasks() {
+		if strings.HasPrefix(tk.Owner, "job/cronjob/report/") && tk.State == task.Running {
+			t.Fatalf("task %v of a removed cron job still runs", tk.ID)
+		}
+	}
+
+	if _, err := manifest.Parse([]byte("cronJobs:\n  - name: x\n    schedule: '* * *'\n    job:\n      template:\n        image: x\n")); err == nil {
+		t.Fatal("cron job with an invalid schedule was accepted")
+	}
+}
+
+func workflowStatus(t *testing.T, c *cluster.Cluster, name string) manager.WorkflowStatus {
+	t.Helper()
+
+	wf, ok := c.Manager.GetWorkflow(name)
+	if !ok {
+		t.Fatalf("workflow %s not found", name)
+	}
+
+	return wf
+}
+
+func stepStates(wf manager.WorkflowStatus) string {
+	var states []string
+	for _, s := range wf.Steps {
+		states = append(states, s.Name+"="+s.State)
+	}
+
+	return strings.Join(states, ",")
+}
+
+func TestWorkflowRunsStepsInOrder(t *testing.T) {
+	c := newCluster(t, 2)
+	addr := strings.TrimPrefix(c.ManagerUrl, "http://")
+	c.Manager.JobBackoff = 0
+
+	// extract fans out to two transforms, which load waits for.
+	etl := manifest.Workflow{Name: "etl", Steps: []manifest.Step{
+		{Name: "load", DependsOn: []string{"clean", "enrich"}, Template: manifest.TaskSpec{Image: "load"}},
+		{Name: "clean", DependsOn: []string{"extract"}, Retries: 1, Template: manifest.TaskSpec{Image: "clean"}},
+		{Name: "enrich", DependsOn: []string{"extract"}, Template: manifest.TaskSpec{Image: "enrich"}},
+		{Name: "extract", Template: manifest.TaskSpec{Image: "extract"}},
+	}}
+	res, err := c.Apply(manifest.Manifest{Workflows: []manifest.Workflow{etl}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Created, ",") != "job/workflow/etl/extract,workflow/etl" {
+		t.Fatalf("apply returned %+v, want only the first step and the workflow created", res)
+	}
+	c.Step()
+	c.Step()
+
+	if st := stepStates(workflowStatus(t, c, "etl")); st != "extract=Running,clean=Pending,enrich=Pending,load=Pending" {
+		t.Fatalf("steps are %s, want only extract running", st)
+	}
+
+	finish := func(owner string, code int) {
+		t.Helper()
+		running := ownedTasks(c, owner, task.Running)
+		if len(running) != 1 {
+			t.Fatalf("%d tasks of %s running, want 1", len(running), owner)
+		}
+		c.Runtime(running[0].ID).Exit(running[0].ContainerId, code)
+	}
+
+	finish("job/workflow/etl/extract", 0)
+	ok := c.StepUntil(5, func() bool {
+		return len(ownedTasks(c, "job/workflow/etl/clean", task.Running))+len(ownedTasks(c, "job/workflow/etl/enrich", task.Running)) == 2
+	})
+	if !ok {
+		t.Fatalf("transforms did not start after extract: %s", stepStates(workflowStatus(t, c, "etl")))
+	}
+
+	// A failing step is retried up to its retries.
+	finish("job/workflow/etl/clean", 1)
+	ok = c.StepUntil(5, func() bool { return len(ownedTasks(c, "job/workflow/etl/clean", task.Running)) == 1 })
+	if !ok {
+		t.Fatalf("clean was not retried: %+v", workflowStatus(t, c, "etl"))
+	}
+	finish("job/workflow/etl/clean", 0)
+	c.Step()
+	if st := stepStates(workflowStatus(t, c, "etl")); st != "extract=Succeeded,clean=Succeeded,enrich=Running,load=Pending" {
+		t.Fatalf("steps are %s, want load waiting for enrich", st)
+	}
+
+	finish("job/workflow/etl/enrich", 0)
+	ok = c.StepUntil(5, func() bool { return len(ownedTasks(c, "job/workflow/etl/load", task.Running)) == 1 })
+	if !ok {
+		t.Fatalf("load did not start: %s", stepStates(workflowStatus(t, c, "etl")))
+	}
+	finish("job/workflow/etl/load", 0)
+	ok = c.StepUntil(5, func() bool { return workflowStatus(t, c, "etl").State == manager.WorkflowSucceeded })
+	if !ok {
+		t.Fatalf("workflow did not succeed: %+v", workflowStatus(t, c, "etl"))
+	}
+	if wf := workflowStatus(t, c, "etl"); wf.StartTime.IsZero() || wf.EndTime.Before(wf.StartTime) {
+		t.Fatalf("workflow ran from %v to %v", wf.StartTime, wf.EndTime)
+	}
+
+	// A step failing for good fails the workflow; the steps after it are
+	// skipped.
+	resp, err := managerDo(addr, http.MethodPost, "/workflows", strings.NewReader(`{"name": "chain", "steps": [
+		{"name": "first", "template": {"image": "first"}},
+		{"name": "second", "dependsOn": ["first"], "template": {"image": "second"}}]}`))
+	if err != nil {
+		t.Fatalf("setting workflow: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("setting workflow returned %d", resp.StatusCode)
+	}
+	c.Step()
+	c.Step()
+	finish("job/workflow/chain/first", 2)
+	ok = c.StepUntil(5, func() bool { return workflowStatus(t, c, "chain").State == manager.WorkflowFailed })
+	if !ok {
+		t.Fatalf("workflow did not fail: %+v", workflowStatus(t, c, "chain"))
+	}
+	c.Step()
+	wf := workflowStatus(t, c, "chain")
+	if st := stepStates(wf); st != "first=Failed,second=Skipped" {
+		t.Fatalf("steps are %s, want second skipped", st)
+	}
+	if !strings.Contains(wf.Message, "step first failed") {
+		t.Fatalf("workflow message is %q, want it to name the failed step", wf.Message)
+	}
+	if n := len(ownedTasks(c, "job/workflow/chain/second", task.Pending)) + len(ownedTasks(c, "job/workflow/chain/second", task.Running)); n != 0 {
+		t.Fatalf("%d tasks started for a step after a failed one", n)
+	}
+
+	var out strings.Builder
+	err = cmdWorkflow([]string{"ls", "-manager", addr}, &out)
+	if err != nil {
+		t.Fatalf("workflow ls: %v", err)
+	}
+	if !strings.Contains(out.String(), "Succeeded") || !strings.Contains(out.String(), "0/2") {
+		t.Fatalf("workflow ls printed %q, want a succeeded and a failed workflow", out.String())
+	}
+
+	out.Reset()
+	err = cmdWorkflow([]string{"get", "-manager", addr, "chain"}, &out)
+	if err != nil {
+		t.Fatalf("workflow get: %v", err)
+	}
+	if !strings.Contains(out.String(), "Skipped") || !strings.Contains(out.String(), "backoff limit is 0") {
+		t.Fatalf("workflow get printed %q, want the failed and skipped steps", out.String())
+	}
+
+	err = cmdWorkflow([]string{"rm", "-manager", addr, "chain"}, io.Discard)
+	if err != nil {
+		t.Fatalf("workflow rm: %v", err)
+	}
+	if _, ok := c.Manager.GetWorkflow("chain"); ok {
+		t.Fatal("workflow chain still exists after rm")
+	}
+	if _, ok := c.Manager.JobRuns["chain.first"]; ok {
+		t.Fatal("run of a removed workflow's step was kept")
+	}
+}
+
+func TestWorkflowStepsDoNotShareJobsWithAppliedJobs(t *testing.T) {
+	c := newCluster(t, 1)
+
+	// Before step jobs were named under their workflow, the applied job and
+	// the step below were both "etl.load", and shared a run.
+	mf := manifest.Manifest{
+		Jobs: []manifest.Job{{Name: "etl.load", Template: manifest.TaskSpec{Image: "other"}}},
+		Workflows: []manifest.Workflow{{Name: "etl", Steps: []manifest.Step{
+			{Name: "load", Template: manifest.TaskSpec{Image: "load"}},
+		}}},
+	}
+	if _, err := c.Apply(mf, false); err != nil {
+		t.Fatal(err)
+	}
+	ok := c.StepUntil(5, func() bool {
+		return len(ownedTasks(c, "job/etl.load", task.Running)) == 1 && len(ownedTasks(c, "job/workflow/etl/load", task.Running)) == 1
+	})
+	if !ok {
+		t.Fatalf("the job and the step are not both running: %+v, %s", jobStatus(t, c, "etl.load"), stepStates(workflowStatus(t, c, "etl")))
+	}
+
+	job := ownedTasks(c, "job/etl.load", task.Running)[0]
+	c.Runtime(job.ID).Exit(job.ContainerId, 0)
+	c.StepUntil(5, func() bool { return jobStatus(t, c, "etl.load").Run.State == manager.JobComplete })
+	if st := jobStatus(t, c, "etl.load"); st.Run.State != manager.JobComplete {
+		t.Fatalf("job did not complete: %+v", st)
+	}
+	if states := stepStates(workflowStatus(t, c, "etl")); states != "load=Running" {
+		t.Fatalf("steps are %s after the job completed, want load=Running", states)
+	}
+
+	if _, err := c.Apply(manifest.Manifest{Jobs: []manifest.Job{{Name: "workflow/etl/load", Template: manifest.TaskSpec{Image: "x"}}}}, false); err == nil {
+		t.Fatal("a job named like a workflow step's was accepted")
+	}
+}
+
+// daemonNodes returns the workers running the daemon set's tasks, sorted.
+func daemonNodes(c *cluster.Cluster, name string) string {
+	var nodes []string
+	for _, tk := range c.Manager.GetTasks() {
+		if strings.HasPrefix(tk.Owner, "daemonset/"+name+"@") && tk.State == task.Running {
+			w, _ := c.Manager.TaskWorker(tk.ID)
+			nodes = append(nodes, w)
+		}
+	}
+	sort.Strings(nodes)
+
+	return strings.Join(nodes, ",")
+}
+
+func TestDaemonSetRunsOnEveryNode(t *testing.T) {
+	c := newCluster(t, 2)
+	addr := strings.TrimPrefix(c.ManagerUrl, "http://")
+	first, second := c.Manager.Workers[0], c.Manager.Workers[1]
+	port := freePort(t)
+
+	err := cmdNode([]string{"label", "-manager", addr, first, "zone=edge"}, io.Discard)
+	if err != nil {
+		t.Fatalf("node label: %v", err)
+	}
+
+	mf := manifest.Manifest{
+		DaemonSets: []manifest.DaemonSet{
+			{Name: "agent", Template: manifest.TaskSpec{Image: "agent"}},
+			{Name: "proxy", NodeSelector: map[string]string{"zone": "edge"}, Template: manifest.TaskSpec{Image: "proxy", Ports: map[string]string{"443": port}}},
+		},
+		Services: []manifest.Service{{Name: "web", Replicas: 2, Template: manifest.TaskSpec{Image: "web"}}},
+	}
+	res, err := c.Apply(mf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(res.Created, "daemonset/agent") || !slices.Contains(res.Created, "daemonset/proxy@"+first) {
+		t.Fatalf("apply returned %+v, want the daemon sets and their tasks created", res)
+	}
+	c.Step()
+	c.Step()
+
+	if got := daemonNodes(c, "agent"); got != first+","+second {
+		t.Fatalf("agent runs on %q, want both nodes", got)
+	}
+	if got := daemonNodes(c, "proxy"); got != first {
+		t.Fatalf("proxy runs on %q, want only the labelled node", got)
+	}
+
+	// A node that joins gets the daemon sets that select it.
+	i, err := c.AddWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := c.Manager.Workers[i]
+	c.Step()
+	c.Step()
+	if got := daemonNodes(c, "agent"); got != first+","+second+","+third {
+		t.Fatalf("agent runs on %q after a node joined, want all three", got)
+	}
+
+	// Relabelling moves the proxy to the node that now matches.
+	if err := c.Manager.SetNodeLabels(first, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Manager.SetNodeLabels(second, map[string]string{"zone": "edge"}); err != nil {
+		t.Fatal(err)
+	}
+	ok := c.StepUntil(5, func() bool { return daemonNodes(c, "proxy") == second })
+	if !ok {
+		t.Fatalf("proxy runs on %q, want it moved to the relabelled node", daemonNodes(c, "proxy"))
+	}
+	st, _ := c.Manager.GetDaemonSet("proxy")
+	if st.Desired != 1 || st.Current != 1 || st.Ready != 1 {
+		t.Fatalf("proxy is %+v, want 1 desired, current and ready", st)
+	}
+
+	// A node that leaves takes its daemon tasks with it, and its other
+	// tasks are placed elsewhere.
+	var webOnSecond []uuid.UUID
+	for _, tk := range ownedTasks(c, "service/web", task.Running) {
+		if w, _ := c.Manager.TaskWorker(tk.ID); w == second {
+			webOnSecond = append(webOnSecond, tk.ID)
+		}
+	}
+	if err := c.RemoveWorker(1); err != nil {
+		t.Fatal(err)
+	}
+	ok = c.StepUntil(5, func() bool {
+		return daemonNodes(c, "agent") == first+","+third && daemonNodes(c, "proxy") == "" && len(ownedTasks(c, "service/web", task.Running)) == 2
+	})
+	if !ok {
+		t.Fatalf("agent runs on %q, proxy on %q and %d web replicas after a node left", daemonNodes(c, "agent"), daemonNodes(c, "proxy"), len(ownedTasks(c, "service/web", task.Running)))
+	}
+	for _, id := range webOnSecond {
+		if w, _ := c.Manager.TaskWorker(id); w == second {
+			t.Fatalf("web replica %s still placed on the node that left", id)
+		}
+	}
+	for _, tk := range c.Manager.GetTasks() {
+		if tk.Owner == "daemonset/agent@"+second && tk.State != task.Completed {
+			t.Fatalf("agent task on the node that left is %v, want Completed", tk.State)
+		}
+	}
+
+	var out strings.Builder
+	err = cmdDaemonSet([]string{"ls", "-manager", addr}, &out)
+	if err != nil {
+		t.Fatalf("daemonset ls: %v", err)
+	}
+	if !strings.Contains(out.String(), "zone=edge") {
+		t.Fatalf("daemonset ls printed %q, want the proxy's selector", out.String())
+	}
+
+	err = cmdDaemonSet([]string{"rm", "-manager", addr, "agent"}, io.Discard)
+	if err != nil {
+		t.Fatalf("daemonset rm: %v", err)
+	}
+	ok = c.StepUntil(5, func() bool { return daemonNodes(c, "agent") == "" })
+	if !ok {
+		t.Fatalf("agent still runs on %q after rm", daemonNodes(c, "agent"))
+	}
+}
+
+func containerStates(tk task.Task) string {
+	var states []string
+	for _, c := range tk.Containers {
+		states = append(states, c.Name+"="+c.State)
+	}
+
+	return strings.Join(states, ",")
+}
+
+func TestTaskGroupRunsInitContainersAndSidecars(t *testing.T) {
+	c := newCluster(t, 1)
+	rt := c.Runtimes[0]
+	rt.SetBehavior("migrate", task.FakeBehavior{ExitAfter: 50 * time.Millisecond})
+	rt.SetBehavior("broken", task.FakeBehavior{ExitAfter: time.Millisecond, ExitCode: 3})
+
+	mf := manifest.Manifest{Tasks: []manifest.TaskSpec{{
+		Name:           "web",
+		Image:          "web",
+		InitContainers: []manifest.ContainerSpec{{Name: "migrate", Image: "migrate"}},
+		Sidecars:       []manifest.ContainerSpec{{Name: "proxy", Image: "proxy"}},
+	}}}
+	if _, err := c.Apply(mf, false); err != nil {
+		t.Fatal(err)
+	}
+	c.Step()
+	c.Step()
+
+	// The task waits for its init container before anything else starts.
+	tasks := ownedTasks(c, "task/web", task.Scheduled)
+	if len(tasks) != 1 {
+		t.Fatalf("got %d scheduled web tasks, want 1 waiting on its init container", len(tasks))
+	}
+	id := tasks[0].ID
+	if got := containerStates(*tasks[0]); got != "migrate=Running,main=Waiting,proxy=Waiting" {
+		t.Fatalf("containers are %s, want only the init container running", got)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	ok := c.StepUntil(3, func() bool { return taskState(c, id) == task.Running })
+	if !ok {
+		t.Fatalf("task is %v after its init container exited, want Running", taskState(c, id))
+	}
+	tk, _ := c.Task(id)
+	if got := containerStates(tk); got != "migrate=Exited,main=Running,proxy=Running" {
+		t.Fatalf("containers are %s, want the main container and sidecar running", got)
+	}
+	proxy, _ := rt.Container(tk.Name + "-proxy")
+	if proxy.Config.NetworkMode != "container:"+tk.ContainerId {
+		t.Fatalf("sidecar network mode is %q, want the main container's", proxy.Config.NetworkMode)
+	}
+
+	var out strings.Builder
+	err := cmdStatus([]string{"-manager", strings.TrimPrefix(c.ManagerUrl, "http://")}, &out)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if !strings.Contains(out.String(), "2/2") {
+		t.Fatalf("status printed %q, want both containers of the task running", out.String())
+	}
+
+	// A sidecar that exits fails the whole task, which is restarted,
+	// init container first.
+	if err := rt.Exit(proxy.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	c.Step()
+	main, _ := rt.Container(tk.Name)
+	if main.Status != "exited" {
+		t.Fatalf("main container is %s after its sidecar exited, want exited", main.Status)
+	}
+	ok = c.StepUntil(3, func() bool {
+		tk, _ := c.Task(id)
+		return tk.RestartCount == 1 && containerStates(tk) == "migrate=Running,main=Waiting,proxy=Waiting"
+	})
+	if ok {
+		time.Sleep(50 * time.Millisecond)
+		ok = c.StepUntil(3, func() bool { return taskState(c, id) == task.Running })
+	}
+	if !ok {
+		tk, _ := c.Task(id)
+		t.Fatalf("task is %v with %d restarts and containers %s, want it restarted", tk.State, tk.RestartCount, containerStates(tk))
+	}
+	if migrate, _ := rt.Container(tk.Name + "-migrate"); migrate.Starts != 2 {
+		t.Fatalf("init container started %d times, want 2", migrate.Starts)
+	}
+
+	// An init container that fails fails the task before it starts.
+	bad := runTask(t, c, task.Task{
+		Name:           "bad",
+		Image:          "web",
+		InitContainers: []task.ContainerSpec{{Name: "setup", Image: "broken"}},
+	})
+	c.Step()
+	time.Sleep(10 * time.Millisecond)
+	ok = c.StepUntil(5, func() bool {
+		tk, _ := c.Task(bad)
+		return tk.FailureReason == task.ReasonInitFailed
+	})
+	if !ok {
+		tk, _ := c.Task(bad)
+		t.Fatalf("task with a failing init container is %v with reason %q", tk.State, tk.FailureReason)
+	}
+	if _, ok := rt.Container("bad"); ok {
+		t.Fatal("main container of a task whose init container failed was started")
+	}
+}
+
+func TestRestartedWorkerAdoptsTaskGroups(t *testing.T) {
+	c := newCluster(t, 1)
+	rt := c.Runtimes[0]
+	rt.SetBehavior("migrate", task.FakeBehavior{ExitAfter: 100 * time.Millisecond})
+
+	path := filepath.Join(t.TempDir(), "worker-1.db")
+	s, err := store.NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RestartWorker(0, s); err != nil {
+		t.Fatalf("unable to restart worker: %v", err)
+	}
+
+	sidecars := []task.ContainerSpec{{Name: "proxy", Image: "proxy"}}
+	web := runTask(t, c, task.Task{Name: "web", Image: "web", Sidecars: sidecars})
+	alone := runTask(t, c, task.Task{Name: "alone", Image: "web", Sidecars: sidecars})
+	initing := runTask(t, c, task.Task{
+		Name:           "initing",
+		Image:          "web",
+		InitContainers: []task.ContainerSpec{{Name: "migrate", Image: "migrate"}},
+		Sidecars:       sidecars,
+	})
+	ok := c.StepUntil(3, func() bool {
+		return taskState(c, web) == task.Running && taskState(c, alone) == task.Running && taskState(c, initing) == task.Scheduled
+	})
+	if !ok {
+		t.Fatal("tasks did not start")
+	}
+
+	// One task loses its sidecar while the worker is down.
+	aloneProxy, _ := rt.Container("alone-proxy")
+	if err := rt.Remove(context.Background(), aloneProxy.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = store.NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RestartWorker(0, s); err != nil {
+		t.Fatalf("unable to restart worker: %v", err)
+	}
+
+	webProxy, _ := rt.Container("web-proxy")
+	if tk, _ := c.Workers[0].GetTask(web); tk.State != task.Running || containerStates(tk) != "main=Running,proxy=Running" {
+		t.Fatalf("task with its sidecar was not adopted: %v with containers %s", tk.State, containerStates(tk))
+	} else if id, _ := tk.ContainerIdOf("proxy"); id != webProxy.ID {
+		t.Fatalf("adopted sidecar is %s, want %s", id, webProxy.ID)
+	}
+	if tk, _ := c.Workers[0].GetTask(alone); tk.State != task.Failed || tk.FailureReason != task.ReasonSidecarExited {
+		t.Fatalf("task without its sidecar is %v with reason %q, want it failed", tk.State, tk.FailureReason)
+	}
+	if tk, _ := c.Workers[0].GetTask(initing); tk.State != task.Scheduled || containerStates(tk) != "migrate=Running,main=Waiting,proxy=Waiting" {
+		t.Fatalf("initializing task is %v with containers %s, want it still initializing", tk.State, containerStates(tk))
+	}
+
+	// What is left of the failed task goes down with it, and the
+	// initializing task carries on once its init container exits.
+	time.Sleep(100 * time.Millisecond)
+	ok = c.StepUntil(3, func() bool { return taskState(c, initing) == task.Running })
+	if !ok {
+		tk, _ := c.Task(initing)
+		t.Fatalf("initializing task is %v with containers %s, want Running", tk.State, containerStates(tk))
+	}
+	if main, _ := rt.Container("alone"); main.Status != "exited" {
+		t.Fatalf("main container of the failed task is %s, want exited", main.Status)
+	}
+	if tk, _ := c.Task(initing); containerStates(tk) != "migrate=Exited,main=Running,proxy=Running" {
+		t.Fatalf("initialized task has containers %s", containerStates(tk))
+	}
+}
+
+func nodeStatus(c *cluster.Cluster, name string) string {
+	for _, n := range c.Manager.GetNodes() {
+		if n.Name == name {
+			return n.Status
+		}
+	}
+
+	return ""
+}
+
+func TestWorkersRegisterAndHeartbeat(t *testing.T) {
+	c := newCluster(t, 1)
+	addr := strings.TrimPrefix(c.ManagerUrl, "http://")
+	now := time.Now()
+	c.Manager.Now = func() time.Time { return now }
+	static := c.Manager.Workers[0]
+
+	// A worker given the manager's address registers itself.
+	i, err := c.AddWorker()
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	joined := c.Workers[i].Address
+	if got := nodeStatus(c, joined); got != node.NodeReady {
+		t.Fatalf("registered node is %q, want Ready", got)
+	}
+	for _, n := range c.Manager.GetNodes() {
+		if n.Name == joined && n.Cores == 0 {
+			t.Fatalf("registered node reported no capacity: %+v", n)
+		}
+	}
+
+	// Nodes not heard from within the timeout are NotReady and get no new
+	// tasks, until a heartbeat or sync reaches them again.
+	now = now.Add(c.Manager.NodeTimeout + time.Second)
+	c.Manager.CheckNodes()
+	if nodeStatus(c, static) != node.NodeNotReady || nodeStatus(c, joined) != node.NodeNotReady {
+		t.Fatalf("nodes are %q and %q, want both NotReady", nodeStatus(c, static), nodeStatus(c, joined))
+	}
+
+	var out strings.Builder
+	err = cmdNode([]string{"ls", "-manager", addr}, &out)
+	if err != nil {
+		t.Fatalf("node ls: %v", err)
+	}
+	if !strings.Contains(out.String(), node.NodeNotReady) {
+		t.Fatalf("node ls printed %q, want the NotReady nodes", out.String())
+	}
+
+	if err := c.Workers[i].SendHeartbeat(context.Background()); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	if got := nodeStatus(c, joined); got != node.NodeReady {
+		t.Fatalf("node is %q after a heartbeat, want Ready", got)
+	}
+	for range 2 {
+		id := runTask(t, c, task.Task{Image: "web"})
+		c.Step()
+		if w := taskWorker(c, id); w != joined {
+			t.Fatalf("task placed on %q, want only the Ready node %s", w, joined)
+		}
+		// The step's task sync reached the other node too, so let it
+		// go unheard from again.
+		now = now.Add(c.Manager.NodeTimeout + time.Second)
+		c.Manager.CheckNodes()
+		c.Workers[i].SendHeartbeat(context.Background())
+	}
+	c.Step()
+	if got := nodeStatus(c, static); got != node.NodeReady {
+		t.Fatalf("node is %q once synced, want Ready", got)
+	}
+
+	// A removed worker registers again with its next heartbeat.
+	err = cmdNode([]string{"rm", "-manager", addr, joined}, io.Discard)
+	if err != nil {
+		t.Fatalf("node rm: %v", err)
+	}
+	if got := nodeStatus(c, joined); got != "" {
+		t.Fatalf("removed node is still listed as %q", got)
+	}
+	if err := c.Workers[i].SendHeartbeat(context.Background()); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	if got := nodeStatus(c, joined); got != node.NodeReady {
+		t.Fatalf("node is %q after registering again, want Ready", got)
+	}
+}
@@ -1,91 +1,52 @@
 package main
 
 import (
-	"cube/manager"
-	"cube/task"
-	"cube/worker"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
 	"os"
-	"strconv"
-	"time"
 
-	"github.com/golang-collections/collections/queue"
-	"github.com/google/uuid"
+	// Cron job time zones resolve even where the host has no zoneinfo.
+	_ "time/tzdata"
 )
 
-func main() {
-	whost := os.Getenv("CUBE_WORKER_HOST")
-	wport, _ := strconv.Atoi(os.Getenv("CUBE_WORKER_PORT"))
-
-	mhost := os.Getenv("CUBE_MANAGER_HOST")
-	mport, _ := strconv.Atoi(os.Getenv("CUBE_MANAGER_PORT"))
-
-	fmt.Println("Starting Cube worker")
-
-	w1 := worker.Worker{
-		Queue: *queue.New(),
-		Db:    make(map[uuid.UUID]*task.Task),
-	}
-	wapi := worker.Api{Address: whost, Port: wport, Worker: &w1}
-
-	w2 := worker.Worker{
-		Queue: *queue.New(),
-		Db:    make(map[uuid.UUID]*task.Task),
-	}
-
-	w2api := worker.Api{Address: whost, Port: wport + 1, Worker: &w2}
+const usage = `Usage: cube <command> [flags]
+
+Commands:
+  manager    run the manager
+  worker     run a worker
+  apply      apply a manifest of desired tasks, services and other workloads
+  run        run a task
+  stop       stop a task
+  status     list tasks
+  service    list, scale or remove services
+  daemonset  list or remove daemon sets
+  job        list or remove jobs
+  cronjob    list or remove cron jobs
+  workflow   list, inspect or remove workflows
+  logs       print a task's logs
+  node       list, label or remove worker nodes
+
+Run cube <command> -h for the flags of a command. Flags may also be set in
+the environment or in a JSON config file given with -config.
+`
 
-	w3 := worker.Worker{
-		Queue: *queue.New(),
-		Db:    make(map[uuid.UUID]*task.Task),
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
 	}
 
-	w3api := worker.Api{Address: whost, Port: wport + 2, Worker: &w3}
-
-	go wapi.Start()
-	go w2api.Start()
-	go w3api.Start()
-
-	time.Sleep(4 * time.Second)
-
-	go w1.RunTasks()
-	go w1.CollectStats()
-	go w1.UpdateTasks()
-
-	go w2.RunTasks()
-	go w2.CollectStats()
-	go w2.UpdateTasks()
-
-	go w3.RunTasks()
-	go w3.CollectStats()
-	go w3.UpdateTasks()
-
-	log.Println("Starting Cube Manager")
-
-	workers := []string{
-		fmt.Sprintf("%s:%d", whost, wport),
-		fmt.Sprintf("%s:%d", whost, wport+1),
-		fmt.Sprintf("%s:%d", whost, wport+2),
+	err := runCommand(os.Args[1], os.Args[2:], os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
 	}
-
-	m := manager.New(workers, "roundrobin")
-	mapi := manager.Api{
-		Address: mhost,
-		Port:    mport,
-		Manager: m,
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cube %s: %v\n", os.Args[1], err)
+		os.Exit(1)
 	}
 
-	go mapi.Start()
-
-	time.Sleep(2 * time.Second)
-
-	go m.ProcessTasks()
-	go m.UpdateTasks()
-	go m.DoHealthChecks()
-
-	select {}
-
 	// go func() {
 	// 	for {
 	// 		fmt.Printf("[Manager] Updating tasks from %d workers\n", len(m.Workers))
@@ -139,7 +100,43 @@ func main() {
 
 }
 
-// func createContainer() (*task.Docker, *task.DockerResult) {
+func runCommand(name string, args []string, out io.Writer) error {
+	switch name {
+	case "manager":
+		return cmdManager(args)
+	case "worker":
+		return cmdWorker(args)
+	case "apply":
+		return cmdApply(args, out)
+	case "run":
+		return cmdRun(args, out)
+	case "stop":
+		return cmdStop(args, out)
+	case "status":
+		return cmdStatus(args, out)
+	case "logs":
+		return cmdLogs(args, out)
+	case "service":
+		return cmdService(args, out)
+	case "daemonset":
+		return cmdDaemonSet(args, out)
+	case "job":
+		return cmdJob(args, out)
+	case "cronjob":
+		return cmdCronJob(args, out)
+	case "workflow":
+		return cmdWorkflow(args, out)
+	case "node":
+		return cmdNode(args, out)
+	case "help", "-h", "--help":
+		fmt.Fprint(out, usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", name, usage)
+	}
+}
+
+// func createContainer() (*task.Docker, *task.Result) {
 
 // 	c := task.Config{
 // 		Name:  "test-container-1",
@@ -169,7 +166,7 @@ func main() {
 
 // }
 
-// func stopContainer(d *task.Docker, id string) *task.DockerResult {
+// func stopContainer(d *task.Docker, id string) *task.Result {
 // 	result := d.Stop(id)
 // 	if result.Error != nil {
 // 		fmt.Printf("%v\n", result.Error)
@@ -1,13 +1,18 @@
 package manager
 
 import (
+	"context"
+	"cube/utils"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
 
+const ShutdownTimeout = 30 * time.Second
+
 type Api struct {
 	Address string
 	Port    int
@@ -20,19 +25,81 @@ type ErrResponse struct {
 	Message        string
 }
 
-func (a *Api) initRouter() {
+func (a *Api) InitRouter() {
 	a.Router = chi.NewRouter()
 	a.Router.Route("/tasks", func(r chi.Router) {
 		r.Get("/", a.GetTasksHandler)
 		r.Post("/", a.StartTaskHandler)
 		r.Route("/{taskID}", func(r chi.Router) {
 			r.Delete("/", a.StopTaskHandler)
+			r.Get("/logs", a.GetTaskLogsHandler)
+			r.Post("/exec", a.ExecTaskHandler)
+		})
+	})
+	a.Router.Route("/nodes", func(r chi.Router) {
+		r.Get("/", a.GetNodesHandler)
+		r.Post("/", a.RegisterNodeHandler)
+		r.Route("/{name}", func(r chi.Router) {
+			r.Delete("/", a.DeleteNodeHandler)
+			r.Put("/labels", a.SetNodeLabelsHandler)
+			r.Put("/heartbeat", a.NodeHeartbeatHandler)
+		})
+	})
+	a.Router.Route("/services", func(r chi.Router) {
+		r.Get("/", a.GetServicesHandler)
+		r.Post("/", a.SetServiceHandler)
+		r.Route("/{name}", func(r chi.Router) {
+			r.Get("/", a.GetServiceHandler)
+			r.Delete("/", a.DeleteServiceHandler)
+			r.Put("/scale", a.ScaleServiceHandler)
+			r.Get("/revisions", a.GetRevisionsHandler)
+			r.Post("/rollback", a.RollbackServiceHandler)
+		})
+	})
+	a.Router.Route("/daemonsets", func(r chi.Router) {
+		r.Get("/", a.GetDaemonSetsHandler)
+		r.Post("/", a.SetDaemonSetHandler)
+		r.Route("/{name}", func(r chi.Router) {
+			r.Get("/", a.GetDaemonSetHandler)
+			r.Delete("/", a.DeleteDaemonSetHandler)
 		})
 	})
+	a.Router.Route("/jobs", func(r chi.Router) {
+		r.Get("/", a.GetJobsHandler)
+		r.Post("/", a.SetJobHandler)
+		// The jobs cron jobs start are named under them, slashes and all.
+		r.Get("/*", a.GetJobHandler)
+		r.Delete("/*", a.DeleteJobHandler)
+	})
+	a.Router.Route("/cronjobs", func(r chi.Router) {
+		r.Get("/", a.GetCronJobsHandler)
+		r.Post("/", a.SetCronJobHandler)
+		r.Route("/{name}", func(r chi.Router) {
+			r.Get("/", a.GetCronJobHandler)
+			r.Delete("/", a.DeleteCronJobHandler)
+		})
+	})
+	a.Router.Route("/workflows", func(r chi.Router) {
+		r.Get("/", a.GetWorkflowsHandler)
+		r.Post("/", a.SetWorkflowHandler)
+		r.Route("/{name}", func(r chi.Router) {
+			r.Get("/", a.GetWorkflowHandler)
+			r.Delete("/", a.DeleteWorkflowHandler)
+		})
+	})
+	a.Router.Post("/apply", a.ApplyHandler)
 }
 
-func (a *Api) Start() {
-	a.initRouter()
+// Start serves the API until ctx is cancelled, then waits up to
+// ShutdownTimeout for in-flight requests to finish.
+func (a *Api) Start(ctx context.Context) error {
+	a.InitRouter()
 	log.Printf("Serving manager on %s:%d\n", a.Address, a.Port)
-	http.ListenAndServe(fmt.Sprintf("%s:%d", a.Address, a.Port), a.Router)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", a.Address, a.Port),
+		Handler: a.Router,
+	}
+
+	return utils.Serve(ctx, srv, ShutdownTimeout)
 }
@@ -0,0 +1,213 @@
+package manager
+
+import (
+	"bytes"
+	"cube/manifest"
+	"encoding/json"
+	"maps"
+	"sort"
+)
+
+// ApplyResult lists, by owner such as "task/db", "service/web",
+// "daemonset/agent", "job/migrate", "cronjob/backup" or "workflow/etl",
+// what applying a manifest changed. A daemon set's task on each node is
+// listed as well, as "daemonset/agent@<node>". Daemon sets, cron jobs and
+// workflows that are removed are listed as stopped.
+type ApplyResult struct {
+	Created   []string
+	Updated   []string
+	Scaled    []string
+	Stopped   []string
+	Unchanged []string
+}
+
+// Apply makes the manifest the desired state. Tasks are created for new
+// specs, services, daemon sets and jobs, replaced for changed ones, added or
+// stopped to match replica counts and selected nodes and stopped for those
+// that were applied before but are no longer in the manifest. Objects made
+// through the API are left alone unless the manifest names them. A job that
+// already ran with the same template is not run again. Removing a cron job
+// removes the jobs it started, and removing a workflow the jobs of its
+// steps. With dryRun nothing is changed and the result reports what would
+// be.
+func (m *Manager) Apply(mf manifest.Manifest, dryRun bool) ApplyResult {
+	given := newDesiredState(mf)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changes := ApplyResult{}
+	objectChanges(m.DaemonSets, given.DaemonSets, manifest.DaemonSet.Owner, m.Applied, &changes)
+	objectChanges(m.CronJobs, given.CronJobs, manifest.CronJob.Owner, m.Applied, &changes)
+	objectChanges(m.Workflows, given.Workflows, manifest.Workflow.Owner, m.Applied, &changes)
+
+	d := desiredState{
+		Specs:      withImperative(m.Specs, given.Specs, manifest.TaskSpec.Owner, m.Applied),
+		Services:   withImperative(m.Services, given.Services, manifest.Service.Owner, m.Applied),
+		DaemonSets: withImperative(m.DaemonSets, given.DaemonSets, manifest.DaemonSet.Owner, m.Applied),
+		Jobs:       withImperative(m.Jobs, given.Jobs, manifest.Job.Owner, m.Applied),
+		CronJobs:   withImperative(m.CronJobs, given.CronJobs, manifest.CronJob.Owner, m.Applied),
+		Workflows:  withImperative(m.Workflows, given.Workflows, manifest.Workflow.Owner, m.Applied),
+	}
+
+	if dryRun {
+		res := m.reconcile(m.workloads(d), true)
+		res.add(changes)
+		return res
+	}
+
+	for name := range m.Specs {
+		if _, ok := d.Specs[name]; !ok {
+			m.remove(specsBucket, name)
+		}
+	}
+	for name, s := range given.Specs {
+		m.persist(specsBucket, name, s)
+	}
+	m.Specs = d.Specs
+
+	for name := range m.Services {
+		if _, ok := d.Services[name]; !ok {
+			m.remove(servicesBucket, name)
+			m.deleteHistory(name)
+		}
+	}
+	for name, s := range given.Services {
+		m.persist(servicesBucket, name, s)
+		m.recordRevision(s, "apply", false, "")
+	}
+	m.Services = d.Services
+
+	for name := range m.DaemonSets {
+		if _, ok := d.DaemonSets[name]; !ok {
+			m.remove(daemonSetsBucket, name)
+		}
+	}
+	for name, ds := range given.DaemonSets {
+		m.persist(daemonSetsBucket, name, ds)
+	}
+	m.DaemonSets = d.DaemonSets
+
+	for name := range m.Jobs {
+		if _, ok := d.Jobs[name]; !ok {
+			m.remove(jobsBucket, name)
+			m.deleteJobRun(name)
+		}
+	}
+	for name, j := range given.Jobs {
+		m.persist(jobsBucket, name, j)
+	}
+	m.Jobs = d.Jobs
+
+	for name := range m.CronJobs {
+		if _, ok := d.CronJobs[name]; !ok {
+			m.remove(cronJobsBucket, name)
+			m.deleteCronState(name)
+		}
+	}
+	for name, c := range given.CronJobs {
+		m.persist(cronJobsBucket, name, c)
+	}
+	m.CronJobs = d.CronJobs
+
+	for name, w := range m.Workflows {
+		if _, ok := d.Workflows[name]; !ok {
+			m.remove(workflowsBucket, name)
+		}
+		m.deleteStepRuns(w, d.Workflows[name])
+	}
+	for name, w := range given.Workflows {
+		m.persist(workflowsBucket, name, w)
+	}
+	m.Workflows = d.Workflows
+
+	owners := given.owners()
+	for owner := range m.Applied {
+		if !owners[owner] {
+			m.markApplied(owner, false)
+		}
+	}
+	for owner := range owners {
+		m.markApplied(owner, true)
+	}
+
+	m.updateCronJobs(m.Now().UTC())
+	m.updateJobs()
+
+	res := m.reconcile(m.workloads(m.desired()), false)
+	res.add(changes)
+	m.wake()
+
+	return res
+}
+
+// objectChanges adds to res which of the given objects are new, changed or
+// unchanged, and which of those applied before are missing from them.
+func objectChanges[T any](current map[string]T, given map[string]T, owner func(T) string, applied map[string]bool, res *ApplyResult) {
+	for name, o := range given {
+		old, ok := current[name]
+		switch {
+		case !ok:
+			res.Created = append(res.Created, owner(o))
+		case !sameJSON(old, o):
+			res.Updated = append(res.Updated, owner(o))
+		default:
+			res.Unchanged = append(res.Unchanged, owner(o))
+		}
+	}
+	for name, o := range current {
+		if _, ok := given[name]; !ok && applied[owner(o)] {
+			res.Stopped = append(res.Stopped, owner(o))
+		}
+	}
+}
+
+// withImperative returns the given objects together with those current
+// ones that weren't applied, such as the ones made through the API, which
+// applying a manifest leaves alone.
+func withImperative[T any](current map[string]T, given map[string]T, owner func(T) string, applied map[string]bool) map[string]T {
+	res := maps.Clone(given)
+	for name, o := range current {
+		if _, ok := given[name]; !ok && !applied[owner(o)] {
+			res[name] = o
+		}
+	}
+
+	return res
+}
+
+// markApplied records whether the object of the given owner came from an
+// applied manifest, rather than the API. It expects the caller to hold
+// m.mu.
+func (m *Manager) markApplied(owner string, applied bool) {
+	switch {
+	case applied:
+		m.Applied[owner] = true
+		m.persist(appliedBucket, owner, true)
+	case m.Applied[owner]:
+		delete(m.Applied, owner)
+		m.remove(appliedBucket, owner)
+	}
+}
+
+func sameJSON(a any, b any) bool {
+	da, _ := json.Marshal(a)
+	db, _ := json.Marshal(b)
+
+	return bytes.Equal(da, db)
+}
+
+func (r *ApplyResult) add(other ApplyResult) {
+	r.Created = append(r.Created, other.Created...)
+	r.Updated = append(r.Updated, other.Updated...)
+	r.Scaled = append(r.Scaled, other.Scaled...)
+	r.Stopped = append(r.Stopped, other.Stopped...)
+	r.Unchanged = append(r.Unchanged, other.Unchanged...)
+	r.sort()
+}
+
+func (r *ApplyResult) sort() {
+	for _, owners := range [][]string{r.Created, r.Updated, r.Scaled, r.Stopped, r.Unchanged} {
+		sort.Strings(owners)
+	}
+}
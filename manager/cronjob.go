@@ -0,0 +1,267 @@
+package manager
+
+import (
+	"cube/manifest"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+var ErrCronJobNotFound = errors.New("cron job not found")
+
+// CronState is what a cron job has done so far: the latest scheduled time
+// it acted on, by starting a job or skipping the run, and the jobs it
+// started that it still keeps, oldest first. Message says why the latest
+// run was skipped, if it was.
+type CronState struct {
+	LastScheduleTime time.Time
+	Jobs             []manifest.Job
+	Message          string
+}
+
+// CronJobStatus is a cron job with when it last and next fires and the
+// jobs it keeps, oldest first.
+type CronJobStatus struct {
+	manifest.CronJob
+	LastScheduleTime time.Time
+	NextScheduleTime time.Time
+	Message          string
+	Jobs             []JobStatus
+}
+
+// SetCronJob creates the cron job, or replaces it. Jobs it already started
+// carry on as they were; its new job template applies from its next run.
+func (m *Manager) SetCronJob(c manifest.CronJob) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.CronJobs[c.Name] = c
+	m.persist(cronJobsBucket, c.Name, c)
+	m.markApplied(c.Owner(), false)
+	m.updateCronJobs(m.Now().UTC())
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+// DeleteCronJob removes the cron job and the jobs it keeps, stopping any of
+// their tasks still running.
+func (m *Manager) DeleteCronJob(name string) error {
+	m.mu.Lock()
+	c, ok := m.CronJobs[name]
+	if !ok {
+		m.mu.Unlock()
+		return ErrCronJobNotFound
+	}
+
+	delete(m.CronJobs, name)
+	m.remove(cronJobsBucket, name)
+	m.markApplied(c.Owner(), false)
+	m.deleteCronState(name)
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+func (m *Manager) GetCronJobs() []CronJobStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := []CronJobStatus{}
+	for _, c := range m.CronJobs {
+		res = append(res, m.cronJobStatus(c))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
+
+func (m *Manager) GetCronJob(name string) (CronJobStatus, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	c, ok := m.CronJobs[name]
+	if !ok {
+		return CronJobStatus{}, false
+	}
+
+	return m.cronJobStatus(c), true
+}
+
+func (m *Manager) cronJobStatus(c manifest.CronJob) CronJobStatus {
+	st := m.CronStates[c.Name]
+	res := CronJobStatus{CronJob: c, LastScheduleTime: st.LastScheduleTime, Message: st.Message, Jobs: []JobStatus{}}
+
+	sched, loc, err := c.Parse()
+	if err == nil && !st.LastScheduleTime.IsZero() {
+		res.NextScheduleTime = sched.Next(st.LastScheduleTime.In(loc))
+	}
+
+	for _, j := range st.Jobs {
+		js := m.jobStatus(j)
+		js.CronJob = c.Name
+		res.Jobs = append(res.Jobs, js)
+	}
+
+	return res
+}
+
+// The helpers below expect the caller to hold m.mu.
+
+// updateCronJobs starts a job for every cron job that is due, as its
+// concurrency policy allows, and drops the finished jobs beyond its history
+// limits. A new cron job first fires at its next scheduled time after now.
+// When runs were missed, as while the manager was down, only the latest is
+// started, and only if it is within the cron job's starting deadline.
+func (m *Manager) updateCronJobs(now time.Time) {
+	for name, c := range m.CronJobs {
+		st, ok := m.CronStates[name]
+		if !ok {
+			m.setCronState(name, CronState{LastScheduleTime: now})
+			continue
+		}
+
+		changed := false
+		if due, missed := m.dueRun(c, st.LastScheduleTime, now); !due.IsZero() {
+			st.LastScheduleTime = due.UTC()
+			m.startCronRun(c, &st, due, missed, now)
+			changed = true
+		}
+		if m.pruneCronHistory(c, &st) {
+			changed = true
+		}
+
+		if changed {
+			m.setCronState(name, st)
+		}
+	}
+}
+
+// dueRun returns the latest scheduled time of the cron job after last and
+// no later than now, if any, and how many runs were due in all.
+func (m *Manager) dueRun(c manifest.CronJob, last time.Time, now time.Time) (time.Time, int) {
+	sched, loc, err := c.Parse()
+	if err != nil {
+		log.Printf("[Manager] Cron job %s has an invalid schedule: %v\n", c.Name, err)
+		return time.Time{}, 0
+	}
+
+	var due time.Time
+	n := 0
+	for t := sched.Next(last.In(loc)); !t.IsZero() && !t.After(now); t = sched.Next(t) {
+		due = t
+		n++
+	}
+
+	return due, n
+}
+
+// startCronRun starts the cron job's run due at the given time, unless it
+// is past the starting deadline or the concurrency policy forbids it.
+func (m *Manager) startCronRun(c manifest.CronJob, st *CronState, due time.Time, missed int, now time.Time) {
+	if missed > 1 {
+		log.Printf("[Manager] Cron job %s missed %d runs, only the latest, due at %v, may start\n", c.Name, missed-1, due)
+	}
+
+	if deadline := time.Duration(c.StartingDeadline) * time.Second; deadline > 0 && now.Sub(due) > deadline {
+		st.Message = fmt.Sprintf("skipped run due at %v, more than %v late", due, deadline)
+		log.Printf("[Manager] Cron job %s %s\n", c.Name, st.Message)
+		return
+	}
+
+	var active, kept []manifest.Job
+	for _, j := range st.Jobs {
+		if run, ok := m.JobRuns[j.Name]; !ok || run.State == JobRunning {
+			active = append(active, j)
+		} else {
+			kept = append(kept, j)
+		}
+	}
+
+	if len(active) > 0 {
+		switch c.ConcurrencyPolicy {
+		case manifest.ForbidConcurrent:
+			st.Message = fmt.Sprintf("skipped run due at %v, job %s is still running", due, active[0].Name)
+			log.Printf("[Manager] Cron job %s %s\n", c.Name, st.Message)
+			return
+		case manifest.ReplaceConcurrent:
+			for _, j := range active {
+				log.Printf("[Manager] Cron job %s replaces job %s\n", c.Name, j.Name)
+				m.deleteJobRun(j.Name)
+			}
+			st.Jobs = kept
+		}
+	}
+
+	j := c.Job
+	// Named under the cron job, the job can't be taken for an applied job
+	// or a workflow step's.
+	j.Name = fmt.Sprintf("%s/%d", c.Owner(), due.Unix()/60)
+	st.Jobs = append(st.Jobs, j)
+	st.Message = ""
+	log.Printf("[Manager] Cron job %s started job %s for %v\n", c.Name, j.Name, due)
+}
+
+// pruneCronHistory drops the oldest complete and failed jobs beyond the
+// cron job's history limits, and reports whether it dropped any.
+func (m *Manager) pruneCronHistory(c manifest.CronJob, st *CronState) bool {
+	complete, failed := 0, 0
+	var keep []manifest.Job
+	for i := len(st.Jobs) - 1; i >= 0; i-- {
+		j := st.Jobs[i]
+		switch m.JobRuns[j.Name].State {
+		case JobComplete:
+			complete++
+			if complete > c.SuccessfulJobsHistoryLimit {
+				m.deleteJobRun(j.Name)
+				continue
+			}
+		case JobFailed:
+			failed++
+			if failed > c.FailedJobsHistoryLimit {
+				m.deleteJobRun(j.Name)
+				continue
+			}
+		}
+		keep = append([]manifest.Job{j}, keep...)
+	}
+
+	pruned := len(keep) != len(st.Jobs)
+	st.Jobs = keep
+
+	return pruned
+}
+
+// startedJobs returns the jobs kept by the given cron jobs.
+func (m *Manager) startedJobs(cronJobs map[string]manifest.CronJob) []manifest.Job {
+	var res []manifest.Job
+	for name := range cronJobs {
+		res = append(res, m.CronStates[name].Jobs...)
+	}
+
+	return res
+}
+
+func (m *Manager) setCronState(name string, st CronState) {
+	m.CronStates[name] = st
+	m.persist(cronStatesBucket, name, st)
+}
+
+func (m *Manager) deleteCronState(name string) {
+	for _, j := range m.CronStates[name].Jobs {
+		m.deleteJobRun(j.Name)
+	}
+	delete(m.CronStates, name)
+	m.remove(cronStatesBucket, name)
+}
@@ -0,0 +1,139 @@
+package manager
+
+import (
+	"cube/manifest"
+	"errors"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+var ErrDaemonSetNotFound = errors.New("daemon set not found")
+
+// DaemonSetStatus is a daemon set with how many nodes it selects, how many
+// of those run its current template and how many of those tasks are ready.
+// Tasks holds the live task on each node, by node name.
+type DaemonSetStatus struct {
+	manifest.DaemonSet
+	Desired int
+	Current int
+	Ready   int
+	Tasks   map[string]uuid.UUID
+}
+
+// SetDaemonSet creates the daemon set, or replaces it, and starts its tasks
+// on the nodes it selects straight away.
+func (m *Manager) SetDaemonSet(d manifest.DaemonSet) error {
+	err := d.Validate()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.DaemonSets[d.Name] = d
+	m.persist(daemonSetsBucket, d.Name, d)
+	m.markApplied(d.Owner(), false)
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+// DeleteDaemonSet removes the daemon set and stops its tasks on every node.
+func (m *Manager) DeleteDaemonSet(name string) error {
+	m.mu.Lock()
+	d, ok := m.DaemonSets[name]
+	if !ok {
+		m.mu.Unlock()
+		return ErrDaemonSetNotFound
+	}
+
+	delete(m.DaemonSets, name)
+	m.remove(daemonSetsBucket, name)
+	m.markApplied(d.Owner(), false)
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+func (m *Manager) GetDaemonSets() []DaemonSetStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := []DaemonSetStatus{}
+	for _, d := range m.DaemonSets {
+		res = append(res, m.daemonSetStatus(d))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
+
+func (m *Manager) GetDaemonSet(name string) (DaemonSetStatus, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	d, ok := m.DaemonSets[name]
+	if !ok {
+		return DaemonSetStatus{}, false
+	}
+
+	return m.daemonSetStatus(d), true
+}
+
+func (m *Manager) daemonSetStatus(d manifest.DaemonSet) DaemonSetStatus {
+	res := DaemonSetStatus{DaemonSet: d, Tasks: map[string]uuid.UUID{}}
+	hash := d.Template.Hash()
+
+	for _, n := range m.WorkerNodes {
+		if !n.Matches(d.NodeSelector) {
+			continue
+		}
+		res.Desired++
+
+		owner := d.NodeOwner(n.Name)
+		for _, t := range m.TasksDb {
+			if t.Owner != owner || !isLive(t) || m.retiring[t.ID] {
+				continue
+			}
+
+			res.Tasks[n.Name] = t.ID
+			if t.SpecHash == hash {
+				res.Current++
+				if m.isReady(t) {
+					res.Ready++
+				}
+			}
+		}
+	}
+
+	return res
+}
+
+// The helpers below expect the caller to hold m.mu.
+
+// daemonWorkloads returns a workload of one task pinned to each node the
+// daemon set selects, by owner. Nodes that leave or stop matching drop out,
+// so their tasks are stopped.
+func (m *Manager) daemonWorkloads(d manifest.DaemonSet) map[string]workload {
+	res := map[string]workload{}
+	for _, n := range m.WorkerNodes {
+		if !n.Matches(d.NodeSelector) {
+			continue
+		}
+
+		res[d.NodeOwner(n.Name)] = workload{
+			Spec:     d.Template,
+			Replicas: 1,
+			Update:   manifest.UpdateStrategy{MaxUnavailable: 1},
+			Node:     n.Name,
+		}
+	}
+
+	return res
+}
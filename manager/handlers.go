@@ -1,12 +1,19 @@
 package manager
 
 import (
+	"bufio"
+	"bytes"
+	"cube/manifest"
+	"cube/node"
 	"cube/task"
+	"cube/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
-	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
@@ -33,6 +40,15 @@ func (a *Api) StartTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	_, err = task.ParsePortBindings(te.Task.PortBindings)
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid port bindings of task %v: %v", te.Task.ID, err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
 	a.Manager.AddTask(te)
 	log.Printf("[Manager] Added task: %v\n", te.Task.ID)
 	w.WriteHeader(201)
@@ -45,6 +61,126 @@ func (a *Api) GetTasksHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(a.Manager.GetTasks())
 }
 
+func (a *Api) GetNodesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(a.Manager.GetNodes())
+}
+
+// SetNodeLabelsHandler replaces the labels of a node with the posted ones.
+func (a *Api) SetNodeLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	labels := map[string]string{}
+	err := json.NewDecoder(r.Body).Decode(&labels)
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid labels for node %s: %v", name, err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	err = a.Manager.SetNodeLabels(name, labels)
+	if err != nil {
+		nodeNotFound(w, name)
+		return
+	}
+
+	log.Printf("[Manager] Set labels of node %s to %v\n", name, labels)
+	w.WriteHeader(204)
+}
+
+// RegisterNodeHandler adds the worker sending the heartbeat to the cluster.
+func (a *Api) RegisterNodeHandler(w http.ResponseWriter, r *http.Request) {
+	hb := node.Heartbeat{}
+	err := json.NewDecoder(r.Body).Decode(&hb)
+	if err == nil {
+		err = a.Manager.RegisterWorker(hb)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid node registration: %v", err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// NodeHeartbeatHandler records a heartbeat of a registered node. Unknown
+// nodes get a 404, telling them to register again.
+func (a *Api) NodeHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	hb := node.Heartbeat{}
+	err := json.NewDecoder(r.Body).Decode(&hb)
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid heartbeat from node %s: %v", name, err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	err = a.Manager.Heartbeat(name, hb)
+	if err != nil {
+		nodeNotFound(w, name)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+func (a *Api) DeleteNodeHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	err := a.Manager.RemoveWorker(name)
+	if err != nil {
+		nodeNotFound(w, name)
+		return
+	}
+
+	log.Printf("[Manager] Removed node %s\n", name)
+	w.WriteHeader(204)
+}
+
+func nodeNotFound(w http.ResponseWriter, name string) {
+	msg := fmt.Sprintf("[Manager] No node found with name %s", name)
+	log.Println(msg)
+	w.WriteHeader(404)
+	json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 404, Message: msg})
+}
+
+// ApplyHandler makes the posted manifest the desired state and reports what
+// changed, or with dryRun=true what would change.
+func (a *Api) ApplyHandler(w http.ResponseWriter, r *http.Request) {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	mf := manifest.Manifest{}
+	err := d.Decode(&mf)
+	if err == nil {
+		err = mf.Validate()
+	}
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid manifest: %v", err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	res := a.Manager.Apply(mf, dryRun)
+	log.Printf("[Manager] Applied manifest (dry run %v): %+v\n", dryRun, res)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(res)
+}
+
 func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 	taskID := chi.URLParam(r, "taskID")
 
@@ -55,7 +191,7 @@ func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tID, _ := uuid.Parse(taskID)
-	taskToStop, ok := a.Manager.TasksDb[tID]
+	taskToStop, ok := a.Manager.GetTask(tID)
 
 	if !ok {
 		msg := fmt.Sprintf("[Manager] No task found with id %v to stop", tID)
@@ -73,15 +209,576 @@ func (a *Api) StopTaskHandler(w http.ResponseWriter, r *http.Request) {
 	te := task.TaskEvent{
 		ID:        uuid.New(),
 		State:     task.Completed,
-		Timestamp: time.Now(),
+		Timestamp: a.Manager.Now(),
 	}
 
-	taskCopy := *taskToStop
-	taskCopy.State = task.Completed
-	te.Task = taskCopy
+	taskToStop.State = task.Completed
+	te.Task = taskToStop
 
 	a.Manager.AddTask(te)
 
 	log.Printf("[Manager] added task event %v to stop task %v\n", te.ID, tID)
 	w.WriteHeader(204)
 }
+
+// GetTaskLogsHandler proxies a log request to the worker running the task,
+// streaming the response back as it arrives so follow=true works end to end.
+func (a *Api) GetTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	tID, worker, ok := a.findTaskWorker(w, r)
+	if !ok {
+		return
+	}
+
+	url := fmt.Sprintf("http://%s/tasks/%s/logs?%s", worker, tID, r.URL.RawQuery)
+	a.proxy(w, r, worker, url)
+}
+
+// ExecTaskHandler passes an exec request through to the worker running the
+// task. Interactive sessions are spliced together at the TCP level once the
+// worker has switched protocols.
+func (a *Api) ExecTaskHandler(w http.ResponseWriter, r *http.Request) {
+	tID, worker, ok := a.findTaskWorker(w, r)
+	if !ok {
+		return
+	}
+
+	url := fmt.Sprintf("http://%s/tasks/%s/exec?%s", worker, tID, r.URL.RawQuery)
+	if r.URL.Query().Get("interactive") == "true" {
+		a.proxyInteractive(w, r, worker, url)
+		return
+	}
+
+	a.proxy(w, r, worker, url)
+}
+
+func (a *Api) findTaskWorker(w http.ResponseWriter, r *http.Request) (uuid.UUID, string, bool) {
+	taskID := chi.URLParam(r, "taskID")
+	tID, err := uuid.Parse(taskID)
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid task ID %s", taskID)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return tID, "", false
+	}
+
+	worker, ok := a.Manager.TaskWorker(tID)
+	if !ok {
+		msg := fmt.Sprintf("[Manager] No worker found running task %v", tID)
+		log.Println(msg)
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 404, Message: msg})
+		return tID, "", false
+	}
+
+	return tID, worker, true
+}
+
+func (a *Api) proxy(w http.ResponseWriter, r *http.Request, worker string, url string) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, url, r.Body)
+	if err != nil {
+		log.Printf("[Manager] Error creating request to %s: %v\n", url, err)
+		w.WriteHeader(500)
+		return
+	}
+	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Error connecting to worker %s: %v", worker, err)
+		log.Println(msg)
+		w.WriteHeader(502)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 502, Message: msg})
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(&utils.FlushWriter{W: w}, resp.Body)
+}
+
+func (a *Api) proxyInteractive(w http.ResponseWriter, r *http.Request, worker string, url string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	upstream, err := net.Dial("tcp", worker)
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Error connecting to worker %s: %v", worker, err)
+		log.Println(msg)
+		w.WriteHeader(502)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 502, Message: msg})
+		return
+	}
+	defer upstream.Close()
+
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	err = req.Write(upstream)
+	if err != nil {
+		w.WriteHeader(502)
+		return
+	}
+
+	br := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		w.WriteHeader(502)
+		return
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("[Manager] Error hijacking exec connection: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	brw.Flush()
+
+	go func() {
+		io.Copy(upstream, brw.Reader)
+		if tc, ok := upstream.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+
+	io.Copy(conn, br)
+}
+
+func (a *Api) GetServicesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(a.Manager.GetServices())
+}
+
+func (a *Api) GetServiceHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	s, ok := a.Manager.GetService(name)
+	if !ok {
+		serviceNotFound(w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(s)
+}
+
+// SetServiceHandler creates a service or replaces an existing one of the
+// same name.
+func (a *Api) SetServiceHandler(w http.ResponseWriter, r *http.Request) {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	s := manifest.Service{}
+	err := d.Decode(&s)
+	if err == nil {
+		err = a.Manager.SetService(s)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid service: %v", err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	log.Printf("[Manager] Set service %s to %d replicas\n", s.Name, s.Replicas)
+	st, _ := a.Manager.GetService(s.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(st)
+}
+
+// ScaleRequest is the body of a request to scale a service.
+type ScaleRequest struct {
+	Replicas int
+}
+
+func (a *Api) ScaleServiceHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	req := ScaleRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil && req.Replicas < 0 {
+		err = fmt.Errorf("invalid replica count %d", req.Replicas)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid scale request for service %s: %v", name, err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	err = a.Manager.ScaleService(name, req.Replicas)
+	if err != nil {
+		serviceNotFound(w, name)
+		return
+	}
+
+	log.Printf("[Manager] Scaled service %s to %d replicas\n", name, req.Replicas)
+	st, _ := a.Manager.GetService(name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(st)
+}
+
+func (a *Api) DeleteServiceHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	err := a.Manager.DeleteService(name)
+	if err != nil {
+		serviceNotFound(w, name)
+		return
+	}
+
+	log.Printf("[Manager] Deleted service %s\n", name)
+	w.WriteHeader(204)
+}
+
+func (a *Api) GetRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	revs, err := a.Manager.GetRevisions(name)
+	if err != nil {
+		serviceNotFound(w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(revs)
+}
+
+// RollbackRequest is the body of a request to roll a service back. A zero
+// Revision, or no body, means the revision before the current one.
+type RollbackRequest struct {
+	Revision int
+}
+
+func (a *Api) RollbackServiceHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	req := RollbackRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		msg := fmt.Sprintf("[Manager] Invalid rollback request for service %s: %v", name, err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	err = a.Manager.RollbackService(name, req.Revision)
+	if errors.Is(err, ErrRevisionNotFound) {
+		msg := fmt.Sprintf("[Manager] Service %s has no revision %d to roll back to", name, req.Revision)
+		log.Println(msg)
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 404, Message: msg})
+		return
+	}
+	if err != nil {
+		serviceNotFound(w, name)
+		return
+	}
+
+	log.Printf("[Manager] Rolling back service %s\n", name)
+	st, _ := a.Manager.GetService(name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(st)
+}
+
+func (a *Api) GetDaemonSetsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(a.Manager.GetDaemonSets())
+}
+
+func (a *Api) GetDaemonSetHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	d, ok := a.Manager.GetDaemonSet(name)
+	if !ok {
+		daemonSetNotFound(w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(d)
+}
+
+// SetDaemonSetHandler creates a daemon set or replaces an existing one of
+// the same name.
+func (a *Api) SetDaemonSetHandler(w http.ResponseWriter, r *http.Request) {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	ds := manifest.DaemonSet{}
+	err := d.Decode(&ds)
+	if err == nil {
+		err = a.Manager.SetDaemonSet(ds)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid daemon set: %v", err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	log.Printf("[Manager] Set daemon set %s\n", ds.Name)
+	st, _ := a.Manager.GetDaemonSet(ds.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(st)
+}
+
+func (a *Api) DeleteDaemonSetHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	err := a.Manager.DeleteDaemonSet(name)
+	if err != nil {
+		daemonSetNotFound(w, name)
+		return
+	}
+
+	log.Printf("[Manager] Deleted daemon set %s\n", name)
+	w.WriteHeader(204)
+}
+
+func daemonSetNotFound(w http.ResponseWriter, name string) {
+	msg := fmt.Sprintf("[Manager] No daemon set found with name %s", name)
+	log.Println(msg)
+	w.WriteHeader(404)
+	json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 404, Message: msg})
+}
+
+func (a *Api) GetJobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(a.Manager.GetJobs())
+}
+
+func (a *Api) GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "*")
+
+	j, ok := a.Manager.GetJob(name)
+	if !ok {
+		jobNotFound(w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(j)
+}
+
+// SetJobHandler creates a job or replaces an existing one of the same name.
+func (a *Api) SetJobHandler(w http.ResponseWriter, r *http.Request) {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	j := manifest.Job{}
+	err := d.Decode(&j)
+	if err == nil {
+		err = a.Manager.SetJob(j)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid job: %v", err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	log.Printf("[Manager] Set job %s\n", j.Name)
+	st, _ := a.Manager.GetJob(j.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(st)
+}
+
+func (a *Api) DeleteJobHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "*")
+
+	err := a.Manager.DeleteJob(name)
+	if err != nil {
+		jobNotFound(w, name)
+		return
+	}
+
+	log.Printf("[Manager] Deleted job %s\n", name)
+	w.WriteHeader(204)
+}
+
+func jobNotFound(w http.ResponseWriter, name string) {
+	msg := fmt.Sprintf("[Manager] No job found with name %s", name)
+	log.Println(msg)
+	w.WriteHeader(404)
+	json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 404, Message: msg})
+}
+
+func (a *Api) GetCronJobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(a.Manager.GetCronJobs())
+}
+
+func (a *Api) GetCronJobHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	c, ok := a.Manager.GetCronJob(name)
+	if !ok {
+		cronJobNotFound(w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(c)
+}
+
+// SetCronJobHandler creates a cron job or replaces an existing one of the
+// same name.
+func (a *Api) SetCronJobHandler(w http.ResponseWriter, r *http.Request) {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	c := manifest.CronJob{}
+	err := d.Decode(&c)
+	if err == nil {
+		err = a.Manager.SetCronJob(c)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid cron job: %v", err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	log.Printf("[Manager] Set cron job %s to %q\n", c.Name, c.Schedule)
+	st, _ := a.Manager.GetCronJob(c.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(st)
+}
+
+func (a *Api) DeleteCronJobHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	err := a.Manager.DeleteCronJob(name)
+	if err != nil {
+		cronJobNotFound(w, name)
+		return
+	}
+
+	log.Printf("[Manager] Deleted cron job %s\n", name)
+	w.WriteHeader(204)
+}
+
+func cronJobNotFound(w http.ResponseWriter, name string) {
+	msg := fmt.Sprintf("[Manager] No cron job found with name %s", name)
+	log.Println(msg)
+	w.WriteHeader(404)
+	json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 404, Message: msg})
+}
+
+func (a *Api) GetWorkflowsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(a.Manager.GetWorkflows())
+}
+
+func (a *Api) GetWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	wf, ok := a.Manager.GetWorkflow(name)
+	if !ok {
+		workflowNotFound(w, name)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(wf)
+}
+
+// SetWorkflowHandler creates a workflow or replaces an existing one of the
+// same name.
+func (a *Api) SetWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	wf := manifest.Workflow{}
+	err := d.Decode(&wf)
+	if err == nil {
+		err = a.Manager.SetWorkflow(wf)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("[Manager] Invalid workflow: %v", err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	log.Printf("[Manager] Set workflow %s with %d steps\n", wf.Name, len(wf.Steps))
+	st, _ := a.Manager.GetWorkflow(wf.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(st)
+}
+
+func (a *Api) DeleteWorkflowHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	err := a.Manager.DeleteWorkflow(name)
+	if err != nil {
+		workflowNotFound(w, name)
+		return
+	}
+
+	log.Printf("[Manager] Deleted workflow %s\n", name)
+	w.WriteHeader(204)
+}
+
+func workflowNotFound(w http.ResponseWriter, name string) {
+	msg := fmt.Sprintf("[Manager] No workflow found with name %s", name)
+	log.Println(msg)
+	w.WriteHeader(404)
+	json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 404, Message: msg})
+}
+
+func serviceNotFound(w http.ResponseWriter, name string) {
+	msg := fmt.Sprintf("[Manager] No service found with name %s", name)
+	log.Println(msg)
+	w.WriteHeader(404)
+	json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 404, Message: msg})
+}
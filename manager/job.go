@@ -0,0 +1,297 @@
+package manager
+
+import (
+	"cube/manifest"
+	"cube/task"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+const (
+	JobRunning  = "Running"
+	JobComplete = "Complete"
+	JobFailed   = "Failed"
+)
+
+// MaxJobBackoff caps how long a job waits before replacing a failed task.
+// The wait starts at the manager's JobBackoff and doubles with every
+// failure.
+const MaxJobBackoff = 6 * time.Minute
+
+// JobRun is the progress of a job's latest run. A job runs again when its
+// template changes; its tasks carry the number of the run they were started
+// for as their Revision. Active, Succeeded and Failed count the run's tasks
+// that are live, exited 0 and failed. A failed task is replaced no earlier
+// than RetryTime.
+type JobRun struct {
+	Number    int
+	Hash      string
+	State     string
+	Active    int
+	Succeeded int
+	Failed    int
+	StartTime time.Time
+	EndTime   time.Time
+	RetryTime time.Time
+	Message   string
+}
+
+// JobStatus is a job with the progress of its latest run and every task
+// started for that run, finished or not. CronJob names the cron job that
+// started it, if any.
+type JobStatus struct {
+	manifest.Job
+	CronJob string
+	Run     JobRun
+	Tasks   []uuid.UUID
+}
+
+// SetJob creates the job, or replaces it, and starts its tasks straight
+// away. A job whose template is unchanged carries on with its current run,
+// taking on the new completions, parallelism and backoff limit.
+func (m *Manager) SetJob(j manifest.Job) error {
+	err := j.Validate()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.Jobs[j.Name] = j
+	m.persist(jobsBucket, j.Name, j)
+	m.markApplied(j.Owner(), false)
+	m.updateJobs()
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+// DeleteJob removes the job and its run, stopping any of its tasks still
+// running.
+func (m *Manager) DeleteJob(name string) error {
+	m.mu.Lock()
+	j, ok := m.Jobs[name]
+	if !ok {
+		m.mu.Unlock()
+		return ErrJobNotFound
+	}
+
+	delete(m.Jobs, name)
+	m.remove(jobsBucket, name)
+	m.markApplied(j.Owner(), false)
+	m.deleteJobRun(name)
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+func (m *Manager) GetJobs() []JobStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := []JobStatus{}
+	for _, j := range m.Jobs {
+		res = append(res, m.jobStatus(j))
+	}
+	for cronJob := range m.CronJobs {
+		for _, j := range m.CronStates[cronJob].Jobs {
+			st := m.jobStatus(j)
+			st.CronJob = cronJob
+			res = append(res, st)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
+
+// GetJob returns the applied job, or job started by a cron job, of the
+// given name.
+func (m *Manager) GetJob(name string) (JobStatus, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if j, ok := m.Jobs[name]; ok {
+		return m.jobStatus(j), true
+	}
+	for cronJob := range m.CronJobs {
+		for _, j := range m.CronStates[cronJob].Jobs {
+			if j.Name == name {
+				st := m.jobStatus(j)
+				st.CronJob = cronJob
+				return st, true
+			}
+		}
+	}
+
+	return JobStatus{}, false
+}
+
+func (m *Manager) jobStatus(j manifest.Job) JobStatus {
+	st := JobStatus{Job: j, Run: m.JobRuns[j.Name], Tasks: []uuid.UUID{}}
+	for _, t := range m.TasksDb {
+		if t.Owner == j.Owner() && t.Revision == st.Run.Number {
+			st.Tasks = append(st.Tasks, t.ID)
+		}
+	}
+	sort.Slice(st.Tasks, func(i, j int) bool { return st.Tasks[i].String() < st.Tasks[j].String() })
+
+	return st
+}
+
+// The helpers below expect the caller to hold m.mu.
+
+// updateJobs brings the run of every applied job, every job started by a
+// cron job and every workflow step's job up to date with its tasks.
+func (m *Manager) updateJobs() {
+	for _, j := range m.Jobs {
+		m.updateJob(j)
+	}
+	for _, j := range m.startedJobs(m.CronJobs) {
+		m.updateJob(j)
+	}
+	for _, w := range m.Workflows {
+		m.updateWorkflow(w)
+	}
+}
+
+// updateJob brings the job's run up to date: a run is complete once
+// Completions of its tasks have exited 0 and failed once more than
+// BackoffLimit have failed. A job whose template changed starts a new run.
+func (m *Manager) updateJob(j manifest.Job) {
+	now := m.Now().UTC()
+	prev, ok := m.JobRuns[j.Name]
+	run := prev
+	hash := j.Template.Hash()
+	if !ok || run.Hash != hash {
+		run = JobRun{Number: m.lastJobRun(j.Owner(), run.Number) + 1, Hash: hash, State: JobRunning, StartTime: now}
+	}
+
+	if run.State == JobRunning {
+		m.countJobTasks(j, &run)
+
+		switch {
+		case run.Succeeded >= j.Completions:
+			run.State = JobComplete
+			run.EndTime = now
+			run.Active = 0
+			log.Printf("[Manager] Job %s completed run %d\n", j.Name, run.Number)
+		case run.Failed > j.BackoffLimit:
+			run.State = JobFailed
+			run.EndTime = now
+			run.Active = 0
+			run.Message = fmt.Sprintf("%d tasks failed, backoff limit is %d", run.Failed, j.BackoffLimit)
+			log.Printf("[Manager] Job %s failed run %d: %s\n", j.Name, run.Number, run.Message)
+		}
+	}
+
+	if !ok || run != prev {
+		m.setJobRun(j.Name, run)
+	}
+}
+
+// countJobTasks counts the run's tasks by outcome and works out when the
+// latest failure may be replaced. Only tasks that exited 0 on their own
+// succeeded; those stopped count as neither succeeded nor failed.
+func (m *Manager) countJobTasks(j manifest.Job, run *JobRun) {
+	run.Active, run.Succeeded, run.Failed = 0, 0, 0
+
+	var lastFailure *task.Task
+	for _, t := range m.TasksDb {
+		if t.Owner != j.Owner() || t.Revision != run.Number {
+			continue
+		}
+
+		switch {
+		case isLive(t):
+			run.Active++
+		case t.State == task.Completed && !t.Stopped && t.ExitCode == 0:
+			run.Succeeded++
+		case t.State == task.Failed:
+			run.Failed++
+			if lastFailure == nil || t.EndTime.After(lastFailure.EndTime) {
+				lastFailure = t
+			}
+		}
+	}
+
+	if lastFailure != nil {
+		run.RetryTime = lastFailure.EndTime.Add(m.jobBackoff(run.Failed))
+		run.Message = fmt.Sprintf("task %s exited with code %d", lastFailure.ID, lastFailure.ExitCode)
+		if lastFailure.FailureReason != "" {
+			run.Message = fmt.Sprintf("task %s failed: %s", lastFailure.ID, lastFailure.FailureReason)
+		}
+	}
+}
+
+// jobBackoff is how long to wait before replacing a job's task after the
+// given number of failures.
+func (m *Manager) jobBackoff(failures int) time.Duration {
+	d := m.JobBackoff
+	for i := 1; i < failures && d < MaxJobBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, MaxJobBackoff)
+}
+
+// lastJobRun returns the number of the job's latest run, going by its tasks
+// as well, so a job that is deleted and applied again doesn't count the
+// tasks of its earlier runs.
+func (m *Manager) lastJobRun(owner string, last int) int {
+	for _, t := range m.TasksDb {
+		if t.Owner == owner && t.Revision > last {
+			last = t.Revision
+		}
+	}
+
+	return last
+}
+
+// jobWorkload is the job as a workload: as many tasks as parallelism and
+// the completions still needed allow, none while a failed task waits out
+// its backoff, and none once the run is over. Tasks already running are
+// left to finish rather than stopped when fewer are wanted.
+func (m *Manager) jobWorkload(j manifest.Job) workload {
+	run, ok := m.JobRuns[j.Name]
+	w := workload{Spec: j.Template, Job: j.Name, Revision: run.Number}
+
+	switch {
+	case !ok || run.Hash != j.Template.Hash():
+		// The run isn't started yet, as in a dry run.
+		w.Revision = m.lastJobRun(j.Owner(), run.Number) + 1
+		w.Replicas = min(j.Parallelism, j.Completions)
+	case run.State != JobRunning:
+	case m.Now().Before(run.RetryTime):
+		w.Replicas = run.Active
+	default:
+		w.Replicas = max(run.Active, min(j.Parallelism, j.Completions-run.Succeeded))
+	}
+
+	// Tasks of an earlier run are stopped at once.
+	w.Update = manifest.UpdateStrategy{MaxSurge: w.Replicas, MaxUnavailable: w.Replicas}
+
+	return w
+}
+
+func (m *Manager) setJobRun(name string, run JobRun) {
+	m.JobRuns[name] = run
+	m.persist(jobRunsBucket, name, run)
+}
+
+func (m *Manager) deleteJobRun(name string) {
+	delete(m.JobRuns, name)
+	m.remove(jobRunsBucket, name)
+}
@@ -2,24 +2,40 @@ package manager
 
 import (
 	"bytes"
+	"context"
+	"cube/manifest"
 	"cube/node"
 	"cube/scheduler"
+	"cube/stats"
+	"cube/store"
 	"cube/task"
 	"cube/worker"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net/http"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/docker/go-connections/nat"
 	"github.com/golang-collections/collections/queue"
 	"github.com/google/uuid"
 )
 
+// Manager's maps, queue and node allocations are shared by the API handlers
+// and the background loops, so every access goes through mu. It is never
+// held while talking to a worker.
 type Manager struct {
+	mu sync.RWMutex
+
+	// schedMu serializes scoring and picking nodes, which is done without
+	// mu held and may keep state in the Scheduler.
+	schedMu sync.Mutex
+
 	Pending       queue.Queue
 	TasksDb       map[uuid.UUID]*task.Task
 	TaskEventDb   map[uuid.UUID]*task.TaskEvent
@@ -29,30 +45,143 @@ type Manager struct {
 	LastWorker    int
 	WorkerNodes   []*node.Node
 	Scheduler     scheduler.Scheduler
+	Store         store.Store
+
+	// Specs and Services are what was last applied, by name. Reconcile
+	// keeps a task live for each spec and the wanted number of replicas
+	// live for each service.
+	Specs    map[string]manifest.TaskSpec
+	Services map[string]manifest.Service
+
+	// DaemonSets is what was last applied as daemon sets, by name, and
+	// NodeLabels the labels set on each node they select nodes by, kept
+	// by node name even while the node is not part of the cluster.
+	DaemonSets map[string]manifest.DaemonSet
+	NodeLabels map[string]map[string]string
+
+	// Revisions is each service's revision history, oldest first, and
+	// Rollouts the progress of each service's latest revision.
+	Revisions map[string][]Revision
+	Rollouts  map[string]Rollout
+
+	// Jobs is what was last applied as jobs, by name, and JobRuns the
+	// progress of each job's latest run. JobBackoff is how long a job
+	// waits before replacing its first failed task.
+	Jobs       map[string]manifest.Job
+	JobRuns    map[string]JobRun
+	JobBackoff time.Duration
+
+	// CronJobs is what was last applied as cron jobs, by name, and
+	// CronStates when each last fired and the jobs it started. Now is the
+	// clock they are scheduled by, as are job retries and task placement.
+	CronJobs   map[string]manifest.CronJob
+	CronStates map[string]CronState
+	Now        func() time.Time
+
+	// Workflows is what was last applied as workflows, by name. The runs
+	// of their steps' jobs are kept in JobRuns.
+	Workflows map[string]manifest.Workflow
+
+	// Applied holds the owners, such as "service/web", of the objects
+	// that came from an applied manifest. Apply prunes only those, leaving
+	// the ones made through the API alone.
+	Applied map[string]bool
+
+	// Concurrency bounds how many events are dispatched to workers at
+	// once. Events are dispatched as soon as they are added; RetryInterval
+	// is how long events that could not be delivered wait before being
+	// tried again.
+	Concurrency         int
+	RetryInterval       time.Duration
+	SyncInterval        time.Duration
+	HealthCheckInterval time.Duration
+	// NodeTimeout is how long a node may go unheard from, by heartbeat or
+	// task sync, before it is marked NotReady.
+	NodeTimeout time.Duration
+
+	pendingSeq uint64
+	notify     chan struct{}
+	retiring   map[uuid.UUID]bool
+	healthy    map[uuid.UUID]bool
 }
 
+const (
+	DefaultConcurrency         = 10
+	DefaultRetryInterval       = 10 * time.Second
+	DefaultSyncInterval        = 15 * time.Second
+	DefaultHealthCheckInterval = 60 * time.Second
+	DefaultJobBackoff          = 10 * time.Second
+	DefaultNodeTimeout         = 45 * time.Second
+)
+
+// MaxPlacementBackoff caps how long a task that could not be placed waits
+// before it is tried again. The wait starts at the manager's RetryInterval
+// and doubles with every attempt.
+const MaxPlacementBackoff = 5 * time.Minute
+
+// SelectWorker picks the node to place t on. The scheduler, which may ask
+// nodes for their stats, works on copies of the nodes so mu isn't held
+// meanwhile; the caller must not hold it, and should check the node still
+// fits the task before placing it there.
 func (m *Manager) SelectWorker(t task.Task) (*node.Node, error) {
-	candidates := m.Scheduler.SelectCandidateNodes(t, m.WorkerNodes)
+	nodes := m.GetNodes()
+	before := make([]capacity, len(nodes))
+	for i, n := range nodes {
+		before[i] = capacityOf(n)
+	}
+
+	m.schedMu.Lock()
+	defer m.schedMu.Unlock()
 
-	if candidates == nil {
+	candidates := m.Scheduler.SelectCandidateNodes(t, nodes)
+
+	if len(candidates) == 0 {
 		msg := fmt.Sprintf("No available candidates match resource request for task %v\n", t.ID)
 		err := errors.New(msg)
 		return nil, err
 	}
 
 	scores := m.Scheduler.Score(t, candidates)
-	selectedNode := m.Scheduler.Pick(scores, m.WorkerNodes)
+	selectedNode := m.Scheduler.Pick(scores, candidates)
+
+	// What the scheduler learned of the nodes is kept, so their capacity
+	// is known to the next placement without waiting for a heartbeat,
+	// unless one has reported since.
+	m.mu.Lock()
+	for i, nc := range nodes {
+		n := m.getNode(nc.Name)
+		if n == nil || capacityOf(nc) == before[i] || capacityOf(n) != before[i] {
+			continue
+		}
+		n.Memory, n.Disk, n.Stats = nc.Memory, nc.Disk, nc.Stats
+	}
+	m.mu.Unlock()
 
 	return selectedNode, nil
 }
 
-func (m *Manager) updateTasks() {
+// capacity is what a node reports of itself, by heartbeat or when asked
+// for its stats.
+type capacity struct {
+	Memory uint64
+	Disk   int64
+	Stats  stats.Stats
+}
+
+func capacityOf(n *node.Node) capacity {
+	return capacity{Memory: n.Memory, Disk: n.Disk, Stats: n.Stats}
+}
 
-	for _, w := range m.Workers {
+func (m *Manager) SyncTasks(ctx context.Context) {
+	m.mu.RLock()
+	workers := append([]string(nil), m.Workers...)
+	m.mu.RUnlock()
+
+	for _, w := range workers {
 		log.Printf("Checking worker %v for task updates\n", w)
 		url := fmt.Sprintf("http://%s/tasks", w)
 
-		res, err := http.Get(url)
+		res, err := httpDo(ctx, "GET", url, nil)
 
 		if err != nil {
 			log.Printf("[Manager] Error getting tasks info %v\n", err)
@@ -62,76 +191,165 @@ func (m *Manager) updateTasks() {
 		d := json.NewDecoder(res.Body)
 		var tasks []*task.Task
 		err = d.Decode(&tasks)
+		res.Body.Close()
 
 		if err != nil {
 			log.Printf("[Manager] error in unmarshalling tasks %v", err)
 			continue
 		}
 
+		m.mu.Lock()
+		// A worker that answers counts as heard from, whether or not it
+		// sends heartbeats.
+		if n := m.getNode(w); n != nil {
+			m.seen(n)
+		}
 		for _, t := range tasks {
 			log.Printf("[Manager] Attempting to update task %v\n", t.ID)
 
-			_, ok := m.TasksDb[t.ID]
+			persisted, ok := m.TasksDb[t.ID]
 
 			if !ok {
 				log.Printf("[Manager] Task with ID %v was not found!", t.ID)
 				continue
 			}
+			// Tasks a worker ran before it left the cluster were given
+			// up on, and may have been replaced since.
+			if m.TaskWorkerMap[t.ID] != w {
+				continue
+			}
+			old := *persisted
 
 			if m.TasksDb[t.ID].State != t.State {
 				m.TasksDb[t.ID].State = t.State
+				// A failed job task is replaced rather than restarted
+				// where it ran.
+				if t.State == task.Completed || t.State == task.Failed && persisted.RunToCompletion {
+					m.releaseResources(t.ID)
+				}
+			}
+
+			// A task's end is stamped by the manager's clock when it
+			// first hears of it, as the job backoff is measured from
+			// there, whatever the worker's clock says.
+			switch {
+			case t.State != task.Completed && t.State != task.Failed:
+				m.TasksDb[t.ID].EndTime = t.EndTime
+			case old.State != t.State:
+				m.TasksDb[t.ID].EndTime = m.Now().UTC()
 			}
 
 			m.TasksDb[t.ID].StartTime = t.StartTime
-			m.TasksDb[t.ID].EndTime = t.EndTime
 			m.TasksDb[t.ID].ContainerId = t.ContainerId
 			m.TasksDb[t.ID].HostPorts = t.HostPorts
+			m.TasksDb[t.ID].ExitCode = t.ExitCode
+			m.TasksDb[t.ID].FailureReason = t.FailureReason
+			m.TasksDb[t.ID].Stopped = t.Stopped
+			m.TasksDb[t.ID].Containers = t.Containers
 
+			if !reflect.DeepEqual(old, *m.TasksDb[t.ID]) {
+				m.saveTask(m.TasksDb[t.ID])
+			}
 		}
+		m.mu.Unlock()
 
 	}
 
 }
 
-func (m *Manager) SendWork() {
-	if m.Pending.Len() < 1 {
+func (m *Manager) SendWork(ctx context.Context) {
+	m.mu.Lock()
+	pe, ok := m.dequeue()
+	if !ok {
+		m.mu.Unlock()
 		log.Printf("[Manager] No pending tasks to allocate")
 		return
 	}
 
-	e := m.Pending.Dequeue()
-	event := e.(task.TaskEvent)
-
+	event := pe.Event
 	t := event.Task
 	log.Printf("[Manager] Pulled %#v off the pending queue\n", t)
 
 	taskWorker, ok := m.TaskWorkerMap[event.Task.ID]
 	if ok {
-		persistedStateDb := m.TasksDb[event.Task.ID]
-		if event.State == task.Completed && task.ValidStateTransition(persistedStateDb.State, event.State) {
-			m.stopTask(taskWorker, event.Task.ID.String())
+		persistedState := m.TasksDb[event.Task.ID].State
+		m.mu.Unlock()
+
+		if event.State == task.Completed && task.ValidStateTransition(persistedState, event.State) {
+			m.stopTask(ctx, taskWorker, event.Task.ID.String())
 			return
 		}
 
-		log.Printf("[Manager] invalid request, existing task %s in state %d and could not transition to completed state in worker %s\n", event.Task.ID.String(), persistedStateDb.State, taskWorker)
+		log.Printf("[Manager] invalid request, existing task %s in state %d and could not transition to completed state in worker %s\n", event.Task.ID.String(), persistedState, taskWorker)
+		return
+	}
+
+	// A task stopped before it was placed is never started.
+	if persisted, ok := m.TasksDb[t.ID]; ok && (event.State == task.Completed || persisted.State == task.Completed) {
+		if persisted.State != task.Completed {
+			persisted.State = task.Completed
+			persisted.Stopped = true
+			persisted.EndTime = m.Now().UTC()
+			m.saveTask(persisted)
+		}
+		m.mu.Unlock()
+		log.Printf("[Manager] Task %s was stopped before it was placed\n", t.ID)
 		return
 	}
 
 	m.TaskEventDb[event.ID] = &event
+	m.saveEvent(&event)
+	m.mu.Unlock()
+
+	selected, err := m.SelectWorker(t)
+
+	m.mu.Lock()
+	// The task may have been stopped, or placed by another event, while it
+	// was scheduled.
+	if persisted, ok := m.TasksDb[t.ID]; ok && persisted.State == task.Completed {
+		m.mu.Unlock()
+		log.Printf("[Manager] Task %s was stopped before it was placed\n", t.ID)
+		return
+	}
+	if _, ok := m.TaskWorkerMap[t.ID]; ok {
+		m.mu.Unlock()
+		return
+	}
 
-	newWorker, err := m.SelectWorker(t)
 	if err != nil {
-		log.Printf("[Manager] Error selecting worker for task %v\n", err)
+		// The task stays pending, and is tried again after a backoff as
+		// nodes come, go and free up.
+		if _, ok := m.TasksDb[t.ID]; !ok {
+			pending := t
+			pending.State = task.Pending
+			m.TasksDb[t.ID] = &pending
+			m.saveTask(&pending)
+		}
+		m.requeue(event, pe.Attempts+1)
+		m.mu.Unlock()
+		log.Printf("[Manager] Error selecting worker for task %v, attempt %d\n", err, pe.Attempts+1)
+		return
+	}
+
+	// Nor need the node still be there, or have room for the task, now.
+	newWorker := m.getNode(selected.Name)
+	if newWorker == nil || len(m.Scheduler.SelectCandidateNodes(t, []*node.Node{newWorker})) == 0 {
+		m.enqueue(event)
+		m.mu.Unlock()
+		log.Printf("[Manager] Worker %s no longer fits task %s, rescheduling it\n", selected.Name, t.ID)
 		return
 	}
 
 	log.Printf("[Manager] selected worker %s for task %s\n", newWorker.Name, t.ID)
 
-	m.TaskWorkerMap[t.ID] = newWorker.Name
-	m.WorkerTaskMap[newWorker.Name] = append(m.WorkerTaskMap[newWorker.Name], t.ID)
+	m.assignTask(t.ID, newWorker.Name)
+	m.allocateResources(&t, newWorker.Name)
 
 	t.State = task.Scheduled
-	m.TasksDb[t.ID] = &t
+	persisted := t
+	m.TasksDb[t.ID] = &persisted
+	m.saveTask(&persisted)
+	m.mu.Unlock()
 
 	data, err := json.Marshal(event)
 
@@ -141,13 +359,17 @@ func (m *Manager) SendWork() {
 
 	url := fmt.Sprintf("http://%s/tasks", newWorker.Name)
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	resp, err := httpDo(ctx, "POST", url, bytes.NewBuffer(data))
 
 	if err != nil {
 		log.Printf("[Manager] Error connecting to %v\n", err)
-		m.Pending.Enqueue(event)
+		m.mu.Lock()
+		m.unassignTask(t.ID)
+		m.enqueue(event)
+		m.mu.Unlock()
 		return
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
 		log.Printf("[Manager] Error sending request %v\n", err)
@@ -164,34 +386,124 @@ func (m *Manager) SendWork() {
 }
 
 func (m *Manager) AddTask(te task.TaskEvent) {
-	m.Pending.Enqueue(te)
+	m.mu.Lock()
+	m.enqueue(te)
+	m.mu.Unlock()
+
+	m.wake()
 }
 
+// wake tells ProcessTasks there are new events to dispatch.
+func (m *Manager) wake() {
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+// GetTasks returns copies of every task, safe to use after the manager has
+// moved on.
 func (m *Manager) GetTasks() []*task.Task {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	tasks := []*task.Task{}
 	for _, t := range m.TasksDb {
-		tasks = append(tasks, t)
+		tc := *t
+		tasks = append(tasks, &tc)
 	}
 
 	return tasks
 }
 
-func (m *Manager) checkTaskHealth(t task.Task) error {
+func (m *Manager) GetTask(id uuid.UUID) (task.Task, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.TasksDb[id]
+	if !ok {
+		return task.Task{}, false
+	}
+
+	return *t, true
+}
+
+// TaskWorker returns the worker a task was placed on.
+func (m *Manager) TaskWorker(id uuid.UUID) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	w, ok := m.TaskWorkerMap[id]
+	return w, ok
+}
+
+func (m *Manager) PendingLen() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.Pending.Len()
+}
+
+// GetNodes returns copies of the worker nodes with their current task
+// counts and allocations.
+func (m *Manager) GetNodes() []*node.Node {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	nodes := []*node.Node{}
+	for _, n := range m.WorkerNodes {
+		nc := *n
+		nc.HostPorts = make(map[string]uuid.UUID, len(n.HostPorts))
+		for p, id := range n.HostPorts {
+			nc.HostPorts[p] = id
+		}
+		nc.Labels = maps.Clone(n.Labels)
+		nc.TaskCount = len(m.WorkerTaskMap[n.Name])
+		nodes = append(nodes, &nc)
+	}
+
+	return nodes
+}
+
+// NodeDiskAllocated returns the disk held by volume tasks on the named node.
+func (m *Manager) NodeDiskAllocated(name string) int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n := m.getNode(name)
+	if n == nil {
+		return 0
+	}
+
+	return n.DiskAllocated
+}
+
+func (m *Manager) checkTaskHealth(ctx context.Context, t task.Task) error {
 	log.Printf("Calling health check for task %s: %s\n", t.ID, t.HealthCheck)
 
-	w := m.TaskWorkerMap[t.ID]
-	hostPort := getHostPort(t.HostPorts)
+	if t.HealthCheck == "" {
+		return nil
+	}
+
+	w, _ := m.TaskWorker(t.ID)
+	hostPort := t.HostPort()
+	if hostPort == nil {
+		msg := fmt.Sprintf("[Manager] No host port published for task %s\n", t.ID)
+		log.Println(msg)
+		return errors.New(msg)
+	}
 	worker := strings.Split(w, ":")
-	url := fmt.Sprintf("http://%s:%s%s", worker[0], *hostPort, t.HealthCheck)
+	url := fmt.Sprintf("http://%s:%s%s", worker[0], hostPort.HostPort, t.HealthCheck)
 
 	log.Printf("[Manager] Calling health check for task %s: %s\n", t.ID, url)
 
-	resp, err := http.Get(url)
+	resp, err := httpDo(ctx, "GET", url, nil)
 	if err != nil {
 		msg := fmt.Sprintf("[Manager] Error connecting to health check %s\n", err)
 		log.Println(msg)
 		return errors.New(msg)
 	}
+	resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		msg := fmt.Sprintf("[Manager] Error health check for task %s did not return 200\n", t.ID)
@@ -205,36 +517,68 @@ func (m *Manager) checkTaskHealth(t task.Task) error {
 
 }
 
-func (m *Manager) doHealthChecks() {
-	for _, t := range m.TasksDb {
-		if t.RestartCount >= 3 {
-			return
+func (m *Manager) CheckTasksHealth(ctx context.Context) {
+	for _, t := range m.GetTasks() {
+		if t.RestartCount >= maxRestarts {
+			continue
 		}
 
 		switch t.State {
 		case task.Running:
-			err := m.checkTaskHealth(*t)
+			err := m.checkTaskHealth(ctx, *t)
+			m.setHealthy(t.ID, err == nil)
 			if err != nil {
-				m.restartTask(t)
+				m.restartTask(ctx, *t)
 			}
 		case task.Failed:
-			m.restartTask(t)
+			if !t.RunToCompletion {
+				m.restartTask(ctx, *t)
+			}
 		}
 	}
 }
 
-func (m *Manager) restartTask(t *task.Task) {
-	w := m.TaskWorkerMap[t.ID]
-	t.State = task.Scheduled
-	t.RestartCount++
-	m.TasksDb[t.ID] = t
+// setHealthy records the outcome of a task's latest health check, which
+// decides whether it counts as ready during a rolling update.
+func (m *Manager) setHealthy(id uuid.UUID, healthy bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if healthy {
+		m.healthy[id] = true
+	} else {
+		delete(m.healthy, id)
+	}
+}
+
+func (m *Manager) restartTask(ctx context.Context, t task.Task) {
+	m.mu.Lock()
+	persisted, ok := m.TasksDb[t.ID]
+	if !ok || persisted.State != t.State || persisted.RestartCount != t.RestartCount || m.retiring[t.ID] {
+		// The task moved on since it was checked, or is being stopped.
+		m.mu.Unlock()
+		return
+	}
+
+	w, placed := m.TaskWorkerMap[t.ID]
+	persisted.State = task.Scheduled
+	persisted.RestartCount++
+	m.saveTask(persisted)
 
 	te := task.TaskEvent{
 		ID:        uuid.New(),
 		State:     task.Running,
-		Timestamp: time.Now(),
-		Task:      *t,
+		Timestamp: m.Now(),
+		Task:      *persisted,
 	}
+	if !placed {
+		// Its worker left the cluster, so the task is placed afresh.
+		m.placeAfresh(persisted, te)
+		m.mu.Unlock()
+		m.wake()
+		return
+	}
+	m.mu.Unlock()
 
 	data, err := json.Marshal(te)
 	if err != nil {
@@ -243,12 +587,21 @@ func (m *Manager) restartTask(t *task.Task) {
 	}
 
 	url := fmt.Sprintf("http://%s/tasks", w)
-	res, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	res, err := httpDo(ctx, "POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		log.Printf("[Manager] error conntecting to %v: %v", w, err)
-		m.Pending.Enqueue(t)
+		// Nor can the task be restarted where it ran, so it is placed
+		// afresh, unless it has moved on meanwhile.
+		m.mu.Lock()
+		if m.TasksDb[t.ID] == persisted && persisted.State == task.Scheduled && m.TaskWorkerMap[t.ID] == w && !m.retiring[t.ID] {
+			m.unassignTask(t.ID)
+			m.placeAfresh(persisted, te)
+		}
+		m.mu.Unlock()
+		m.wake()
 		return
 	}
+	defer res.Body.Close()
 
 	d := json.NewDecoder(res.Body)
 
@@ -271,94 +624,155 @@ func (m *Manager) restartTask(t *task.Task) {
 		return
 	}
 
-	log.Printf("%#v\n", t)
+	log.Printf("%#v\n", newTask)
 }
 
-func New(workers []string, schedulerType string) *Manager {
+// New creates a manager for the given workers and restores its state from
+// s. A nil store keeps state in memory only.
+func New(workers []string, schedulerType string, s store.Store) (*Manager, error) {
+	if s == nil {
+		s = store.NewMemory()
+	}
+
 	tasksDb := make(map[uuid.UUID]*task.Task)
 	taskEventDb := make(map[uuid.UUID]*task.TaskEvent)
 	workerTaskMap := make(map[string][]uuid.UUID)
 	taskWorkerMap := make(map[uuid.UUID]string)
 
-	var nodes []*node.Node
-	for worker := range workers {
-		workerTaskMap[workers[worker]] = []uuid.UUID{}
-
-		nApi := fmt.Sprintf("http://%v", workers[worker])
-		newNode := node.NewNode(workers[worker], nApi, "worker")
-		nodes = append(nodes, newNode)
-	}
-
-	var s scheduler.Scheduler
+	var sched scheduler.Scheduler
 	switch schedulerType {
 	case "roundrobin":
-		s = &scheduler.RoundRobin{Name: "roundrobin"}
+		sched = &scheduler.RoundRobin{Name: "roundrobin"}
 	case "epvm":
-		s = &scheduler.Epvm{Name: "epvm"}
+		sched = &scheduler.Epvm{Name: "epvm"}
 	default:
-		s = &scheduler.RoundRobin{Name: "roundrobin"}
+		sched = &scheduler.RoundRobin{Name: "roundrobin"}
 	}
 
 	manager := Manager{
 		Pending:       *queue.New(),
-		Workers:       workers,
 		TasksDb:       tasksDb,
 		TaskEventDb:   taskEventDb,
 		WorkerTaskMap: workerTaskMap,
 		TaskWorkerMap: taskWorkerMap,
-		WorkerNodes:   nodes,
-		Scheduler:     s,
+		Scheduler:     sched,
+		Store:         s,
+		Specs:         map[string]manifest.TaskSpec{},
+		Services:      map[string]manifest.Service{},
+		DaemonSets:    map[string]manifest.DaemonSet{},
+		NodeLabels:    map[string]map[string]string{},
+		Revisions:     map[string][]Revision{},
+		Rollouts:      map[string]Rollout{},
+		Jobs:          map[string]manifest.Job{},
+		JobRuns:       map[string]JobRun{},
+		JobBackoff:    DefaultJobBackoff,
+		CronJobs:      map[string]manifest.CronJob{},
+		CronStates:    map[string]CronState{},
+		Now:           time.Now,
+		Workflows:     map[string]manifest.Workflow{},
+		Applied:       map[string]bool{},
+
+		Concurrency:         DefaultConcurrency,
+		RetryInterval:       DefaultRetryInterval,
+		SyncInterval:        DefaultSyncInterval,
+		HealthCheckInterval: DefaultHealthCheckInterval,
+		NodeTimeout:         DefaultNodeTimeout,
+		notify:              make(chan struct{}, 1),
+		retiring:            map[uuid.UUID]bool{},
+		healthy:             map[uuid.UUID]bool{},
+	}
+
+	for _, w := range workers {
+		manager.addWorker(w)
 	}
 
-	return &manager
+	err := manager.load()
+	if err != nil {
+		return nil, fmt.Errorf("loading manager state: %v", err)
+	}
+
+	return &manager, nil
 }
 
-func (m *Manager) UpdateTasks() {
+func (m *Manager) UpdateTasks(ctx context.Context) {
 	for {
 		log.Println("[Manager] Checking for any task updates from the workers")
-		m.updateTasks()
+		m.SyncTasks(ctx)
+		m.CheckNodes()
+		m.Reconcile()
 		log.Println("[Manager] Task updates completed")
-		log.Println("[Manager] Sleeping for 15 seconds")
-		time.Sleep(15 * time.Second)
+		log.Printf("[Manager] Sleeping for %v\n", m.SyncInterval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.SyncInterval):
+		}
 	}
 }
 
-func (m *Manager) ProcessTasks() {
+// ProcessTasks dispatches pending events as soon as they are added, up to
+// Concurrency at a time. Events put back after failing to reach their worker
+// are picked up again every RetryInterval. Once ctx is cancelled it waits
+// for dispatches in flight and returns; events that were cut short are put
+// back on the queue.
+func (m *Manager) ProcessTasks(ctx context.Context) {
+	sem := make(chan struct{}, m.Concurrency)
+	retry := time.NewTicker(m.RetryInterval)
+	defer retry.Stop()
+
 	for {
-		log.Println("[Manager] Processing any tasks in the queue")
-		m.SendWork()
-		log.Println("[Manager] Sleeping for 10 seconds")
-		time.Sleep(10 * time.Second)
+		for n := m.PendingLen(); n > 0 && ctx.Err() == nil; n-- {
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem }()
+				m.SendWork(ctx)
+			}()
+		}
+
+		select {
+		case <-ctx.Done():
+			for i := 0; i < cap(sem); i++ {
+				sem <- struct{}{}
+			}
+			return
+		case <-m.notify:
+		case <-retry.C:
+		}
 	}
 }
 
-func (m *Manager) DoHealthChecks() {
+func (m *Manager) DoHealthChecks(ctx context.Context) {
 	for {
 		log.Println("[Manager] Performing task health check")
-		m.doHealthChecks()
+		m.CheckTasksHealth(ctx)
 		log.Println("[Manager] Task health checks completed")
-		log.Println("[Manager] Sleeping for 60 seconds")
-		time.Sleep(60 * time.Second)
+		log.Printf("[Manager] Sleeping for %v\n", m.HealthCheckInterval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.HealthCheckInterval):
+		}
 	}
 }
 
-func (m *Manager) stopTask(worker string, taskID string) {
-	client := &http.Client{}
+// Shutdown closes the manager's store once its loops have stopped.
+func (m *Manager) Shutdown() error {
+	return m.Store.Close()
+}
 
+func (m *Manager) stopTask(ctx context.Context, worker string, taskID string) {
 	url := fmt.Sprintf("http://%s/tasks/%s", worker, taskID)
 
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		log.Printf("[Manager] Error in creating task with ID %s: %v\n", taskID, req)
-		return
-	}
-
-	resp, err := client.Do(req)
+	resp, err := httpDo(ctx, "DELETE", url, nil)
 	if err != nil {
 		log.Printf("[Manager] Error connecting to worker at %s: %v\n", url, err)
 		return
 	}
 
+	resp.Body.Close()
+
 	if resp.StatusCode != 204 {
 		log.Printf("[Manager[ Error sending request %v\n", err)
 		return
@@ -368,10 +782,92 @@ func (m *Manager) stopTask(worker string, taskID string) {
 
 }
 
-func getHostPort(ports nat.PortMap) *string {
-	for k := range ports {
-		return &ports[k][0].HostPort
+func (m *Manager) getNode(name string) *node.Node {
+	for _, n := range m.WorkerNodes {
+		if n.Name == name {
+			return n
+		}
 	}
 
 	return nil
 }
+
+func (m *Manager) allocateResources(t *task.Task, worker string) {
+	n := m.getNode(worker)
+	if n == nil {
+		return
+	}
+
+	ports, err := t.RequiredHostPorts()
+	if err != nil {
+		log.Printf("[Manager] Invalid port bindings of task %v: %v\n", t.ID, err)
+	}
+	n.AllocatePorts(t.ID, ports)
+	if len(t.Volumes()) > 0 {
+		n.DiskAllocated += t.Disk
+	}
+}
+
+// releaseResources frees what a task held on its node once it no longer
+// runs there.
+func (m *Manager) releaseResources(taskID uuid.UUID) {
+	n := m.getNode(m.TaskWorkerMap[taskID])
+	if n == nil {
+		return
+	}
+
+	n.ReleasePorts(taskID)
+
+	t, ok := m.TasksDb[taskID]
+	if ok && len(t.Volumes()) > 0 {
+		n.DiskAllocated -= t.Disk
+	}
+}
+
+// unassignTask undoes the placement of a task its worker couldn't be
+// reached for, leaving it Pending so it can be scheduled afresh.
+func (m *Manager) unassignTask(taskID uuid.UUID) {
+	m.releaseResources(taskID)
+
+	w := m.TaskWorkerMap[taskID]
+	delete(m.TaskWorkerMap, taskID)
+	m.remove(assignmentsBucket, taskID.String())
+	if t, ok := m.TasksDb[taskID]; ok {
+		t.State = task.Pending
+		m.saveTask(t)
+	}
+
+	ids := m.WorkerTaskMap[w]
+	for i, id := range ids {
+		if id == taskID {
+			m.WorkerTaskMap[w] = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+}
+
+// placeAfresh queues a task no longer assigned to a worker to be placed
+// again from scratch, by te, as it is when its worker has left.
+func (m *Manager) placeAfresh(t *task.Task, te task.TaskEvent) {
+	t.State = task.Pending
+	t.ContainerId = ""
+	t.HostPorts = nil
+	t.Containers = nil
+	m.saveTask(t)
+
+	te.Task = *t
+	te.Task.State = task.Scheduled
+	m.enqueue(te)
+}
+
+func httpDo(ctx context.Context, method string, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return http.DefaultClient.Do(req)
+}
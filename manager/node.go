@@ -0,0 +1,207 @@
+package manager
+
+import (
+	"cube/node"
+	"cube/task"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+
+	"github.com/google/uuid"
+)
+
+var ErrNodeNotFound = errors.New("node not found")
+
+// AddWorker makes the worker at addr part of the cluster, so tasks may be
+// placed on it and daemon sets that select it start their tasks there.
+// Adding a worker that is already part of the cluster does nothing.
+func (m *Manager) AddWorker(addr string) {
+	m.mu.Lock()
+	if m.getNode(addr) != nil {
+		m.mu.Unlock()
+		return
+	}
+
+	m.addWorker(addr)
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+}
+
+// RegisterWorker adds the worker sending the heartbeat to the cluster, if
+// it isn't part of it already, and records the heartbeat. Registered
+// workers are kept in the store, so they stay part of the cluster across
+// manager restarts until they are removed.
+func (m *Manager) RegisterWorker(hb node.Heartbeat) error {
+	if hb.Address == "" {
+		return errors.New("no address given")
+	}
+
+	m.mu.Lock()
+	n := m.getNode(hb.Address)
+	added := n == nil
+	if added {
+		n = m.addWorker(hb.Address)
+		m.persist(workersBucket, hb.Address, hb.Address)
+	}
+	m.heartbeat(n, hb)
+	if added {
+		m.reconcile(m.workloads(m.desired()), false)
+	}
+	m.mu.Unlock()
+
+	if added {
+		m.wake()
+	}
+
+	return nil
+}
+
+// Heartbeat records a heartbeat from the named node, updating its capacity
+// and stats and marking it Ready. Nodes the manager doesn't know, say
+// because they were removed, get ErrNodeNotFound and should register
+// again.
+func (m *Manager) Heartbeat(name string, hb node.Heartbeat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := m.getNode(name)
+	if n == nil {
+		return ErrNodeNotFound
+	}
+	m.heartbeat(n, hb)
+
+	return nil
+}
+
+// CheckNodes marks the nodes not heard from within NodeTimeout NotReady.
+// No new tasks are placed on them until they are heard from again; the
+// tasks already there are left be, as the node may only be cut off from
+// the manager.
+func (m *Manager) CheckNodes() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.Now()
+	for _, n := range m.WorkerNodes {
+		if n.Ready() && now.Sub(n.LastHeartbeat) > m.NodeTimeout {
+			log.Printf("[Manager] Worker %s not heard from since %v, marking it NotReady\n", n.Name, n.LastHeartbeat)
+			n.Status = node.NodeNotReady
+		}
+	}
+}
+
+// RemoveWorker takes the worker at addr out of the cluster. Its daemon set
+// tasks, and tasks it was stopping, are marked Completed; its other live
+// tasks are marked Failed, so they are restarted on other workers or, for
+// jobs, replaced like any failed task.
+func (m *Manager) RemoveWorker(addr string) error {
+	m.mu.Lock()
+	if m.getNode(addr) == nil {
+		m.mu.Unlock()
+		return ErrNodeNotFound
+	}
+
+	for i, w := range m.Workers {
+		if w == addr {
+			m.Workers = append(m.Workers[:i:i], m.Workers[i+1:]...)
+			break
+		}
+	}
+	for i, n := range m.WorkerNodes {
+		if n.Name == addr {
+			m.WorkerNodes = append(m.WorkerNodes[:i:i], m.WorkerNodes[i+1:]...)
+			break
+		}
+	}
+
+	now := m.Now().UTC()
+	for _, id := range m.WorkerTaskMap[addr] {
+		delete(m.TaskWorkerMap, id)
+		m.remove(assignmentsBucket, id.String())
+
+		t, ok := m.TasksDb[id]
+		if !ok || !isLive(t) {
+			continue
+		}
+		if t.Node != "" || m.retiring[id] {
+			t.State = task.Completed
+			t.Stopped = true
+		} else {
+			t.State = task.Failed
+			t.FailureReason = fmt.Sprintf("worker %s left the cluster", addr)
+		}
+		t.EndTime = now
+		m.saveTask(t)
+	}
+	delete(m.WorkerTaskMap, addr)
+	m.remove(workersBucket, addr)
+	log.Printf("[Manager] Worker %s left the cluster\n", addr)
+
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+// SetNodeLabels replaces the labels of the named node. Daemon sets start
+// tasks on the node if it now matches their selector and stop those on it
+// if it no longer does.
+func (m *Manager) SetNodeLabels(name string, labels map[string]string) error {
+	m.mu.Lock()
+	n := m.getNode(name)
+	if n == nil {
+		m.mu.Unlock()
+		return ErrNodeNotFound
+	}
+
+	labels = maps.Clone(labels)
+	n.Labels = labels
+	m.NodeLabels[name] = labels
+	m.persist(nodeLabelsBucket, name, labels)
+
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+// The helpers below expect the caller to hold m.mu.
+
+// addWorker adds a node for the worker at addr, Ready as of now.
+func (m *Manager) addWorker(addr string) *node.Node {
+	n := node.NewNode(addr, fmt.Sprintf("http://%v", addr), "worker")
+	n.Labels = m.NodeLabels[addr]
+	n.LastHeartbeat = m.Now()
+	m.Workers = append(m.Workers, addr)
+	m.WorkerNodes = append(m.WorkerNodes, n)
+	if _, ok := m.WorkerTaskMap[addr]; !ok {
+		m.WorkerTaskMap[addr] = []uuid.UUID{}
+	}
+	log.Printf("[Manager] Worker %s joined the cluster\n", addr)
+
+	return n
+}
+
+func (m *Manager) heartbeat(n *node.Node, hb node.Heartbeat) {
+	n.Cores = hb.Cores
+	n.Memory = hb.Memory
+	n.Disk = hb.Disk
+	n.Stats = hb.Stats
+	m.seen(n)
+}
+
+// seen marks the node Ready as of now.
+func (m *Manager) seen(n *node.Node) {
+	if !n.Ready() {
+		log.Printf("[Manager] Worker %s is Ready again\n", n.Name)
+	}
+	n.Status = node.NodeReady
+	n.LastHeartbeat = m.Now()
+}
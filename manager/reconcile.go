@@ -0,0 +1,454 @@
+package manager
+
+import (
+	"cube/manifest"
+	"cube/task"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// maxRestarts is how many times the manager restarts a failed or unhealthy
+// task before giving up on it.
+const maxRestarts = 3
+
+// workload is a set of identical tasks the manager keeps live: Replicas
+// tasks built from Spec, replaced as Update allows when Spec changes.
+// Applied task specs are workloads of one that are stopped before being
+// replaced; services also carry their name and current revision, jobs
+// their name and current run, and a daemon set's task the node it is
+// pinned to.
+type workload struct {
+	Spec     manifest.TaskSpec
+	Replicas int
+	Update   manifest.UpdateStrategy
+	Service  string
+	Job      string
+	Revision int
+	Node     string
+}
+
+// Reconcile converges the applied tasks, service replicas and job tasks on
+// the specs, services, daemon sets and jobs last applied, replacing tasks
+// that were lost or failed for good, moving rolling updates and job runs
+// along, starting the jobs of cron jobs that are due and starting workflow
+// steps whose dependencies have completed.
+func (m *Manager) Reconcile() {
+	m.mu.Lock()
+	m.updateCronJobs(m.Now().UTC())
+	m.updateJobs()
+	res := m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	if len(res.Created)+len(res.Updated)+len(res.Scaled)+len(res.Stopped) > 0 {
+		log.Printf("[Manager] Reconciled: created %v, updated %v, scaled %v, stopped %v\n", res.Created, res.Updated, res.Scaled, res.Stopped)
+		m.wake()
+	}
+}
+
+// The helpers below expect the caller to hold m.mu.
+
+// desiredState is what was applied, or is about to be, by name.
+type desiredState struct {
+	Specs      map[string]manifest.TaskSpec
+	Services   map[string]manifest.Service
+	DaemonSets map[string]manifest.DaemonSet
+	Jobs       map[string]manifest.Job
+	CronJobs   map[string]manifest.CronJob
+	Workflows  map[string]manifest.Workflow
+}
+
+func newDesiredState(mf manifest.Manifest) desiredState {
+	d := desiredState{
+		Specs:      map[string]manifest.TaskSpec{},
+		Services:   map[string]manifest.Service{},
+		DaemonSets: map[string]manifest.DaemonSet{},
+		Jobs:       map[string]manifest.Job{},
+		CronJobs:   map[string]manifest.CronJob{},
+		Workflows:  map[string]manifest.Workflow{},
+	}
+	for _, s := range mf.Tasks {
+		d.Specs[s.Name] = s
+	}
+	for _, s := range mf.Services {
+		d.Services[s.Name] = s
+	}
+	for _, ds := range mf.DaemonSets {
+		d.DaemonSets[ds.Name] = ds
+	}
+	for _, j := range mf.Jobs {
+		d.Jobs[j.Name] = j
+	}
+	for _, c := range mf.CronJobs {
+		d.CronJobs[c.Name] = c
+	}
+	for _, w := range mf.Workflows {
+		d.Workflows[w.Name] = w
+	}
+
+	return d
+}
+
+// desired returns what was last applied.
+func (m *Manager) desired() desiredState {
+	return desiredState{
+		Specs:      m.Specs,
+		Services:   m.Services,
+		DaemonSets: m.DaemonSets,
+		Jobs:       m.Jobs,
+		CronJobs:   m.CronJobs,
+		Workflows:  m.Workflows,
+	}
+}
+
+// owners returns the owners of the objects in d, such as "service/web".
+func (d desiredState) owners() map[string]bool {
+	res := map[string]bool{}
+	for _, s := range d.Specs {
+		res[s.Owner()] = true
+	}
+	for _, s := range d.Services {
+		res[s.Owner()] = true
+	}
+	for _, ds := range d.DaemonSets {
+		res[ds.Owner()] = true
+	}
+	for _, j := range d.Jobs {
+		res[j.Owner()] = true
+	}
+	for _, c := range d.CronJobs {
+		res[c.Owner()] = true
+	}
+	for _, w := range d.Workflows {
+		res[w.Owner()] = true
+	}
+
+	return res
+}
+
+// workloads returns the workloads for the given specs, services, daemon
+// sets and jobs, the jobs the given cron jobs started and the steps of the
+// given workflows that started, by owner.
+func (m *Manager) workloads(d desiredState) map[string]workload {
+	res := map[string]workload{}
+	for _, s := range d.Specs {
+		res[s.Owner()] = workload{
+			Spec:     s,
+			Replicas: 1,
+			Update:   manifest.UpdateStrategy{MaxUnavailable: 1},
+		}
+	}
+	for _, s := range d.Services {
+		res[s.Owner()] = workload{
+			Spec:     s.Template,
+			Replicas: s.Replicas,
+			Update:   s.Update,
+			Service:  s.Name,
+			Revision: m.currentRevision(s.Name),
+		}
+	}
+	for _, ds := range d.DaemonSets {
+		for owner, w := range m.daemonWorkloads(ds) {
+			res[owner] = w
+		}
+	}
+	for _, j := range d.Jobs {
+		res[j.Owner()] = m.jobWorkload(j)
+	}
+	for _, j := range m.startedJobs(d.CronJobs) {
+		res[j.Owner()] = m.jobWorkload(j)
+	}
+	for _, w := range d.Workflows {
+		for _, j := range m.stepJobs(w) {
+			res[j.Owner()] = m.jobWorkload(j)
+		}
+	}
+
+	return res
+}
+
+func (m *Manager) reconcile(desired map[string]workload, dryRun bool) ApplyResult {
+	live := m.liveTasks()
+
+	res := ApplyResult{}
+	for owner, tasks := range live {
+		if _, ok := desired[owner]; ok {
+			continue
+		}
+
+		res.Stopped = append(res.Stopped, owner)
+		if !dryRun {
+			for _, t := range tasks {
+				m.retireTask(t)
+			}
+		}
+	}
+
+	for owner, w := range desired {
+		hash := w.Spec.Hash()
+
+		var current, stale []*task.Task
+		for _, t := range live[owner] {
+			if t.SpecHash == hash {
+				current = append(current, t)
+			} else {
+				stale = append(stale, t)
+			}
+		}
+
+		missing := w.Replicas - len(current)
+		switch {
+		case len(stale) > 0:
+			res.Updated = append(res.Updated, owner)
+		case len(current) == 0 && missing > 0:
+			res.Created = append(res.Created, owner)
+		case missing != 0:
+			res.Scaled = append(res.Scaled, owner)
+		default:
+			res.Unchanged = append(res.Unchanged, owner)
+		}
+
+		if dryRun {
+			continue
+		}
+
+		if w.Service != "" && m.checkRollout(owner, w, len(stale) > 0) {
+			// The service was rolled back; its new template is picked
+			// up by the next pass.
+			continue
+		}
+
+		if len(stale) > 0 {
+			if m.Rollouts[w.Service].State != RolloutPaused {
+				m.rollingUpdate(owner, w, current, stale)
+			}
+			continue
+		}
+
+		if missing < 0 {
+			sortForRetiring(current)
+			for _, t := range current[:-missing] {
+				m.retireTask(t)
+			}
+		}
+		for i := 0; i < missing; i++ {
+			m.createTask(owner, w)
+		}
+	}
+
+	res.sort()
+
+	return res
+}
+
+// rollingUpdate takes one step of replacing stale tasks with current ones:
+// old tasks that aren't serving are stopped at once, new ones are started
+// as far as MaxSurge allows, and serving old ones are stopped as far as
+// MaxUnavailable allows, counting only new tasks that are ready.
+func (m *Manager) rollingUpdate(owner string, w workload, current []*task.Task, stale []*task.Task) {
+	if extra := len(current) - w.Replicas; extra > 0 {
+		sortForRetiring(current)
+		for _, t := range current[:extra] {
+			m.retireTask(t)
+		}
+		current = current[extra:]
+	}
+
+	var serving []*task.Task
+	for _, t := range stale {
+		if m.isReady(t) {
+			serving = append(serving, t)
+		} else {
+			m.retireTask(t)
+		}
+	}
+
+	ready := 0
+	for _, t := range current {
+		if m.isReady(t) {
+			ready++
+		}
+	}
+
+	start := min(w.Replicas+w.Update.MaxSurge-len(current)-len(serving), w.Replicas-len(current))
+	for i := 0; i < start; i++ {
+		m.createTask(owner, w)
+	}
+
+	stop := min(ready+len(serving)-(w.Replicas-w.Update.MaxUnavailable), len(serving))
+	if stop > 0 {
+		sortForRetiring(serving)
+		for _, t := range serving[:stop] {
+			m.retireTask(t)
+		}
+	}
+}
+
+// checkRollout moves the service's rollout on: it is complete once every
+// replica is current and ready, and if a task of the revision being rolled
+// out fails first the service is rolled back to the revision before, or
+// the rollout paused if it was a rollback itself. It reports whether the
+// service was rolled back.
+func (m *Manager) checkRollout(owner string, w workload, updating bool) bool {
+	r, ok := m.Rollouts[w.Service]
+	if !ok || r.State != RolloutProgressing || r.Revision != w.Revision {
+		return false
+	}
+
+	hash := w.Spec.Hash()
+	var failed *task.Task
+	ready := 0
+	for _, t := range m.TasksDb {
+		if t.Owner != owner || t.SpecHash != hash {
+			continue
+		}
+		// Only tasks started for this revision can fail it; those kept
+		// from an earlier revision with the same template count as ready.
+		if t.Revision == w.Revision && (t.State == task.Failed || t.RestartCount > 0) {
+			failed = t
+			break
+		}
+		if isLive(t) && !m.retiring[t.ID] && m.isReady(t) {
+			ready++
+		}
+	}
+
+	if failed == nil {
+		if !updating && ready >= w.Replicas {
+			r.State = RolloutComplete
+			m.setRollout(w.Service, r)
+			log.Printf("[Manager] Rolled out revision %d of service %s\n", r.Revision, w.Service)
+		}
+		return false
+	}
+
+	reason := failed.FailureReason
+	if reason == "" {
+		reason = "restarted"
+	}
+
+	prev, ok := m.previousRevision(w.Service)
+	if !ok {
+		// A first revision has nothing to go back to; its replicas are
+		// replaced like any other's.
+		return false
+	}
+	if r.Rollback {
+		r.State = RolloutPaused
+		r.Message = fmt.Sprintf("task %s failed: %s", failed.ID, reason)
+		m.setRollout(w.Service, r)
+		log.Printf("[Manager] Paused rollout of revision %d of service %s: %s\n", r.Revision, w.Service, r.Message)
+		return false
+	}
+
+	msg := fmt.Sprintf("revision %d failed, task %s: %s", r.Revision, failed.ID, reason)
+	log.Printf("[Manager] Rolling service %s back to revision %d: %s\n", w.Service, prev.Number, msg)
+	m.rollBack(w.Service, prev, msg)
+
+	return true
+}
+
+// isReady reports whether a task serves: it runs and, if it has a health
+// check, has passed it since it last started.
+func (m *Manager) isReady(t *task.Task) bool {
+	return t.State == task.Running && (t.HealthCheck == "" || m.healthy[t.ID])
+}
+
+// liveTasks returns the live tasks of every owner, leaving out those being
+// stopped.
+func (m *Manager) liveTasks() map[string][]*task.Task {
+	for id := range m.retiring {
+		if t, ok := m.TasksDb[id]; !ok || !isLive(t) {
+			delete(m.retiring, id)
+		}
+	}
+	for id := range m.healthy {
+		if t, ok := m.TasksDb[id]; !ok || t.State != task.Running {
+			delete(m.healthy, id)
+		}
+	}
+
+	live := map[string][]*task.Task{}
+	for _, t := range m.TasksDb {
+		if t.Owner != "" && isLive(t) && !m.retiring[t.ID] {
+			live[t.Owner] = append(live[t.Owner], t)
+		}
+	}
+
+	return live
+}
+
+// isLive reports whether a task runs, or is still on its way to running,
+// as opposed to having finished, been stopped or been given up on. Failed
+// job tasks are replaced rather than restarted, so they are never live.
+func isLive(t *task.Task) bool {
+	switch t.State {
+	case task.Pending, task.Scheduled, task.Running:
+		return true
+	case task.Failed:
+		return !t.RunToCompletion && t.RestartCount < maxRestarts
+	}
+
+	return false
+}
+
+// sortForRetiring orders tasks so those furthest from serving come first,
+// and among those running the newest, when scaling down.
+func sortForRetiring(tasks []*task.Task) {
+	rank := map[task.TaskState]int{task.Pending: 0, task.Failed: 1, task.Scheduled: 2, task.Running: 3}
+
+	sort.SliceStable(tasks, func(i, j int) bool {
+		ri, rj := rank[tasks[i].State], rank[tasks[j].State]
+		if ri != rj {
+			return ri < rj
+		}
+
+		return tasks[i].StartTime.After(tasks[j].StartTime)
+	})
+}
+
+// createTask records a task for the workload as Pending, so it counts as
+// live from the start, and queues it to be placed.
+func (m *Manager) createTask(owner string, w workload) {
+	t := w.Spec.Task(owner, w.Revision)
+	t.RunToCompletion = w.Job != ""
+	t.Node = w.Node
+
+	persisted := t
+	persisted.State = task.Pending
+	m.TasksDb[t.ID] = &persisted
+	m.saveTask(&persisted)
+
+	m.enqueue(task.TaskEvent{
+		ID:        uuid.New(),
+		State:     task.Running,
+		Timestamp: m.Now(),
+		Task:      t,
+	})
+}
+
+// retireTask stops a task on its worker, or marks it Completed straight
+// away if it was never placed. A task being stopped no longer counts as
+// live, so it isn't stopped twice before its worker reports back.
+func (m *Manager) retireTask(t *task.Task) {
+	if _, ok := m.TaskWorkerMap[t.ID]; !ok {
+		t.State = task.Completed
+		t.Stopped = true
+		t.EndTime = m.Now().UTC()
+		m.saveTask(t)
+		return
+	}
+
+	m.retiring[t.ID] = true
+
+	stop := *t
+	stop.State = task.Completed
+	m.enqueue(task.TaskEvent{
+		ID:        uuid.New(),
+		State:     task.Completed,
+		Timestamp: m.Now(),
+		Task:      stop,
+	})
+}
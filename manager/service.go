@@ -0,0 +1,273 @@
+package manager
+
+import (
+	"cube/manifest"
+	"cube/task"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrServiceNotFound = errors.New("service not found")
+
+// ServiceStatus is a service with how many of its replicas are running and
+// ready, the tasks that currently count as its replicas and the progress of
+// its latest revision.
+type ServiceStatus struct {
+	manifest.Service
+	Running int
+	Ready   int
+	Tasks   []uuid.UUID
+	Rollout Rollout
+}
+
+// SetService creates the service, or replaces its template and replica
+// count, and reconciles its replicas straight away.
+func (m *Manager) SetService(s manifest.Service) error {
+	err := s.Validate()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.Services[s.Name] = s
+	m.persist(servicesBucket, s.Name, s)
+	m.markApplied(s.Owner(), false)
+	m.recordRevision(s, "api", false, "")
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+// ScaleService changes how many replicas of the named service run.
+func (m *Manager) ScaleService(name string, replicas int) error {
+	m.mu.RLock()
+	s, ok := m.Services[name]
+	m.mu.RUnlock()
+	if !ok {
+		return ErrServiceNotFound
+	}
+
+	s.Replicas = replicas
+	return m.SetService(s)
+}
+
+// DeleteService removes the service and stops its replicas.
+func (m *Manager) DeleteService(name string) error {
+	m.mu.Lock()
+	s, ok := m.Services[name]
+	if !ok {
+		m.mu.Unlock()
+		return ErrServiceNotFound
+	}
+
+	delete(m.Services, name)
+	m.remove(servicesBucket, name)
+	m.markApplied(s.Owner(), false)
+	m.deleteHistory(name)
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+func (m *Manager) GetServices() []ServiceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	live := m.liveTasks()
+	res := []ServiceStatus{}
+	for _, s := range m.Services {
+		res = append(res, m.serviceStatus(s, live[s.Owner()]))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
+
+func (m *Manager) GetService(name string) (ServiceStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.Services[name]
+	if !ok {
+		return ServiceStatus{}, false
+	}
+
+	return m.serviceStatus(s, m.liveTasks()[s.Owner()]), true
+}
+
+func (m *Manager) serviceStatus(s manifest.Service, tasks []*task.Task) ServiceStatus {
+	st := ServiceStatus{Service: s, Tasks: []uuid.UUID{}, Rollout: m.Rollouts[s.Name]}
+	for _, t := range tasks {
+		st.Tasks = append(st.Tasks, t.ID)
+		if t.State == task.Running {
+			st.Running++
+		}
+		if m.isReady(t) {
+			st.Ready++
+		}
+	}
+	sort.Slice(st.Tasks, func(i, j int) bool { return st.Tasks[i].String() < st.Tasks[j].String() })
+
+	return st
+}
+
+const (
+	RolloutProgressing = "Progressing"
+	RolloutComplete    = "Complete"
+	RolloutPaused      = "Paused"
+)
+
+// RevisionHistoryLimit is how many revisions of each service are kept.
+const RevisionHistoryLimit = 10
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// Revision is a template a service has run, numbered in the order they
+// were rolled out. Cause says what rolled it out.
+type Revision struct {
+	Number   int
+	Template manifest.TaskSpec
+	Hash     string
+	Created  time.Time
+	Cause    string
+}
+
+// Rollout is the progress of a service's latest revision. A Paused rollout
+// replaces no more old replicas until another revision is rolled out.
+type Rollout struct {
+	Revision int
+	State    string
+	Rollback bool
+	Message  string
+}
+
+// GetRevisions returns the service's revision history, oldest first.
+func (m *Manager) GetRevisions(name string) ([]Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, ok := m.Services[name]; !ok {
+		return nil, ErrServiceNotFound
+	}
+
+	return append([]Revision{}, m.Revisions[name]...), nil
+}
+
+// RollbackService rolls the service out again with the template of the
+// given revision, or of the one before the current revision when revision
+// is 0.
+func (m *Manager) RollbackService(name string, revision int) error {
+	m.mu.Lock()
+	if _, ok := m.Services[name]; !ok {
+		m.mu.Unlock()
+		return ErrServiceNotFound
+	}
+
+	var target Revision
+	var ok bool
+	if revision == 0 {
+		target, ok = m.previousRevision(name)
+	} else {
+		for _, r := range m.Revisions[name] {
+			if r.Number == revision {
+				target, ok = r, true
+			}
+		}
+	}
+	if !ok {
+		m.mu.Unlock()
+		return ErrRevisionNotFound
+	}
+
+	m.rollBack(name, target, "")
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+// The helpers below expect the caller to hold m.mu.
+
+// recordRevision adds a revision for the service's template unless it is
+// already the current one, and starts rolling it out.
+func (m *Manager) recordRevision(s manifest.Service, cause string, rollback bool, msg string) {
+	revs := m.Revisions[s.Name]
+	hash := s.Template.Hash()
+	if len(revs) > 0 && revs[len(revs)-1].Hash == hash {
+		return
+	}
+
+	n := 1
+	if len(revs) > 0 {
+		n = revs[len(revs)-1].Number + 1
+	}
+	revs = append(revs, Revision{Number: n, Template: s.Template, Hash: hash, Created: m.Now().UTC(), Cause: cause})
+	if len(revs) > RevisionHistoryLimit {
+		revs = revs[len(revs)-RevisionHistoryLimit:]
+	}
+	m.Revisions[s.Name] = revs
+	m.persist(revisionsBucket, s.Name, revs)
+
+	m.setRollout(s.Name, Rollout{Revision: n, State: RolloutProgressing, Rollback: rollback, Message: msg})
+}
+
+// rollBack rolls the service out with the template of an earlier revision.
+func (m *Manager) rollBack(name string, target Revision, msg string) {
+	s := m.Services[name]
+	s.Template = target.Template
+	m.Services[name] = s
+	m.persist(servicesBucket, name, s)
+
+	m.recordRevision(s, fmt.Sprintf("rollback to revision %d", target.Number), true, msg)
+}
+
+func (m *Manager) deleteHistory(name string) {
+	delete(m.Revisions, name)
+	delete(m.Rollouts, name)
+	m.remove(revisionsBucket, name)
+	m.remove(rolloutsBucket, name)
+}
+
+func (m *Manager) setRollout(name string, r Rollout) {
+	m.Rollouts[name] = r
+	m.persist(rolloutsBucket, name, r)
+}
+
+func (m *Manager) currentRevision(name string) int {
+	revs := m.Revisions[name]
+	if len(revs) == 0 {
+		return 0
+	}
+
+	return revs[len(revs)-1].Number
+}
+
+// previousRevision returns the latest revision with a template other than
+// the current one.
+func (m *Manager) previousRevision(name string) (Revision, bool) {
+	revs := m.Revisions[name]
+	if len(revs) == 0 {
+		return Revision{}, false
+	}
+
+	current := revs[len(revs)-1].Hash
+	for i := len(revs) - 2; i >= 0; i-- {
+		if revs[i].Hash != current {
+			return revs[i], true
+		}
+	}
+
+	return Revision{}, false
+}
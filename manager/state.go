@@ -0,0 +1,256 @@
+package manager
+
+import (
+	"cube/store"
+	"cube/task"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	tasksBucket       = "tasks"
+	eventsBucket      = "events"
+	assignmentsBucket = "assignments"
+	pendingBucket     = "pending"
+	specsBucket       = "specs"
+	servicesBucket    = "services"
+	daemonSetsBucket  = "daemonsets"
+	nodeLabelsBucket  = "nodelabels"
+	revisionsBucket   = "revisions"
+	rolloutsBucket    = "rollouts"
+	jobsBucket        = "jobs"
+	jobRunsBucket     = "jobruns"
+	cronJobsBucket    = "cronjobs"
+	cronStatesBucket  = "cronstates"
+	workflowsBucket   = "workflows"
+	workersBucket     = "workers"
+	appliedBucket     = "applied"
+)
+
+// pendingEvent is what sits on the pending queue. Seq orders the queue, so
+// it can be rebuilt in the same order from the store.
+type pendingEvent struct {
+	Seq   uint64
+	Event task.TaskEvent
+
+	// Attempts counts the times the event's task could not be placed, and
+	// NotBefore is when it is tried again.
+	Attempts  int
+	NotBefore time.Time
+}
+
+// The helpers below expect the caller to hold m.mu.
+
+func (m *Manager) enqueue(te task.TaskEvent) {
+	m.requeue(te, 0)
+}
+
+// requeue enqueues an event whose task could not be placed attempts times,
+// to be dequeued once its placement backoff has passed.
+func (m *Manager) requeue(te task.TaskEvent, attempts int) {
+	m.pendingSeq++
+	pe := pendingEvent{Seq: m.pendingSeq, Event: te, Attempts: attempts}
+	if attempts > 0 {
+		pe.NotBefore = m.Now().Add(m.placementBackoff(attempts))
+	}
+
+	m.persist(pendingBucket, pendingKey(pe.Seq), pe)
+	m.Pending.Enqueue(pe)
+}
+
+// dequeue returns the first pending event that is due, putting those still
+// backing off at the end of the queue.
+func (m *Manager) dequeue() (pendingEvent, bool) {
+	now := m.Now()
+	for n := m.Pending.Len(); n > 0; n-- {
+		pe := m.Pending.Dequeue().(pendingEvent)
+		if pe.NotBefore.After(now) {
+			m.Pending.Enqueue(pe)
+			continue
+		}
+
+		m.remove(pendingBucket, pendingKey(pe.Seq))
+		return pe, true
+	}
+
+	return pendingEvent{}, false
+}
+
+// placementBackoff is how long to wait before trying to place a task again
+// after it could not be placed attempts times.
+func (m *Manager) placementBackoff(attempts int) time.Duration {
+	d := m.RetryInterval
+	for i := 1; i < attempts && d < MaxPlacementBackoff; i++ {
+		d *= 2
+	}
+
+	return min(d, MaxPlacementBackoff)
+}
+
+func (m *Manager) saveTask(t *task.Task) {
+	m.persist(tasksBucket, t.ID.String(), t)
+}
+
+func (m *Manager) saveEvent(te *task.TaskEvent) {
+	m.persist(eventsBucket, te.ID.String(), te)
+}
+
+func (m *Manager) assignTask(taskID uuid.UUID, worker string) {
+	m.TaskWorkerMap[taskID] = worker
+	m.WorkerTaskMap[worker] = append(m.WorkerTaskMap[worker], taskID)
+	m.persist(assignmentsBucket, taskID.String(), worker)
+}
+
+func (m *Manager) persist(bucket string, key string, value any) {
+	err := m.Store.Put(bucket, key, value)
+	if err != nil {
+		log.Printf("[Manager] Error persisting %s %s: %v\n", bucket, key, err)
+	}
+}
+
+func (m *Manager) remove(bucket string, key string) {
+	err := m.Store.Delete(bucket, key)
+	if err != nil {
+		log.Printf("[Manager] Error deleting %s %s: %v\n", bucket, key, err)
+	}
+}
+
+// load rebuilds the manager's maps, pending queue and the resources held on
+// each node from the store.
+func (m *Manager) load() error {
+	tasks := map[string]*task.Task{}
+	err := loadBucket(m.Store, tasksBucket, tasks)
+	if err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		m.TasksDb[t.ID] = t
+	}
+
+	// Workers that registered themselves are added before the tasks
+	// assigned to them.
+	workers := map[string]string{}
+	err = loadBucket(m.Store, workersBucket, workers)
+	if err != nil {
+		return err
+	}
+	for key := range workers {
+		if m.getNode(key) == nil {
+			m.addWorker(key)
+		}
+	}
+
+	events := map[string]*task.TaskEvent{}
+	err = loadBucket(m.Store, eventsBucket, events)
+	if err != nil {
+		return err
+	}
+	for _, te := range events {
+		m.TaskEventDb[te.ID] = te
+	}
+
+	assignments := map[string]string{}
+	err = loadBucket(m.Store, assignmentsBucket, assignments)
+	if err != nil {
+		return err
+	}
+	for key, worker := range assignments {
+		id, err := uuid.Parse(key)
+		if err != nil {
+			return fmt.Errorf("decoding %s %s: %v", assignmentsBucket, key, err)
+		}
+
+		m.TaskWorkerMap[id] = worker
+		m.WorkerTaskMap[worker] = append(m.WorkerTaskMap[worker], id)
+
+		t, ok := m.TasksDb[id]
+		if ok && t.State != task.Completed {
+			m.allocateResources(t, worker)
+		}
+	}
+
+	pending := map[string]pendingEvent{}
+	err = loadBucket(m.Store, pendingBucket, pending)
+	if err != nil {
+		return err
+	}
+	queued := slices.Collect(maps.Values(pending))
+	sort.Slice(queued, func(i, j int) bool { return queued[i].Seq < queued[j].Seq })
+	for _, pe := range queued {
+		m.Pending.Enqueue(pe)
+		m.pendingSeq = pe.Seq
+	}
+
+	nodeLabels := map[string]map[string]string{}
+	err = loadBucket(m.Store, nodeLabelsBucket, nodeLabels)
+	if err != nil {
+		return err
+	}
+	for key, labels := range nodeLabels {
+		m.NodeLabels[key] = labels
+		if n := m.getNode(key); n != nil {
+			n.Labels = labels
+		}
+	}
+
+	applied := map[string]bool{}
+	err = loadBucket(m.Store, appliedBucket, applied)
+	if err != nil {
+		return err
+	}
+	for owner := range applied {
+		m.Applied[owner] = true
+	}
+
+	// The rest is kept by the same key as in the store.
+	err = errors.Join(
+		loadBucket(m.Store, specsBucket, m.Specs),
+		loadBucket(m.Store, servicesBucket, m.Services),
+		loadBucket(m.Store, daemonSetsBucket, m.DaemonSets),
+		loadBucket(m.Store, revisionsBucket, m.Revisions),
+		loadBucket(m.Store, rolloutsBucket, m.Rollouts),
+		loadBucket(m.Store, jobsBucket, m.Jobs),
+		loadBucket(m.Store, jobRunsBucket, m.JobRuns),
+		loadBucket(m.Store, cronJobsBucket, m.CronJobs),
+		loadBucket(m.Store, cronStatesBucket, m.CronStates),
+		loadBucket(m.Store, workflowsBucket, m.Workflows),
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[Manager] Loaded %d tasks, %d events, %d pending events, %d specs, %d services, %d daemon sets, %d jobs, %d cron jobs and %d workflows from the store\n", len(m.TasksDb), len(m.TaskEventDb), len(queued), len(m.Specs), len(m.Services), len(m.DaemonSets), len(m.Jobs), len(m.CronJobs), len(m.Workflows))
+
+	return nil
+}
+
+// loadBucket decodes every value in the bucket into the map, by key.
+func loadBucket[T any](s store.Store, bucket string, into map[string]T) error {
+	values, err := s.List(bucket)
+	if err != nil {
+		return err
+	}
+
+	for key, data := range values {
+		var v T
+		err := json.Unmarshal(data, &v)
+		if err != nil {
+			return fmt.Errorf("decoding %s %s: %v", bucket, key, err)
+		}
+		into[key] = v
+	}
+
+	return nil
+}
+
+func pendingKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
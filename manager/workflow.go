@@ -0,0 +1,248 @@
+package manager
+
+import (
+	"cube/manifest"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrWorkflowNotFound = errors.New("workflow not found")
+
+const (
+	WorkflowRunning   = "Running"
+	WorkflowSucceeded = "Succeeded"
+	WorkflowFailed    = "Failed"
+)
+
+// A step is Pending until the steps it depends on have completed, and
+// Skipped if another step failed for good before it could start.
+const (
+	StepPending   = "Pending"
+	StepRunning   = "Running"
+	StepSucceeded = "Succeeded"
+	StepFailed    = "Failed"
+	StepSkipped   = "Skipped"
+)
+
+// StepStatus is a workflow step with the job that runs it, the progress of
+// that job's run and the tasks started for it.
+type StepStatus struct {
+	manifest.Step
+	Job   string
+	State string
+	Run   JobRun
+	Tasks []uuid.UUID
+}
+
+// WorkflowStatus is a workflow with the state of each of its steps, in the
+// order they run. Message says which step failed the workflow, if one did.
+type WorkflowStatus struct {
+	Name      string
+	State     string
+	Message   string
+	StartTime time.Time
+	EndTime   time.Time
+	Steps     []StepStatus
+}
+
+// SetWorkflow creates the workflow, or replaces it, and starts the steps
+// that depend on no others straight away. Steps that already ran with the
+// same template are not run again.
+func (m *Manager) SetWorkflow(w manifest.Workflow) error {
+	err := w.Validate()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.deleteStepRuns(m.Workflows[w.Name], w)
+	m.Workflows[w.Name] = w
+	m.persist(workflowsBucket, w.Name, w)
+	m.markApplied(w.Owner(), false)
+	m.updateJobs()
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+// DeleteWorkflow removes the workflow and the runs of its steps, stopping
+// any of their tasks still running.
+func (m *Manager) DeleteWorkflow(name string) error {
+	m.mu.Lock()
+	w, ok := m.Workflows[name]
+	if !ok {
+		m.mu.Unlock()
+		return ErrWorkflowNotFound
+	}
+
+	delete(m.Workflows, name)
+	m.remove(workflowsBucket, name)
+	m.markApplied(w.Owner(), false)
+	m.deleteStepRuns(w, manifest.Workflow{})
+	m.reconcile(m.workloads(m.desired()), false)
+	m.mu.Unlock()
+
+	m.wake()
+
+	return nil
+}
+
+func (m *Manager) GetWorkflows() []WorkflowStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := []WorkflowStatus{}
+	for _, w := range m.Workflows {
+		res = append(res, m.workflowStatus(w))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
+
+func (m *Manager) GetWorkflow(name string) (WorkflowStatus, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	w, ok := m.Workflows[name]
+	if !ok {
+		return WorkflowStatus{}, false
+	}
+
+	return m.workflowStatus(w), true
+}
+
+// workflowStatus works out the state of every step of the workflow and of
+// the workflow as a whole: it has failed as soon as a step has failed for
+// good, and succeeded once every step has.
+func (m *Manager) workflowStatus(w manifest.Workflow) WorkflowStatus {
+	res := WorkflowStatus{Name: w.Name, State: WorkflowRunning, Steps: []StepStatus{}}
+	failed := m.workflowFailed(w)
+
+	succeeded, running := 0, 0
+	for _, s := range w.Order() {
+		j := w.StepJob(s)
+		js := m.jobStatus(j)
+		st := StepStatus{Step: s, Job: j.Name, Run: js.Run, Tasks: js.Tasks}
+
+		_, started := m.JobRuns[j.Name]
+		switch {
+		case !started && failed:
+			st.State = StepSkipped
+		case !started:
+			st.State = StepPending
+		case js.Run.State == JobComplete:
+			st.State = StepSucceeded
+			succeeded++
+		case js.Run.State == JobFailed:
+			st.State = StepFailed
+			if res.Message == "" {
+				res.Message = fmt.Sprintf("step %s failed: %s", s.Name, js.Run.Message)
+			}
+		default:
+			st.State = StepRunning
+			running++
+		}
+
+		if started {
+			if res.StartTime.IsZero() || js.Run.StartTime.Before(res.StartTime) {
+				res.StartTime = js.Run.StartTime
+			}
+			if js.Run.EndTime.After(res.EndTime) {
+				res.EndTime = js.Run.EndTime
+			}
+		}
+
+		res.Steps = append(res.Steps, st)
+	}
+
+	switch {
+	case failed:
+		res.State = WorkflowFailed
+	case succeeded == len(w.Steps):
+		res.State = WorkflowSucceeded
+	}
+	if res.State == WorkflowRunning || running > 0 {
+		res.EndTime = time.Time{}
+	}
+
+	return res
+}
+
+// The helpers below expect the caller to hold m.mu.
+
+// updateWorkflow brings the runs of the workflow's steps that have started,
+// or may now start, up to date. Steps are taken in order, so a step whose
+// last dependency has just completed starts in the same pass.
+func (m *Manager) updateWorkflow(w manifest.Workflow) {
+	for _, s := range w.Order() {
+		j := w.StepJob(s)
+		if _, ok := m.JobRuns[j.Name]; ok || m.stepReady(w, s) {
+			m.updateJob(j)
+		}
+	}
+}
+
+// stepJobs returns the jobs of the workflow's steps that have started or
+// may start now.
+func (m *Manager) stepJobs(w manifest.Workflow) []manifest.Job {
+	var res []manifest.Job
+	for _, s := range w.Steps {
+		j := w.StepJob(s)
+		if _, ok := m.JobRuns[j.Name]; ok || m.stepReady(w, s) {
+			res = append(res, j)
+		}
+	}
+
+	return res
+}
+
+// stepReady reports whether the step may start: every step it depends on
+// has completed and no step of the workflow has failed for good.
+func (m *Manager) stepReady(w manifest.Workflow, s manifest.Step) bool {
+	if m.workflowFailed(w) {
+		return false
+	}
+
+	for _, d := range s.DependsOn {
+		for _, p := range w.Steps {
+			if p.Name == d && m.JobRuns[w.StepJob(p).Name].State != JobComplete {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (m *Manager) workflowFailed(w manifest.Workflow) bool {
+	for _, s := range w.Steps {
+		if m.JobRuns[w.StepJob(s).Name].State == JobFailed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deleteStepRuns deletes the runs of the workflow's steps that keep, the
+// workflow replacing it, doesn't have.
+func (m *Manager) deleteStepRuns(w manifest.Workflow, keep manifest.Workflow) {
+	kept := map[string]bool{}
+	for _, s := range keep.Steps {
+		kept[keep.StepJob(s).Name] = true
+	}
+
+	for _, s := range w.Steps {
+		if name := w.StepJob(s).Name; !kept[name] {
+			m.deleteJobRun(name)
+		}
+	}
+}
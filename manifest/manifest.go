@@ -0,0 +1,627 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"cube/cron"
+	"cube/task"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest is the desired state of the cluster: every task and service it
+// names should be running as specified, every daemon set on each node it
+// selects, every job and workflow it names should run to completion, every
+// cron job should start its jobs on schedule, and nothing else that was
+// applied should be.
+type Manifest struct {
+	Tasks      []TaskSpec  `json:"tasks,omitempty" yaml:"tasks"`
+	Services   []Service   `json:"services,omitempty" yaml:"services"`
+	DaemonSets []DaemonSet `json:"daemonSets,omitempty" yaml:"daemonSets"`
+	Jobs       []Job       `json:"jobs,omitempty" yaml:"jobs"`
+	CronJobs   []CronJob   `json:"cronJobs,omitempty" yaml:"cronJobs"`
+	Workflows  []Workflow  `json:"workflows,omitempty" yaml:"workflows"`
+}
+
+// Service keeps Replicas tasks built from Template running, replacing those
+// that fail or are lost. A changed template is rolled out as Update says.
+type Service struct {
+	Name     string         `json:"name" yaml:"name"`
+	Replicas int            `json:"replicas" yaml:"replicas"`
+	Template TaskSpec       `json:"template" yaml:"template"`
+	Update   UpdateStrategy `json:"update,omitempty" yaml:"update"`
+}
+
+// UpdateStrategy bounds a rolling update: at most MaxSurge replicas above
+// the wanted count may run, and at most MaxUnavailable below it may be
+// unready, while old replicas are replaced. Leaving both at zero, which
+// would allow no progress, means the default of one surge replica and no
+// unavailable ones.
+type UpdateStrategy struct {
+	MaxSurge       int `json:"maxSurge,omitempty" yaml:"maxSurge"`
+	MaxUnavailable int `json:"maxUnavailable,omitempty" yaml:"maxUnavailable"`
+}
+
+// DefaultUpdate is the update strategy of services that don't give one.
+var DefaultUpdate = UpdateStrategy{MaxSurge: 1}
+
+// DaemonSet keeps one task built from Template running on every worker node
+// whose labels match NodeSelector, or on every node if it selects none. A
+// changed template replaces each node's task, stopping the old one first,
+// as it likely holds the same host ports.
+type DaemonSet struct {
+	Name         string            `json:"name" yaml:"name"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty" yaml:"nodeSelector"`
+	Template     TaskSpec          `json:"template" yaml:"template"`
+}
+
+// Job runs tasks built from Template until Completions of them have exited
+// 0, at most Parallelism at a time. A task that fails is replaced, after a
+// backoff, until more than BackoffLimit of them have failed, which fails the
+// job. Completions and Parallelism default to one.
+type Job struct {
+	Name         string   `json:"name" yaml:"name"`
+	Completions  int      `json:"completions,omitempty" yaml:"completions"`
+	Parallelism  int      `json:"parallelism,omitempty" yaml:"parallelism"`
+	BackoffLimit int      `json:"backoffLimit,omitempty" yaml:"backoffLimit"`
+	Template     TaskSpec `json:"template" yaml:"template"`
+}
+
+// Concurrency policies say what a cron job does when a run is due while a
+// job it started earlier is still running: start another alongside it,
+// skip the run, or stop the running job and start a new one.
+const (
+	AllowConcurrent   = "Allow"
+	ForbidConcurrent  = "Forbid"
+	ReplaceConcurrent = "Replace"
+)
+
+// CronJob starts a job built from Job at the times given by Schedule, a
+// cron expression read in TimeZone, UTC by default. A run missed because
+// the manager was down is started late, unless it is more than
+// StartingDeadline seconds late; of several missed runs only the latest is
+// started. The last SuccessfulJobsHistoryLimit (default 3) complete and
+// FailedJobsHistoryLimit (default 1) failed jobs are kept.
+type CronJob struct {
+	Name                       string `json:"name" yaml:"name"`
+	Schedule                   string `json:"schedule" yaml:"schedule"`
+	TimeZone                   string `json:"timeZone,omitempty" yaml:"timeZone"`
+	ConcurrencyPolicy          string `json:"concurrencyPolicy,omitempty" yaml:"concurrencyPolicy"`
+	StartingDeadline           int    `json:"startingDeadline,omitempty" yaml:"startingDeadline"`
+	SuccessfulJobsHistoryLimit int    `json:"successfulJobsHistoryLimit,omitempty" yaml:"successfulJobsHistoryLimit"`
+	FailedJobsHistoryLimit     int    `json:"failedJobsHistoryLimit,omitempty" yaml:"failedJobsHistoryLimit"`
+	Job                        Job    `json:"job" yaml:"job"`
+}
+
+// Workflow runs its steps, each a task run to completion, once every step
+// it depends on has completed. A step that fails is retried up to Retries
+// times; once one has failed for good no further steps start.
+type Workflow struct {
+	Name  string `json:"name" yaml:"name"`
+	Steps []Step `json:"steps" yaml:"steps"`
+}
+
+type Step struct {
+	Name      string   `json:"name" yaml:"name"`
+	DependsOn []string `json:"dependsOn,omitempty" yaml:"dependsOn"`
+	Retries   int      `json:"retries,omitempty" yaml:"retries"`
+	Template  TaskSpec `json:"template" yaml:"template"`
+}
+
+// TaskSpec describes a task by name. Its fields mirror those of task.Task
+// that a user chooses; the rest are filled in by the manager and workers.
+type TaskSpec struct {
+	Name          string            `json:"name" yaml:"name"`
+	Image         string            `json:"image" yaml:"image"`
+	PullPolicy    string            `json:"pullPolicy,omitempty" yaml:"pullPolicy"`
+	Cmd           []string          `json:"cmd,omitempty" yaml:"cmd"`
+	Entrypoint    []string          `json:"entrypoint,omitempty" yaml:"entrypoint"`
+	Env           []string          `json:"env,omitempty" yaml:"env"`
+	WorkingDir    string            `json:"workingDir,omitempty" yaml:"workingDir"`
+	User          string            `json:"user,omitempty" yaml:"user"`
+	CPU           float64           `json:"cpu,omitempty" yaml:"cpu"`
+	Memory        int64             `json:"memory,omitempty" yaml:"memory"`
+	Disk          int64             `json:"disk,omitempty" yaml:"disk"`
+	ExposedPorts  []string          `json:"exposedPorts,omitempty" yaml:"exposedPorts"`
+	Ports         map[string]string `json:"ports,omitempty" yaml:"ports"`
+	Mounts        []task.Mount      `json:"mounts,omitempty" yaml:"mounts"`
+	RestartPolicy string            `json:"restartPolicy,omitempty" yaml:"restartPolicy"`
+	StopSignal    string            `json:"stopSignal,omitempty" yaml:"stopSignal"`
+	StopTimeout   int               `json:"stopTimeout,omitempty" yaml:"stopTimeout"`
+	PreStopHook   string            `json:"preStopHook,omitempty" yaml:"preStopHook"`
+	HealthCheck   string            `json:"healthCheck,omitempty" yaml:"healthCheck"`
+
+	// InitContainers run one after the other, each to completion, before
+	// the task's own container starts. Sidecars run alongside it. They
+	// all share its network, so reach one another on localhost.
+	InitContainers []ContainerSpec `json:"initContainers,omitempty" yaml:"initContainers"`
+	Sidecars       []ContainerSpec `json:"sidecars,omitempty" yaml:"sidecars"`
+}
+
+// ContainerSpec is an init container or sidecar of a task. It publishes no
+// ports of its own; those it listens on are reached through the task's.
+type ContainerSpec struct {
+	Name       string       `json:"name" yaml:"name"`
+	Image      string       `json:"image" yaml:"image"`
+	PullPolicy string       `json:"pullPolicy,omitempty" yaml:"pullPolicy"`
+	Cmd        []string     `json:"cmd,omitempty" yaml:"cmd"`
+	Entrypoint []string     `json:"entrypoint,omitempty" yaml:"entrypoint"`
+	Env        []string     `json:"env,omitempty" yaml:"env"`
+	WorkingDir string       `json:"workingDir,omitempty" yaml:"workingDir"`
+	User       string       `json:"user,omitempty" yaml:"user"`
+	CPU        float64      `json:"cpu,omitempty" yaml:"cpu"`
+	Memory     int64        `json:"memory,omitempty" yaml:"memory"`
+	Mounts     []task.Mount `json:"mounts,omitempty" yaml:"mounts"`
+}
+
+// Parse reads a manifest written in YAML or JSON, which YAML is a superset
+// of, and validates it. Unknown fields are an error so typos don't pass
+// silently.
+func Parse(data []byte) (*Manifest, error) {
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+
+	m := &Manifest{}
+	err := d.Decode(m)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	err = m.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ReadFile parses the manifest at path, or standard input when path is "-".
+func ReadFile(path string) (*Manifest, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+func (m *Manifest) Validate() error {
+	if err := validateAll("task", m.Tasks, func(s TaskSpec) string { return s.Name }); err != nil {
+		return err
+	}
+	if err := validateAll("service", m.Services, func(s Service) string { return s.Name }); err != nil {
+		return err
+	}
+	if err := validateAll("daemon set", m.DaemonSets, func(d DaemonSet) string { return d.Name }); err != nil {
+		return err
+	}
+	if err := validateAll("job", m.Jobs, func(j Job) string { return j.Name }); err != nil {
+		return err
+	}
+	if err := validateAll("workflow", m.Workflows, func(w Workflow) string { return w.Name }); err != nil {
+		return err
+	}
+
+	return validateAll("cron job", m.CronJobs, func(c CronJob) string { return c.Name })
+}
+
+// validateAll checks that each of a manifest's objects of one kind is named,
+// by a name no other of the kind has, and valid, validating it in place so
+// the defaults it fills in are kept.
+func validateAll[T any, P interface {
+	*T
+	Validate() error
+}](kind string, objs []T, name func(T) string) error {
+	names := map[string]bool{}
+	for i := range objs {
+		n := name(objs[i])
+		if n == "" {
+			return fmt.Errorf("%s %d has no name", kind, i)
+		}
+		if names[n] {
+			return fmt.Errorf("%s %s is given more than once", kind, n)
+		}
+		names[n] = true
+
+		err := P(&objs[i]).Validate()
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", kind, n, err)
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the service, filling in the default update strategy and
+// naming its template after it when the template has no name of its own.
+func (s *Service) Validate() error {
+	if s.Name == "" {
+		return errors.New("no name given")
+	}
+	if s.Replicas < 0 {
+		return fmt.Errorf("invalid replica count %d", s.Replicas)
+	}
+	if s.Update.MaxSurge < 0 || s.Update.MaxUnavailable < 0 {
+		return fmt.Errorf("invalid update strategy %+v", s.Update)
+	}
+	if s.Update == (UpdateStrategy{}) {
+		s.Update = DefaultUpdate
+	}
+	if s.Template.Name == "" {
+		s.Template.Name = s.Name
+	}
+
+	return s.Template.Validate()
+}
+
+// Owner is how tasks built from the service are marked as its replicas.
+func (s Service) Owner() string {
+	return "service/" + s.Name
+}
+
+// Validate checks the daemon set, naming its template after it when the
+// template has no name of its own.
+func (d *DaemonSet) Validate() error {
+	if d.Name == "" {
+		return errors.New("no name given")
+	}
+	if d.Template.Name == "" {
+		d.Template.Name = d.Name
+	}
+
+	return d.Template.Validate()
+}
+
+// Owner is how the daemon set is marked in what applying a manifest
+// changed.
+func (d DaemonSet) Owner() string {
+	return "daemonset/" + d.Name
+}
+
+// NodeOwner is how the daemon set's task on the named node is marked.
+func (d DaemonSet) NodeOwner(node string) string {
+	return d.Owner() + "@" + node
+}
+
+// Validate checks the job, filling in the default completions and
+// parallelism and naming its template after it when the template has no
+// name of its own.
+func (j *Job) Validate() error {
+	err := validName(j.Name)
+	if err != nil {
+		return err
+	}
+
+	return j.validate()
+}
+
+// validate checks all of the job but its name, which for a workflow step's
+// job is made up rather than given.
+func (j *Job) validate() error {
+	if j.Completions < 0 || j.Parallelism < 0 || j.BackoffLimit < 0 {
+		return fmt.Errorf("invalid completions %d, parallelism %d or backoff limit %d", j.Completions, j.Parallelism, j.BackoffLimit)
+	}
+	if j.Completions == 0 {
+		j.Completions = 1
+	}
+	if j.Parallelism == 0 {
+		j.Parallelism = 1
+	}
+	if j.Template.Name == "" {
+		j.Template.Name = j.Name
+	}
+	// A failed task is replaced by the manager, which counts it against
+	// the backoff limit; a container restarting in place would not be.
+	if p := j.Template.RestartPolicy; p != "" && p != "no" {
+		return fmt.Errorf("restart policy %q is not allowed for a job", p)
+	}
+
+	return j.Template.Validate()
+}
+
+// Owner is how tasks built for the job are marked.
+func (j Job) Owner() string {
+	return "job/" + j.Name
+}
+
+// Validate checks the workflow's steps and that their dependencies exist
+// and have no cycle, naming each step's template after the workflow and
+// step when it has no name of its own.
+func (w *Workflow) Validate() error {
+	err := validName(w.Name)
+	if err != nil {
+		return err
+	}
+	if len(w.Steps) == 0 {
+		return errors.New("no steps given")
+	}
+
+	names := map[string]bool{}
+	for i := range w.Steps {
+		s := &w.Steps[i]
+		if s.Name == "" {
+			return fmt.Errorf("step %d has no name", i)
+		}
+		if err := validName(s.Name); err != nil {
+			return fmt.Errorf("step %d: %v", i, err)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("step %s is given more than once", s.Name)
+		}
+		names[s.Name] = true
+
+		if s.Template.Name == "" {
+			s.Template.Name = w.Name + "-" + s.Name
+		}
+		j := w.StepJob(*s)
+		err := j.validate()
+		if err != nil {
+			return fmt.Errorf("step %s: %v", s.Name, err)
+		}
+	}
+
+	for _, s := range w.Steps {
+		for _, d := range s.DependsOn {
+			if !names[d] {
+				return fmt.Errorf("step %s depends on unknown step %s", s.Name, d)
+			}
+		}
+	}
+	if len(w.Order()) != len(w.Steps) {
+		return errors.New("steps depend on each other in a cycle")
+	}
+
+	return nil
+}
+
+// Order returns the steps so that each comes after the steps it depends
+// on. Steps in a dependency cycle are left out.
+func (w Workflow) Order() []Step {
+	done := map[string]bool{}
+	var res []Step
+	for len(res) < len(w.Steps) {
+		added := false
+		for _, s := range w.Steps {
+			if done[s.Name] {
+				continue
+			}
+
+			ready := true
+			for _, d := range s.DependsOn {
+				ready = ready && done[d]
+			}
+			if ready {
+				done[s.Name] = true
+				res = append(res, s)
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+
+	return res
+}
+
+// StepJob returns the job that runs the step: a single task, retried up to
+// the step's retries. It is named under the workflow, as
+// "workflow/<name>/<step>", so it can't be taken for an applied job.
+func (w Workflow) StepJob(s Step) Job {
+	return Job{
+		Name:         w.Owner() + "/" + s.Name,
+		Completions:  1,
+		Parallelism:  1,
+		BackoffLimit: s.Retries,
+		Template:     s.Template,
+	}
+}
+
+// Owner is how the workflow is marked in what applying a manifest changed;
+// the tasks of its steps are marked as those of their jobs.
+func (w Workflow) Owner() string {
+	return "workflow/" + w.Name
+}
+
+// Validate checks the cron job's schedule, time zone and job, filling in
+// the defaults and naming the job after the cron job.
+func (c *CronJob) Validate() error {
+	err := validName(c.Name)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = c.Parse()
+	if err != nil {
+		return err
+	}
+
+	switch c.ConcurrencyPolicy {
+	case "":
+		c.ConcurrencyPolicy = AllowConcurrent
+	case AllowConcurrent, ForbidConcurrent, ReplaceConcurrent:
+	default:
+		return fmt.Errorf("invalid concurrency policy %q, want %s, %s or %s", c.ConcurrencyPolicy, AllowConcurrent, ForbidConcurrent, ReplaceConcurrent)
+	}
+
+	if c.StartingDeadline < 0 || c.SuccessfulJobsHistoryLimit < 0 || c.FailedJobsHistoryLimit < 0 {
+		return fmt.Errorf("invalid starting deadline %d or history limits %d and %d", c.StartingDeadline, c.SuccessfulJobsHistoryLimit, c.FailedJobsHistoryLimit)
+	}
+	if c.SuccessfulJobsHistoryLimit == 0 {
+		c.SuccessfulJobsHistoryLimit = 3
+	}
+	if c.FailedJobsHistoryLimit == 0 {
+		c.FailedJobsHistoryLimit = 1
+	}
+
+	c.Job.Name = c.Name
+	err = c.Job.Validate()
+	if err != nil {
+		return fmt.Errorf("job: %v", err)
+	}
+
+	return nil
+}
+
+// validName checks the name of a job, workflow, step or cron job. The jobs
+// workflows and cron jobs start are named under them, e.g.
+// "cronjob/backup/29012345", so no name given may contain a slash.
+func validName(name string) error {
+	if name == "" {
+		return errors.New("no name given")
+	}
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("name %q contains a /", name)
+	}
+
+	return nil
+}
+
+// Parse returns the cron job's schedule and the location it is read in.
+func (c CronJob) Parse() (*cron.Schedule, *time.Location, error) {
+	s, err := cron.Parse(c.Schedule)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid time zone %q: %v", c.TimeZone, err)
+	}
+
+	return s, loc, nil
+}
+
+// Owner is how jobs started by the cron job are marked.
+func (c CronJob) Owner() string {
+	return "cronjob/" + c.Name
+}
+
+func (s TaskSpec) Validate() error {
+	if s.Image == "" {
+		return errors.New("no image given")
+	}
+
+	for _, p := range s.ExposedPorts {
+		proto, port := nat.SplitProtoPort(p)
+		_, err := nat.NewPort(proto, port)
+		if err != nil {
+			return fmt.Errorf("invalid exposed port %q: %v", p, err)
+		}
+	}
+
+	names := map[string]bool{task.MainContainer: true}
+	for i, c := range slices.Concat(s.InitContainers, s.Sidecars) {
+		if c.Name == "" {
+			return fmt.Errorf("container %d has no name", i)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("container name %s is reserved or given more than once", c.Name)
+		}
+		names[c.Name] = true
+
+		if c.Image == "" {
+			return fmt.Errorf("container %s has no image", c.Name)
+		}
+	}
+
+	_, err := task.ParsePortBindings(s.Ports)
+	return err
+}
+
+// Hash identifies the spec's contents, so a task built from it can tell
+// whether the spec has changed since.
+func (s TaskSpec) Hash() string {
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// Owner is how the task built from a spec applied on its own is marked.
+func (s TaskSpec) Owner() string {
+	return "task/" + s.Name
+}
+
+// Task builds a new task from the spec for the given owner and revision.
+// The task is named after the spec and its ID, as tasks replacing one
+// another across updates, or replicas of one service, must not share a
+// container name.
+func (s TaskSpec) Task(owner string, revision int) task.Task {
+	t := task.Task{
+		ID:            uuid.New(),
+		State:         task.Scheduled,
+		Image:         s.Image,
+		PullPolicy:    s.PullPolicy,
+		Cmd:           s.Cmd,
+		Entrypoint:    s.Entrypoint,
+		Env:           s.Env,
+		WorkingDir:    s.WorkingDir,
+		User:          s.User,
+		CPU:           s.CPU,
+		Memory:        s.Memory,
+		Disk:          s.Disk,
+		PortBindings:  s.Ports,
+		Mounts:        s.Mounts,
+		RestartPolicy: s.RestartPolicy,
+		StopSignal:    s.StopSignal,
+		StopTimeout:   s.StopTimeout,
+		PreStopHook:   s.PreStopHook,
+		HealthCheck:   s.HealthCheck,
+		Owner:         owner,
+		SpecHash:      s.Hash(),
+		Revision:      revision,
+	}
+	t.Name = fmt.Sprintf("%s-%s", s.Name, t.ID.String()[:8])
+
+	for _, c := range s.InitContainers {
+		t.InitContainers = append(t.InitContainers, c.Container())
+	}
+	for _, c := range s.Sidecars {
+		t.Sidecars = append(t.Sidecars, c.Container())
+	}
+
+	if len(s.ExposedPorts) > 0 {
+		t.ExposedPorts = nat.PortSet{}
+		for _, p := range s.ExposedPorts {
+			proto, port := nat.SplitProtoPort(p)
+			np, _ := nat.NewPort(proto, port)
+			t.ExposedPorts[np] = struct{}{}
+		}
+	}
+
+	return t
+}
+
+func (c ContainerSpec) Container() task.ContainerSpec {
+	return task.ContainerSpec{
+		Name:       c.Name,
+		Image:      c.Image,
+		PullPolicy: c.PullPolicy,
+		Cmd:        c.Cmd,
+		Entrypoint: c.Entrypoint,
+		Env:        c.Env,
+		WorkingDir: c.WorkingDir,
+		User:       c.User,
+		CPU:        c.CPU,
+		Memory:     c.Memory,
+		Mounts:     c.Mounts,
+	}
+}
@@ -9,6 +9,9 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 type Node struct {
@@ -23,16 +26,92 @@ type Node struct {
 	Stats           stats.Stats
 	Role            string
 	TaskCount       int
+	HostPorts       map[string]uuid.UUID
+
+	// Labels describe the node, such as its zone or hardware, for daemon
+	// sets to select nodes by.
+	Labels map[string]string
+
+	// Status is NodeReady while the node has been heard from, by a
+	// heartbeat or a task sync, within the manager's node timeout, and
+	// NodeNotReady once it hasn't. LastHeartbeat is when it last was.
+	Status        string
+	LastHeartbeat time.Time
+}
+
+const (
+	NodeReady    = "Ready"
+	NodeNotReady = "NotReady"
+)
+
+// Heartbeat is what a worker sends the manager to register and then
+// periodically to stay Ready: the address the manager reaches it at, its
+// capacity and its latest stats.
+type Heartbeat struct {
+	Address string
+	Cores   uint
+	Memory  uint64
+	Disk    int64
+	Stats   stats.Stats
 }
 
 func NewNode(name string, api string, role string) *Node {
 	return &Node{
-		Name: name,
-		Api:  api,
-		Role: role,
+		Name:      name,
+		Api:       api,
+		Role:      role,
+		HostPorts: make(map[string]uuid.UUID),
+		Status:    NodeReady,
 	}
 }
 
+// Ready reports whether tasks may be placed on the node.
+func (n *Node) Ready() bool {
+	return n.Status != NodeNotReady
+}
+
+// PortsAvailable reports whether none of the given "port/proto" host ports
+// are already held by a task on the node.
+func (n *Node) PortsAvailable(ports []string) bool {
+	for _, p := range ports {
+		if _, ok := n.HostPorts[p]; ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (n *Node) AllocatePorts(taskID uuid.UUID, ports []string) {
+	if n.HostPorts == nil {
+		n.HostPorts = make(map[string]uuid.UUID)
+	}
+
+	for _, p := range ports {
+		n.HostPorts[p] = taskID
+	}
+}
+
+func (n *Node) ReleasePorts(taskID uuid.UUID) {
+	for p, id := range n.HostPorts {
+		if id == taskID {
+			delete(n.HostPorts, p)
+		}
+	}
+}
+
+// Matches reports whether the node carries every label of the selector. An
+// empty selector matches every node.
+func (n *Node) Matches(selector map[string]string) bool {
+	for k, v := range selector {
+		if l, ok := n.Labels[k]; !ok || l != v {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (n *Node) GetStats() (*stats.Stats, error) {
 	var resp *http.Response
 	var err error
@@ -22,8 +22,15 @@ type Epvm struct {
 	Name string
 }
 
-func (r *RoundRobin) SelectCandidateNodes(task task.Task, nodes []*node.Node) []*node.Node {
-	return nodes
+func (r *RoundRobin) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
+	var candidates []*node.Node
+	for _, n := range nodes {
+		if n.Ready() && checkNode(t, n) && checkHostPorts(t, n) && checkVolumeDisk(t, n) {
+			candidates = append(candidates, n)
+		}
+	}
+
+	return candidates
 }
 
 func (r *RoundRobin) Score(t task.Task, nodes []*node.Node) map[string]float64 {
@@ -91,7 +98,7 @@ func (e *Epvm) Pick(scores map[string]float64, candidates []*node.Node) *node.No
 func (e *Epvm) SelectCandidateNodes(t task.Task, nodes []*node.Node) []*node.Node {
 	var candidates []*node.Node
 	for node := range nodes {
-		if checkDisk(t, nodes[node].Disk-nodes[node].DiskAllocated) {
+		if nodes[node].Ready() && checkNode(t, nodes[node]) && checkDisk(t, nodes[node].Disk-nodes[node].DiskAllocated) && checkHostPorts(t, nodes[node]) {
 			candidates = append(candidates, nodes[node])
 		}
 	}
@@ -114,7 +121,7 @@ func (e *Epvm) Score(t task.Task, nodes []*node.Node) map[string]float64 {
 		memoryAllocated := float64(node.Stats.MemUsedKb()) + float64(node.MemoryAllocated)
 		memoryPercentAllocated := memoryAllocated / float64(node.Memory)
 
-		newMemPercent := (calculateLoad(memoryAllocated+float64(t.Memory/1000), float64(node.Memory)))
+		newMemPercent := (calculateLoad(memoryAllocated+float64(t.TotalMemory()/1000), float64(node.Memory)))
 		memCost := math.Pow(LIEB, newMemPercent) + math.Pow(LIEB, float64(node.TaskCount+1)/maxJobs) - math.Pow(LIEB, memoryPercentAllocated) - math.Pow(LIEB, float64(node.TaskCount)/float64(maxJobs))
 		cpuCost := math.Pow(LIEB, cpuLoad) + math.Pow(LIEB, float64(node.TaskCount+1)/float64(maxJobs)) - math.Pow(LIEB, cpuLoad) - math.Pow(LIEB, float64(node.TaskCount)/float64(maxJobs))
 
@@ -128,6 +135,26 @@ func checkDisk(t task.Task, diskRemaining int64) bool {
 	return diskRemaining >= t.Disk
 }
 
+// checkVolumeDisk only holds tasks with volumes to their disk request, and
+// only on nodes whose disk capacity has been reported.
+func checkVolumeDisk(t task.Task, n *node.Node) bool {
+	if len(t.Volumes()) == 0 || n.Disk == 0 {
+		return true
+	}
+
+	return checkDisk(t, n.Disk-n.DiskAllocated)
+}
+
+// checkNode keeps a task pinned to a node off every other.
+func checkNode(t task.Task, n *node.Node) bool {
+	return t.Node == "" || t.Node == n.Name
+}
+
+func checkHostPorts(t task.Task, n *node.Node) bool {
+	ports, err := t.RequiredHostPorts()
+	return err == nil && n.PortsAvailable(ports)
+}
+
 func calculateLoad(usage float64, capacity float64) float64 {
 	return usage / capacity
 }
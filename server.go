@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"cube/manager"
+	"cube/store"
+	"cube/task"
+	"cube/worker"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func cmdManager(args []string) error {
+	var (
+		host, workers, schedulerType, storePath string
+		port, concurrency                       int
+		retry, sync, health, jobBackoff         time.Duration
+		nodeTimeout                             time.Duration
+	)
+
+	f := newFlags("manager", "manager")
+	f.stringVar(&host, "host", "CUBE_MANAGER_HOST", "", "address to listen on")
+	f.intVar(&port, "port", "CUBE_MANAGER_PORT", 5555, "port to listen on")
+	f.stringVar(&workers, "workers", "CUBE_WORKERS", "", "comma separated host:port of each worker, besides those that register")
+	f.stringVar(&schedulerType, "scheduler", "CUBE_SCHEDULER", "roundrobin", "scheduler, roundrobin or epvm")
+	f.stringVar(&storePath, "store", "CUBE_MANAGER_STORE", "", "file to keep state in, in memory only when empty")
+	f.intVar(&concurrency, "concurrency", "CUBE_MANAGER_CONCURRENCY", manager.DefaultConcurrency, "events dispatched to workers at once")
+	f.durationVar(&retry, "retry-interval", "CUBE_MANAGER_RETRY_INTERVAL", manager.DefaultRetryInterval, "how often undeliverable events are retried")
+	f.durationVar(&sync, "sync-interval", "CUBE_MANAGER_SYNC_INTERVAL", manager.DefaultSyncInterval, "how often task state is fetched from the workers")
+	f.durationVar(&health, "health-check-interval", "CUBE_HEALTH_CHECK_INTERVAL", manager.DefaultHealthCheckInterval, "how often tasks are health checked")
+	f.durationVar(&jobBackoff, "job-backoff", "CUBE_MANAGER_JOB_BACKOFF", manager.DefaultJobBackoff, "how long a job waits before replacing its first failed task")
+	f.durationVar(&nodeTimeout, "node-timeout", "CUBE_MANAGER_NODE_TIMEOUT", manager.DefaultNodeTimeout, "how long a worker may go unheard from before it is NotReady")
+	err := f.parse(args)
+	if err != nil {
+		return err
+	}
+
+	s, err := newStore(storePath)
+	if err != nil {
+		return err
+	}
+
+	m, err := manager.New(splitList(workers), schedulerType, s)
+	if err != nil {
+		return fmt.Errorf("unable to start manager: %v", err)
+	}
+	m.Concurrency = concurrency
+	m.RetryInterval = retry
+	m.SyncInterval = sync
+	m.HealthCheckInterval = health
+	m.JobBackoff = jobBackoff
+	m.NodeTimeout = nodeTimeout
+
+	g := newGroup()
+	defer g.stop()
+
+	log.Println("Starting Cube manager")
+	api := manager.Api{Address: host, Port: port, Manager: m}
+	g.serve("manager API", api.Start)
+	g.run(m.ProcessTasks)
+	g.run(m.UpdateTasks)
+	g.run(m.DoHealthChecks)
+
+	g.wait()
+
+	return m.Shutdown()
+}
+
+func cmdWorker(args []string) error {
+	var (
+		name, host, runtime, storePath, policy, credentials string
+		managerAddr, advertise                              string
+		port, concurrency                                   int
+		retention, sync, shutdownTimeout, pullTimeout       time.Duration
+		heartbeat                                           time.Duration
+	)
+
+	hostname, _ := os.Hostname()
+
+	f := newFlags("worker", "worker")
+	f.stringVar(&name, "name", "CUBE_WORKER_NAME", hostname, "name of the worker")
+	f.stringVar(&host, "host", "CUBE_WORKER_HOST", "", "address to listen on")
+	f.intVar(&port, "port", "CUBE_WORKER_PORT", 5556, "port to listen on")
+	f.stringVar(&runtime, "runtime", "CUBE_WORKER_RUNTIME", "docker", "runtime to run tasks with, docker, process or fake")
+	f.stringVar(&storePath, "store", "CUBE_WORKER_STORE", "", "file to keep tasks in, in memory only when empty")
+	f.intVar(&concurrency, "concurrency", "CUBE_WORKER_CONCURRENCY", worker.DefaultConcurrency, "tasks started or stopped at once")
+	f.durationVar(&retention, "retention", "CUBE_WORKER_RETENTION", worker.DefaultRetention, "how long stopped containers are kept")
+	f.durationVar(&sync, "sync-interval", "CUBE_WORKER_SYNC_INTERVAL", worker.DefaultSyncInterval, "how often task state is refreshed from the runtime")
+	f.stringVar(&policy, "shutdown-policy", "CUBE_WORKER_SHUTDOWN_POLICY", worker.ShutdownLeaveTasks, "what to do with running tasks on shutdown, leave or stop")
+	f.durationVar(&shutdownTimeout, "shutdown-timeout", "CUBE_SHUTDOWN_TIMEOUT", time.Minute, "how long stopping tasks on shutdown may take")
+	f.stringVar(&credentials, "registry-credentials", "CUBE_REGISTRY_CREDENTIALS", "", "config.json style file of registry credentials")
+	f.durationVar(&pullTimeout, "pull-timeout", "CUBE_PULL_TIMEOUT", 5*time.Minute, "how long an image pull may take")
+	f.stringVar(&managerAddr, "manager", "CUBE_WORKER_MANAGER", "", "host:port of a manager to register with")
+	f.stringVar(&advertise, "advertise", "CUBE_WORKER_ADVERTISE", "", "host:port the manager reaches the worker at, the host name and port by default")
+	f.durationVar(&heartbeat, "heartbeat-interval", "CUBE_WORKER_HEARTBEAT_INTERVAL", worker.DefaultHeartbeatInterval, "how often a heartbeat is sent to the manager")
+	err := f.parse(args)
+	if err != nil {
+		return err
+	}
+
+	if advertise == "" {
+		h := host
+		if h == "" || h == "0.0.0.0" {
+			h = hostname
+		}
+		advertise = net.JoinHostPort(h, strconv.Itoa(port))
+	}
+
+	switch policy {
+	case worker.ShutdownLeaveTasks, worker.ShutdownStopTasks:
+	default:
+		return fmt.Errorf("invalid shutdown policy %q, want %q or %q", policy, worker.ShutdownLeaveTasks, worker.ShutdownStopTasks)
+	}
+
+	rt, err := newRuntime(runtime, credentials, pullTimeout)
+	if err != nil {
+		return err
+	}
+
+	s, err := newStore(storePath)
+	if err != nil {
+		return err
+	}
+
+	g := newGroup()
+	defer g.stop()
+
+	w, err := worker.New(g.ctx, name, rt, s)
+	if err != nil {
+		return fmt.Errorf("unable to start worker %s: %v", name, err)
+	}
+	w.Concurrency = concurrency
+	w.Retention = retention
+	w.SyncInterval = sync
+	w.ShutdownPolicy = policy
+	w.Manager = managerAddr
+	w.Address = advertise
+	w.HeartbeatInterval = heartbeat
+
+	log.Printf("Starting Cube worker %s\n", name)
+	api := worker.Api{Address: host, Port: port, Worker: w}
+	g.serve("worker API", api.Start)
+	g.run(w.RunTasks)
+	g.run(w.CollectStats)
+	g.run(w.UpdateTasks)
+	g.run(w.SendHeartbeats)
+
+	g.wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return w.Shutdown(ctx)
+}
+
+// group runs a command's API server and loops until SIGINT or SIGTERM, or
+// until the server fails.
+type group struct {
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+func newGroup() *group {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return &group{ctx: ctx, stop: stop}
+}
+
+func (g *group) run(f func(context.Context)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		f(g.ctx)
+	}()
+}
+
+func (g *group) serve(name string, start func(context.Context) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		err := start(g.ctx)
+		if err != nil {
+			log.Printf("%s stopped: %v\n", name, err)
+			g.stop()
+		}
+	}()
+}
+
+// wait blocks until the group is told to stop and then until the server
+// has drained its requests and the loops have returned.
+func (g *group) wait() {
+	<-g.ctx.Done()
+	log.Println("Shutting down, draining requests and stopping loops")
+	g.wg.Wait()
+}
+
+func newRuntime(kind string, credentials string, pullTimeout time.Duration) (task.Runtime, error) {
+	rt, err := task.NewRuntime(kind)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %q runtime: %v", kind, err)
+	}
+
+	if d, ok := rt.(*task.Docker); ok {
+		if credentials != "" {
+			d.Credentials, err = task.LoadCredentials(credentials)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load registry credentials: %v", err)
+			}
+		}
+		d.PullTimeout = pullTimeout
+	}
+
+	return rt, nil
+}
+
+// newStore opens a state file, or keeps state in memory when no path is
+// given.
+func newStore(path string) (store.Store, error) {
+	if path == "" {
+		return store.NewMemory(), nil
+	}
+
+	s, err := store.NewFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open store %s: %v", path, err)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,226 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const compactThreshold = 1000
+
+type record struct {
+	Op     string          `json:"op"`
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// File is an append-only log of every change, replayed into memory when
+// opened. Each write is synced to disk before it returns, so a change a
+// write returned for survives a crash; one the crash interrupted is cut off
+// the end of the log when it is next opened. Once the log holds far more
+// records than live keys it is compacted by rewriting a snapshot of the
+// current state and atomically renaming it over the log.
+type File struct {
+	*Memory
+
+	path    string
+	mu      sync.Mutex
+	f       *os.File
+	records int
+}
+
+func NewFile(path string) (*File, error) {
+	s := &File{
+		Memory: NewMemory(),
+		path:   path,
+	}
+
+	end, err := s.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	s.f, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// What follows the last whole record is dropped, lest the next record
+	// be appended to it.
+	if fi, err := s.f.Stat(); err == nil && fi.Size() > end {
+		log.Printf("[Store] Truncating %s from %d to %d bytes\n", path, fi.Size(), end)
+		err = s.f.Truncate(end)
+		if err == nil {
+			err = s.f.Sync()
+		}
+		if err != nil {
+			s.f.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *File) Put(bucket string, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.append(record{Op: "put", Bucket: bucket, Key: key, Value: data})
+	if err != nil {
+		return err
+	}
+	s.Memory.put(bucket, key, data)
+
+	return s.maybeCompact()
+}
+
+func (s *File) Delete(bucket string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.append(record{Op: "delete", Bucket: bucket, Key: key})
+	if err != nil {
+		return err
+	}
+	s.Memory.Delete(bucket, key)
+
+	return s.maybeCompact()
+}
+
+func (s *File) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
+
+// replay loads the log into memory, returning the offset just past its last
+// whole record. Only the last record can be torn, by a crash mid-write, as
+// the log is truncated to that offset before anything is appended.
+func (s *File) replay() (int64, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var end int64
+	line := 0
+	for {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(data) > 0 {
+				log.Printf("[Store] Ignoring torn record at %s:%d\n", s.path, line+1)
+			}
+			return end, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		line++
+		end += int64(len(data))
+
+		var rec record
+		err = json.Unmarshal(data, &rec)
+		if err != nil {
+			log.Printf("[Store] Ignoring unreadable record at %s:%d: %v\n", s.path, line, err)
+			continue
+		}
+
+		switch rec.Op {
+		case "put":
+			s.Memory.put(rec.Bucket, rec.Key, rec.Value)
+		case "delete":
+			s.Memory.Delete(rec.Bucket, rec.Key)
+		default:
+			return 0, fmt.Errorf("unknown operation %q at %s:%d", rec.Op, s.path, line)
+		}
+		s.records++
+	}
+}
+
+func (s *File) append(r record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.f.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	s.records++
+
+	return s.f.Sync()
+}
+
+func (s *File) maybeCompact() error {
+	live := s.Memory.len()
+	if s.records < compactThreshold || s.records < 2*live {
+		return nil
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	records := 0
+
+	s.Memory.mu.RLock()
+	for bucket, b := range s.Memory.buckets {
+		for key, value := range b {
+			data, _ := json.Marshal(record{Op: "put", Bucket: bucket, Key: key, Value: value})
+			w.Write(append(data, '\n'))
+			records++
+		}
+	}
+	s.Memory.mu.RUnlock()
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	s.f.Close()
+	s.f, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.records = records
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type op struct {
+	del   bool
+	key   string
+	value string
+}
+
+func put(key, value string) op { return op{key: key, value: value} }
+func del(key string) op        { return op{del: true, key: key} }
+
+// apply runs the operations against the store, all in one bucket.
+func apply(t *testing.T, s *File, ops []op) {
+	t.Helper()
+
+	for _, o := range ops {
+		var err error
+		if o.del {
+			err = s.Delete("things", o.key)
+		} else {
+			err = s.Put("things", o.key, o.value)
+		}
+		if err != nil {
+			t.Fatalf("applying %+v: %v", o, err)
+		}
+	}
+}
+
+// contents decodes the bucket the operations went to.
+func contents(t *testing.T, s Store) map[string]string {
+	t.Helper()
+
+	values, err := s.List("things")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := map[string]string{}
+	for k := range values {
+		var v string
+		err := s.Get("things", k, &v)
+		if err != nil {
+			t.Fatalf("getting %s: %v", k, err)
+		}
+		res[k] = v
+	}
+
+	return res
+}
+
+func open(t *testing.T, path string) *File {
+	t.Helper()
+
+	s, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func TestFileReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []op
+		want map[string]string
+	}{
+		{"empty", nil, map[string]string{}},
+		{"puts", []op{put("a", "1"), put("b", "2")}, map[string]string{"a": "1", "b": "2"}},
+		{"overwrite", []op{put("a", "1"), put("a", "2")}, map[string]string{"a": "2"}},
+		{"delete", []op{put("a", "1"), put("b", "2"), del("a")}, map[string]string{"b": "2"}},
+		{"put after delete", []op{put("a", "1"), del("a"), put("a", "3")}, map[string]string{"a": "3"}},
+		{"delete of a missing key", []op{del("a"), put("b", "2")}, map[string]string{"b": "2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state")
+			s := open(t, path)
+			apply(t, s, tt.ops)
+			if got := contents(t, s); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("store holds %v, want %v", got, tt.want)
+			}
+			s.Close()
+
+			if got := contents(t, open(t, path)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("reopened store holds %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileRecoversFromTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string
+	}{
+		{"half a record", `{"op":"put","bucket":"things","key":"c","val`},
+		{"a whole record without its newline", `{"op":"put","bucket":"things","key":"c","value":"3"}`},
+		{"a single byte", `{`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state")
+			s := open(t, path)
+			apply(t, s, []op{put("a", "1"), put("b", "2")})
+			s.Close()
+
+			good, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(path, append(bytes.Clone(good), tt.tail...), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The torn record is dropped, and cut off the log so what is
+			// written next isn't lost with it.
+			s = open(t, path)
+			want := map[string]string{"a": "1", "b": "2"}
+			if got := contents(t, s); !reflect.DeepEqual(got, want) {
+				t.Fatalf("store holds %v, want %v", got, want)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, good) {
+				t.Fatalf("log is %q, want it cut back to %q", data, good)
+			}
+
+			apply(t, s, []op{put("d", "4")})
+			s.Close()
+
+			want["d"] = "4"
+			if got := contents(t, open(t, path)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("reopened store holds %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFileRejectsUnknownOperations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	err := os.WriteFile(path, []byte(`{"op":"frob","bucket":"things","key":"a"}`+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFile(path); err == nil {
+		t.Fatal("opening a log with an unknown operation succeeded")
+	}
+}
+
+func TestFileCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	s := open(t, path)
+
+	var ops []op
+	for i := range compactThreshold + 10 {
+		ops = append(ops, put(fmt.Sprint(i%5), fmt.Sprint(i)))
+	}
+	ops = append(ops, del("4"))
+	apply(t, s, ops)
+
+	// The log is rewritten down to the live keys once it is big enough,
+	// and carries on being appended to after.
+	if s.records > 20 {
+		t.Fatalf("log holds %d records, want it compacted", s.records)
+	}
+	want := map[string]string{"0": "1005", "1": "1006", "2": "1007", "3": "1008"}
+	if got := contents(t, s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("store holds %v, want %v", got, want)
+	}
+	s.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("\n")); n > 20 {
+		t.Fatalf("log file has %d lines, want it compacted", n)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("compaction left its snapshot behind: %v", err)
+	}
+
+	if got := contents(t, open(t, path)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("reopened store holds %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Memory keeps everything in maps, so state lives only as long as the
+// process.
+type Memory struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+func (m *Memory) Put(bucket string, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	m.put(bucket, key, data)
+	return nil
+}
+
+func (m *Memory) Get(bucket string, key string, value any) error {
+	m.mu.RLock()
+	data, ok := m.buckets[bucket][key]
+	m.mu.RUnlock()
+
+	if !ok {
+		return ErrNotFound
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+func (m *Memory) Delete(bucket string, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *Memory) List(bucket string) (map[string][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := make(map[string][]byte, len(m.buckets[bucket]))
+	for k, v := range m.buckets[bucket] {
+		res[k] = v
+	}
+
+	return res, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) put(bucket string, key string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[bucket] = b
+	}
+	b[key] = data
+}
+
+func (m *Memory) len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	n := 0
+	for _, b := range m.buckets {
+		n += len(b)
+	}
+
+	return n
+}
@@ -0,0 +1,18 @@
+package store
+
+import (
+	"errors"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Store is a durable home for cluster state. Values are JSON encoded and
+// grouped into buckets, one per kind of object, each keyed by ID.
+type Store interface {
+	Put(bucket string, key string, value any) error
+	Get(bucket string, key string, value any) error
+	Delete(bucket string, key string) error
+	// List returns every JSON encoded value in the bucket by key.
+	List(bucket string) (map[string][]byte, error)
+	Close() error
+}
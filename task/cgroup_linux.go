@@ -0,0 +1,21 @@
+package task
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// startInCgroup starts cmd inside the cgroup at path, rather than moving it
+// there once it runs. It needs Linux 5.7 or later.
+func startInCgroup(cmd *exec.Cmd, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(f.Fd())}
+
+	return cmd.Start()
+}
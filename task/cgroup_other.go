@@ -0,0 +1,13 @@
+//go:build !linux
+
+package task
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// startInCgroup fails, cgroups being Linux only.
+func startInCgroup(cmd *exec.Cmd, path string) error {
+	return errors.New("cgroups are only supported on Linux")
+}
@@ -0,0 +1,417 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+)
+
+type Docker struct {
+	Client      *client.Client
+	Credentials Credentials
+	PullTimeout time.Duration
+}
+
+func (d *Docker) Run(ctx context.Context, config Config) Result {
+	err := d.ensureImage(ctx, config)
+	if err != nil {
+		return Result{Error: err}
+	}
+
+	rp := container.RestartPolicy{
+		Name: container.RestartPolicyMode(config.RestartPolicy),
+	}
+
+	r := container.Resources{
+		NanoCPUs: int64(config.CPU * math.Pow(10, 9)),
+		Memory:   config.Memory,
+	}
+
+	pm, err := ParsePortBindings(config.PortBindings)
+	if err != nil {
+		log.Printf("Invalid port bindings for container %s: %v\n", config.Name, err)
+		return Result{Error: err}
+	}
+
+	exposed := nat.PortSet{}
+	for p := range config.ExposedPorts {
+		exposed[p] = struct{}{}
+	}
+	for p := range pm {
+		exposed[p] = struct{}{}
+	}
+
+	cc := container.Config{
+		Cmd:          config.Cmd,
+		Entrypoint:   config.Entrypoint,
+		Env:          config.Env,
+		WorkingDir:   config.WorkingDir,
+		User:         config.User,
+		Image:        config.Image,
+		ExposedPorts: exposed,
+		StopSignal:   config.StopSignal,
+		Labels:       config.Labels,
+		Tty:          false,
+	}
+	if config.StopTimeout > 0 {
+		cc.StopTimeout = &config.StopTimeout
+	}
+
+	mounts, err := dockerMounts(config.Mounts)
+	if err != nil {
+		log.Printf("Invalid mounts for container %s: %v\n", config.Name, err)
+		return Result{Error: err}
+	}
+
+	// Exposed ports are published on random host ports only when none are
+	// bound explicitly, which would otherwise publish every other one too.
+	hc := container.HostConfig{
+		Mounts:          mounts,
+		PortBindings:    pm,
+		PublishAllPorts: len(pm) == 0,
+		RestartPolicy:   rp,
+		Resources:       r,
+	}
+	if config.NetworkMode != "" {
+		// Containers sharing another's network can't publish ports of
+		// their own; the one owning the network publishes them.
+		hc.NetworkMode = container.NetworkMode(config.NetworkMode)
+		hc.PortBindings = nil
+		hc.PublishAllPorts = false
+	}
+
+	containerExists, res, err := checkContainerExists(ctx, d.Client, config.Name)
+	if err != nil {
+		log.Printf("Error checking if container existed with name %s\n", config.Name)
+		return Result{Error: err}
+	}
+
+	if containerExists {
+		// A container left by an earlier start of the same task is
+		// started again; one left by another task of the same name, with
+		// that task's image and settings, makes way for this one.
+		if res.Labels[LabelTaskID] == config.Labels[LabelTaskID] {
+			opts := container.StopOptions{Signal: config.StopSignal}
+			if config.StopTimeout > 0 {
+				opts.Timeout = &config.StopTimeout
+			}
+			err := d.Client.ContainerRestart(ctx, res.ID, opts)
+			if err != nil {
+				log.Printf("Error restarting container with ID %v and name %s\n", res.ID, config.Name)
+				return Result{Error: err}
+			}
+			log.Printf("Restarted container with ID %v\n", res.ID)
+
+			return Result{ContainerId: res.ID, Action: "restart", Result: "success"}
+		}
+
+		if res.State == container.StateRunning {
+			return Result{Error: fmt.Errorf("container name %s is in use by task %s", config.Name, res.Labels[LabelTaskID])}
+		}
+		log.Printf("Removing container %v of task %s to reuse its name\n", res.ID, res.Labels[LabelTaskID])
+		err := d.Client.ContainerRemove(ctx, res.ID, container.RemoveOptions{})
+		if err != nil {
+			log.Printf("Error removing container with ID %v: %v\n", res.ID, err)
+			return Result{Error: err}
+		}
+	}
+
+	cres, err := d.Client.ContainerCreate(ctx, &cc, &hc, nil, nil, config.Name)
+	if err != nil {
+		log.Printf("Failed to create container with Image %s: %v\n", config.Image, err)
+		return Result{Error: err}
+	}
+
+	err = d.Client.ContainerStart(ctx, cres.ID, container.StartOptions{})
+	if err != nil {
+		log.Printf("Failed to start container with Image %s: %v\n", config.Image, err)
+		return Result{Error: err}
+	}
+
+	return Result{ContainerId: cres.ID, Action: "start", Result: "success"}
+}
+
+func (d *Docker) Stop(ctx context.Context, id string, opts StopOptions) Result {
+	log.Printf("Attempting to stop container: %s\n", id)
+
+	// Docker takes whole seconds; round up so a task is never given less
+	// time than it asked for.
+	timeout := int(math.Ceil(opts.Timeout.Seconds()))
+	err := d.Client.ContainerStop(ctx, id, container.StopOptions{
+		Signal:  opts.Signal,
+		Timeout: &timeout,
+	})
+
+	if err != nil {
+		log.Printf("Failed to stop the container %s: %v\n", id, err)
+		return Result{Error: err}
+	}
+
+	return Result{Error: nil, Action: "stop", ContainerId: id, Result: "success"}
+}
+
+func (d *Docker) Remove(ctx context.Context, id string) error {
+	err := d.Client.ContainerRemove(ctx, id, container.RemoveOptions{})
+
+	if err != nil {
+		log.Printf("Failed to remove the container %s: %v\n", id, err)
+	}
+
+	return err
+}
+
+func (d *Docker) Inspect(ctx context.Context, containerID string) (*Status, error) {
+	res, err := d.Client.ContainerInspect(ctx, containerID)
+	if err != nil {
+		log.Printf("Error inspecting container: %v\n", err)
+		return nil, err
+	}
+
+	return dockerStatus(res), nil
+}
+
+// dockerStatus turns Docker's inspect response into a Status. Docker
+// reports its timestamps as RFC 3339 strings, the zero time for those not
+// yet reached.
+func dockerStatus(res container.InspectResponse) *Status {
+	s := &Status{}
+	if res.ContainerJSONBase != nil {
+		s.ID = res.ID
+		s.Name = strings.TrimPrefix(res.Name, "/")
+		s.Image = res.Image
+		if res.State != nil {
+			s.State = string(res.State.Status)
+			s.ExitCode = res.State.ExitCode
+			s.Pid = res.State.Pid
+			s.StartedAt, _ = time.Parse(time.RFC3339Nano, res.State.StartedAt)
+			s.FinishedAt, _ = time.Parse(time.RFC3339Nano, res.State.FinishedAt)
+		}
+	}
+	if res.Config != nil {
+		s.Image = res.Config.Image
+	}
+	if res.NetworkSettings != nil {
+		s.Ports = res.NetworkSettings.Ports
+	}
+
+	return s
+}
+
+func (d *Docker) Logs(ctx context.Context, containerID string, opts LogOptions, stdout io.Writer, stderr io.Writer) error {
+	out, err := d.Client.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     opts.Follow,
+		Tail:       opts.Tail,
+		Since:      opts.Since,
+		Timestamps: opts.Timestamps,
+	})
+	if err != nil {
+		log.Printf("Error getting logs for the container %s: %v\n", containerID, err)
+		return err
+	}
+	defer out.Close()
+
+	_, err = stdcopy.StdCopy(stdout, stderr, out)
+	return err
+}
+
+func (d *Docker) Stats(ctx context.Context, containerID string) (*ContainerStats, error) {
+	res, err := d.Client.ContainerStats(ctx, containerID, false)
+	if err != nil {
+		log.Printf("Error getting stats for the container %s: %v\n", containerID, err)
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var s container.StatsResponse
+	err = json.NewDecoder(res.Body).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+
+	var cpuPercent float64
+	if cpuDelta > 0 && systemDelta > 0 {
+		cpuPercent = (cpuDelta / systemDelta) * float64(s.CPUStats.OnlineCPUs)
+	}
+
+	return &ContainerStats{
+		CpuPercent:  cpuPercent,
+		MemoryUsage: s.MemoryStats.Usage,
+		MemoryLimit: s.MemoryStats.Limit,
+	}, nil
+}
+
+func (d *Docker) Exec(ctx context.Context, containerID string, opts ExecOptions, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	exec, err := d.Client.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:          opts.Cmd,
+		Env:          opts.Env,
+		WorkingDir:   opts.WorkingDir,
+		User:         opts.User,
+		Tty:          opts.Tty,
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		log.Printf("Error creating exec in container %s: %v\n", containerID, err)
+		return 0, err
+	}
+
+	hj, err := d.Client.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{Tty: opts.Tty})
+	if err != nil {
+		log.Printf("Error attaching to exec %s in container %s: %v\n", exec.ID, containerID, err)
+		return 0, err
+	}
+	defer hj.Close()
+
+	if stdin != nil {
+		go func() {
+			io.Copy(hj.Conn, stdin)
+			hj.CloseWrite()
+		}()
+	}
+
+	if opts.Tty {
+		_, err = io.Copy(stdout, hj.Reader)
+	} else {
+		_, err = stdcopy.StdCopy(stdout, stderr, hj.Reader)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := d.Client.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.ExitCode, nil
+}
+
+func (d *Docker) List(ctx context.Context) ([]Container, error) {
+	containers, err := d.Client.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", LabelTaskID)),
+	})
+	if err != nil {
+		log.Printf("Error listing containers: %v\n", err)
+		return nil, err
+	}
+
+	res := []Container{}
+	for _, c := range containers {
+		var name string
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+
+		res = append(res, Container{
+			ID:     c.ID,
+			Name:   name,
+			Image:  c.Image,
+			Status: string(c.State),
+			Labels: c.Labels,
+		})
+	}
+
+	return res, nil
+}
+
+func (d *Docker) CreateVolume(ctx context.Context, name string) error {
+	_, err := d.Client.VolumeCreate(ctx, volume.CreateOptions{
+		Name:   name,
+		Labels: map[string]string{"cube.managed": "true"},
+	})
+	if err != nil {
+		log.Printf("Error creating volume %s: %v\n", name, err)
+	}
+
+	return err
+}
+
+func (d *Docker) RemoveVolume(ctx context.Context, name string) error {
+	err := d.Client.VolumeRemove(ctx, name, false)
+	if err != nil {
+		log.Printf("Error removing volume %s: %v\n", name, err)
+	}
+
+	return err
+}
+
+func NewDocker() (*Docker, error) {
+	newC, err := client.NewClientWithOpts(client.FromEnv)
+
+	if err != nil {
+		log.Printf("Error creating a new Docker struct: %v\n", err)
+		return nil, err
+	}
+
+	return &Docker{
+		Client:      newC,
+		PullTimeout: 5 * time.Minute,
+	}, nil
+}
+
+func dockerMounts(mounts []Mount) ([]mount.Mount, error) {
+	var res []mount.Mount
+
+	for _, m := range mounts {
+		dm := mount.Mount{
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		}
+
+		switch m.Type {
+		case MountVolume:
+			dm.Type = mount.TypeVolume
+		case MountBind:
+			dm.Type = mount.TypeBind
+		case MountTmpfs:
+			dm.Type = mount.TypeTmpfs
+			dm.Source = ""
+			dm.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: m.Size}
+		default:
+			return nil, fmt.Errorf("unknown mount type %q for %s", m.Type, m.Target)
+		}
+
+		res = append(res, dm)
+	}
+
+	return res, nil
+}
+
+func checkContainerExists(ctx context.Context, cli *client.Client, containerName string) (bool, container.Summary, error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+
+	if err != nil {
+		return false, container.Summary{}, err
+	}
+
+	for _, c := range containers {
+		for _, name := range c.Names {
+			if name == "/"+containerName || name == containerName {
+				return true, c, nil
+			}
+		}
+	}
+
+	return false, container.Summary{}, err
+}
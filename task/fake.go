@@ -0,0 +1,466 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// FakeBehavior scripts how the Fake runtime treats containers created from
+// a given image.
+type FakeBehavior struct {
+	PullDelay  time.Duration
+	PullError  error
+	StartError error
+	// ExitAfter makes the container exit with ExitCode once it has been
+	// running for the given duration. Zero means it runs until stopped.
+	ExitAfter time.Duration
+	ExitCode  int
+	Unhealthy bool
+	Stdout    string
+	Stderr    string
+	// Exec handles commands run in the container and returns their exit
+	// code. By default the command line is echoed back and exits 0.
+	Exec func(opts ExecOptions, stdin io.Reader, stdout io.Writer, stderr io.Writer) int
+}
+
+type FakeContainer struct {
+	ID         string
+	Name       string
+	Config     Config
+	Status     string
+	ExitCode   int
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Ports      nat.PortMap
+	Healthy    bool
+	Starts     int
+	// StopOptions records how the container was last asked to stop.
+	StopOptions StopOptions
+	// Requests lists the paths of every HTTP request the container served.
+	Requests []string
+
+	behavior  FakeBehavior
+	listeners []net.Listener
+}
+
+// Fake is an in-memory Runtime that never talks to a container daemon.
+// Every exposed port is served by a small HTTP server on Host, on the bound
+// host port if the task has one and a random one otherwise, that answers any
+// path with 200, or 500 once the container is marked unhealthy, so manager
+// health checks work against it unchanged.
+type Fake struct {
+	Host string
+
+	mu         sync.Mutex
+	behaviors  map[string]FakeBehavior
+	containers map[string]*FakeContainer
+	pulled     map[string]bool
+	volumes    map[string]bool
+	nextID     int
+}
+
+func NewFake(host string) *Fake {
+	return &Fake{
+		Host:       host,
+		behaviors:  make(map[string]FakeBehavior),
+		containers: make(map[string]*FakeContainer),
+		pulled:     make(map[string]bool),
+		volumes:    make(map[string]bool),
+	}
+}
+
+// Pulled marks an image as already present, as if it had been pulled
+// before the worker started.
+func (f *Fake) Pulled(image string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pulled[image] = true
+}
+
+func (f *Fake) SetBehavior(image string, b FakeBehavior) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.behaviors[image] = b
+}
+
+func (f *Fake) Run(ctx context.Context, config Config) Result {
+	f.mu.Lock()
+	b := f.behaviors[config.Image]
+	pulled := f.pulled[config.Image]
+	f.mu.Unlock()
+
+	policy := pullPolicy(config)
+	if !pulled && policy == PullNever {
+		return Result{Error: fmt.Errorf("%w: image %s is not present and pull policy is %s", ErrImagePull, config.Image, PullNever)}
+	}
+
+	if !pulled || policy == PullAlways {
+		select {
+		case <-time.After(b.PullDelay):
+		case <-ctx.Done():
+			return Result{Error: fmt.Errorf("%w: %v", ErrImagePull, ctx.Err())}
+		}
+		if b.PullError != nil {
+			log.Printf("[Fake] Error pulling the image %s: %v\n", config.Image, b.PullError)
+			return Result{Error: fmt.Errorf("%w: %v", ErrImagePull, b.PullError)}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pulled[config.Image] = true
+
+	if b.StartError != nil {
+		return Result{Error: b.StartError}
+	}
+
+	action := "start"
+	c := f.findByName(config.Name)
+	if c != nil && c.Config.Labels[LabelTaskID] != config.Labels[LabelTaskID] {
+		// Another task's container of the same name makes way for this
+		// one once it has stopped.
+		if c.Status == "running" {
+			return Result{Error: fmt.Errorf("container name %s is in use by task %s", config.Name, c.Config.Labels[LabelTaskID])}
+		}
+		c.closeListeners()
+		delete(f.containers, c.ID)
+		c = nil
+	}
+	if c != nil {
+		c.closeListeners()
+		action = "restart"
+	} else {
+		f.nextID++
+		c = &FakeContainer{
+			ID:   fmt.Sprintf("fake-%d", f.nextID),
+			Name: config.Name,
+		}
+		f.containers[c.ID] = c
+	}
+
+	c.Config = config
+	c.behavior = b
+	c.Status = "running"
+	c.ExitCode = 0
+	c.StartedAt = time.Now().UTC()
+	c.FinishedAt = time.Time{}
+	c.Healthy = !b.Unhealthy
+	c.Starts++
+
+	err := f.listen(c)
+	if err != nil {
+		c.Status = "exited"
+		c.ExitCode = 128
+		return Result{Error: err}
+	}
+
+	return Result{ContainerId: c.ID, Action: action, Result: "success"}
+}
+
+func (f *Fake) Stop(ctx context.Context, id string, opts StopOptions) Result {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[id]
+	if !ok {
+		return Result{Error: fmt.Errorf("no such container: %s", id)}
+	}
+
+	c.StopOptions = opts
+	c.exit(143)
+
+	return Result{Action: "stop", ContainerId: id, Result: "success"}
+}
+
+func (f *Fake) Remove(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[id]
+	if !ok {
+		return fmt.Errorf("no such container: %s", id)
+	}
+
+	c.closeListeners()
+	delete(f.containers, id)
+	return nil
+}
+
+func (f *Fake) Inspect(ctx context.Context, id string) (*Status, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[id]
+	if !ok {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+	f.expire(c)
+
+	return &Status{
+		ID:         c.ID,
+		Name:       c.Name,
+		Image:      c.Config.Image,
+		State:      c.Status,
+		ExitCode:   c.ExitCode,
+		StartedAt:  c.StartedAt,
+		FinishedAt: c.FinishedAt,
+		Ports:      c.Ports,
+	}, nil
+}
+
+func (f *Fake) Logs(ctx context.Context, id string, opts LogOptions, stdout io.Writer, stderr io.Writer) error {
+	f.mu.Lock()
+	c, ok := f.containers[id]
+	f.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no such container: %s", id)
+	}
+
+	io.WriteString(stdout, c.behavior.Stdout)
+	io.WriteString(stderr, c.behavior.Stderr)
+
+	if opts.Follow {
+		<-ctx.Done()
+	}
+
+	return nil
+}
+
+func (f *Fake) Stats(ctx context.Context, id string) (*ContainerStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[id]
+	if !ok {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+
+	return &ContainerStats{MemoryLimit: uint64(c.Config.Memory)}, nil
+}
+
+func (f *Fake) Exec(ctx context.Context, id string, opts ExecOptions, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	f.mu.Lock()
+	c, ok := f.containers[id]
+	if ok {
+		f.expire(c)
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		return 0, fmt.Errorf("no such container: %s", id)
+	}
+	if c.Status != "running" {
+		return 0, fmt.Errorf("container %s is not running", id)
+	}
+
+	if c.behavior.Exec != nil {
+		return c.behavior.Exec(opts, stdin, stdout, stderr), nil
+	}
+
+	io.WriteString(stdout, strings.Join(opts.Cmd, " ")+"\n")
+	return 0, nil
+}
+
+func (f *Fake) List(ctx context.Context) ([]Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	res := []Container{}
+	for _, c := range f.containers {
+		if _, ok := c.Config.Labels[LabelTaskID]; !ok {
+			continue
+		}
+		f.expire(c)
+
+		res = append(res, Container{
+			ID:     c.ID,
+			Name:   c.Name,
+			Image:  c.Config.Image,
+			Status: c.Status,
+			Labels: c.Config.Labels,
+		})
+	}
+
+	return res, nil
+}
+
+func (f *Fake) CreateVolume(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.volumes[name] = true
+	return nil
+}
+
+func (f *Fake) RemoveVolume(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.volumes[name] {
+		return fmt.Errorf("no such volume: %s", name)
+	}
+	delete(f.volumes, name)
+	return nil
+}
+
+func (f *Fake) Volumes() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	res := []string{}
+	for v := range f.volumes {
+		res = append(res, v)
+	}
+
+	return res
+}
+
+// Exit makes a running container exit with the given code, as if the
+// process inside it had terminated on its own.
+func (f *Fake) Exit(id string, exitCode int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[id]
+	if !ok {
+		return fmt.Errorf("no such container: %s", id)
+	}
+
+	c.exit(exitCode)
+	return nil
+}
+
+// Crash kills a running container with the exit code of a SIGKILL.
+func (f *Fake) Crash(id string) error {
+	return f.Exit(id, 137)
+}
+
+func (f *Fake) SetHealthy(id string, healthy bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[id]
+	if !ok {
+		return fmt.Errorf("no such container: %s", id)
+	}
+
+	c.Healthy = healthy
+	return nil
+}
+
+// Containers returns a snapshot of every container the runtime knows about.
+func (f *Fake) Containers() []FakeContainer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	res := []FakeContainer{}
+	for _, c := range f.containers {
+		f.expire(c)
+		res = append(res, *c)
+	}
+
+	return res
+}
+
+func (f *Fake) Container(name string) (FakeContainer, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := f.findByName(name)
+	if c == nil {
+		return FakeContainer{}, false
+	}
+	f.expire(c)
+
+	return *c, true
+}
+
+func (f *Fake) findByName(name string) *FakeContainer {
+	for _, c := range f.containers {
+		if c.Name == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (f *Fake) expire(c *FakeContainer) {
+	if c.Status != "running" || c.behavior.ExitAfter == 0 {
+		return
+	}
+
+	if time.Since(c.StartedAt) >= c.behavior.ExitAfter {
+		c.exit(c.behavior.ExitCode)
+	}
+}
+
+func (f *Fake) listen(c *FakeContainer) error {
+	c.Ports = nat.PortMap{}
+
+	pm, err := ParsePortBindings(c.Config.PortBindings)
+	if err != nil {
+		return err
+	}
+
+	ports := map[nat.Port]string{}
+	for p := range c.Config.ExposedPorts {
+		ports[p] = "0"
+	}
+	for p, bindings := range pm {
+		ports[p] = bindings[0].HostPort
+	}
+
+	for p, hostPort := range ports {
+		l, err := net.Listen("tcp", net.JoinHostPort(f.Host, hostPort))
+		if err != nil {
+			c.closeListeners()
+			return err
+		}
+		c.listeners = append(c.listeners, l)
+
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		c.Ports[p] = []nat.PortBinding{{HostIP: f.Host, HostPort: port}}
+
+		go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			f.mu.Lock()
+			c.Requests = append(c.Requests, r.URL.Path)
+			healthy := c.Healthy && c.Status == "running"
+			f.mu.Unlock()
+
+			if !healthy {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte("OK"))
+		}))
+	}
+
+	return nil
+}
+
+func (c *FakeContainer) exit(exitCode int) {
+	if c.Status != "running" {
+		return
+	}
+
+	c.closeListeners()
+	c.Status = "exited"
+	c.ExitCode = exitCode
+	c.FinishedAt = time.Now().UTC()
+}
+
+func (c *FakeContainer) closeListeners() {
+	for _, l := range c.listeners {
+		l.Close()
+	}
+	c.listeners = nil
+}
@@ -0,0 +1,136 @@
+package task
+
+import "fmt"
+
+// ContainerSpec is a container a task runs besides its own, main one: an
+// init container run to completion before it, or a sidecar run alongside
+// it.
+type ContainerSpec struct {
+	Name       string
+	Image      string
+	PullPolicy string
+	Cmd        []string
+	Entrypoint []string
+	Env        []string
+	WorkingDir string
+	User       string
+	CPU        float64
+	Memory     int64
+	Mounts     []Mount
+}
+
+// MainContainer names the task's own container among the containers of its
+// group.
+const MainContainer = "main"
+
+// LabelContainer is set on the init containers and sidecars of a task to
+// their name, telling them apart from its main container.
+const LabelContainer = "cube.container"
+
+const (
+	ContainerWaiting = "Waiting"
+	ContainerRunning = "Running"
+	ContainerExited  = "Exited"
+)
+
+const (
+	ReasonInitFailed    = "InitContainerFailed"
+	ReasonSidecarExited = "SidecarExited"
+)
+
+// ContainerStatus is the state of one container of a task's group.
+type ContainerStatus struct {
+	Name        string
+	Init        bool
+	ContainerId string
+	State       string
+	ExitCode    int
+}
+
+// Grouped reports whether the task runs more than its main container.
+func (t *Task) Grouped() bool {
+	return len(t.InitContainers) > 0 || len(t.Sidecars) > 0
+}
+
+// NewContainerStatuses returns the task's containers, init containers
+// first in the order they run, all waiting to start.
+func (t *Task) NewContainerStatuses() []ContainerStatus {
+	var res []ContainerStatus
+	for _, s := range t.InitContainers {
+		res = append(res, ContainerStatus{Name: s.Name, Init: true, State: ContainerWaiting})
+	}
+	res = append(res, ContainerStatus{Name: MainContainer, State: ContainerWaiting})
+	for _, s := range t.Sidecars {
+		res = append(res, ContainerStatus{Name: s.Name, State: ContainerWaiting})
+	}
+
+	return res
+}
+
+// ContainerConfig returns the config of one of the task's init containers
+// or sidecars. It is stopped as the task is, and restarted only with it.
+func (t *Task) ContainerConfig(s ContainerSpec) Config {
+	return Config{
+		Name:        fmt.Sprintf("%s-%s", t.Name, s.Name),
+		Image:       s.Image,
+		PullPolicy:  s.PullPolicy,
+		Cmd:         s.Cmd,
+		Entrypoint:  s.Entrypoint,
+		Env:         s.Env,
+		WorkingDir:  s.WorkingDir,
+		User:        s.User,
+		CPU:         s.CPU,
+		Memory:      s.Memory,
+		Mounts:      s.Mounts,
+		StopSignal:  t.StopSignal,
+		StopTimeout: t.StopTimeout,
+		Labels:      map[string]string{LabelTaskID: t.ID.String(), LabelContainer: s.Name},
+	}
+}
+
+// ContainerIdOf returns the ID of the named container of the task's group,
+// the main container's for an empty name.
+func (t *Task) ContainerIdOf(name string) (string, bool) {
+	if name == "" || name == MainContainer {
+		return t.ContainerId, t.ContainerId != ""
+	}
+
+	for _, c := range t.Containers {
+		if c.Name == name {
+			return c.ContainerId, c.ContainerId != ""
+		}
+	}
+
+	return "", false
+}
+
+// ContainerIds returns the IDs of every container created for the task, its
+// main container's first.
+func (t *Task) ContainerIds() []string {
+	var ids []string
+	if t.ContainerId != "" {
+		ids = append(ids, t.ContainerId)
+	}
+	for _, c := range t.Containers {
+		if c.Name != MainContainer && c.ContainerId != "" {
+			ids = append(ids, c.ContainerId)
+		}
+	}
+
+	return ids
+}
+
+// TotalMemory returns the memory the task needs at once: that of its main
+// container and sidecars together, or of its largest init container if
+// that is more, as init containers run on their own.
+func (t *Task) TotalMemory() int64 {
+	total := t.Memory
+	for _, s := range t.Sidecars {
+		total += s.Memory
+	}
+	for _, s := range t.InitContainers {
+		total = max(total, s.Memory)
+	}
+
+	return total
+}
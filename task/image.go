@@ -0,0 +1,201 @@
+package task
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+const (
+	PullAlways       = "Always"
+	PullIfNotPresent = "IfNotPresent"
+	PullNever        = "Never"
+)
+
+const (
+	ReasonImagePull   = "ImagePullFailed"
+	ReasonStartFailed = "StartFailed"
+)
+
+// ErrImagePull wraps every error that comes from resolving or pulling a
+// task's image, so the worker can report it apart from other start failures.
+var ErrImagePull = errors.New("image pull failed")
+
+// Credentials maps a registry host, e.g. "ghcr.io" or "docker.io", to the
+// credentials used to pull from it.
+type Credentials map[string]registry.AuthConfig
+
+// LoadCredentials reads registry credentials from a file in the format of
+// Docker's config.json: {"auths": {"<registry>": {"auth": "<base64 user:password>"}}},
+// where username and password may be given instead of auth.
+func LoadCredentials(path string) (Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Auths map[string]registry.AuthConfig `json:"auths"`
+	}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %v", path, err)
+	}
+
+	creds := Credentials{}
+	for host, auth := range file.Auths {
+		if auth.Auth != "" && auth.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for registry %s: %v", host, err)
+			}
+			user, pass, _ := strings.Cut(string(decoded), ":")
+			auth.Username, auth.Password, auth.Auth = user, pass, ""
+		}
+		auth.ServerAddress = host
+		creds[registryHost(host)] = auth
+	}
+
+	return creds, nil
+}
+
+func (c Credentials) lookup(ref reference.Named) (registry.AuthConfig, bool) {
+	auth, ok := c[reference.Domain(ref)]
+	return auth, ok
+}
+
+// registryHost normalises the keys found in credential files, which may be
+// URLs, and Docker Hub's legacy index address, to plain registry hosts.
+func registryHost(s string) string {
+	s = strings.TrimPrefix(s, "https://")
+	s = strings.TrimPrefix(s, "http://")
+	s, _, _ = strings.Cut(s, "/")
+
+	if s == "index.docker.io" || s == "registry-1.docker.io" {
+		return "docker.io"
+	}
+
+	return s
+}
+
+func pullPolicy(config Config) string {
+	if config.PullPolicy == "" {
+		return PullIfNotPresent
+	}
+
+	return config.PullPolicy
+}
+
+// ensureImage makes the task's image available locally according to its
+// pull policy. Images pinned by digest are matched on their digest rather
+// than on tags.
+func (d *Docker) ensureImage(ctx context.Context, config Config) error {
+	ref, err := reference.ParseNormalizedNamed(config.Image)
+	if err != nil {
+		return fmt.Errorf("%w: invalid image reference %s: %v", ErrImagePull, config.Image, err)
+	}
+	ref = reference.TagNameOnly(ref)
+
+	policy := pullPolicy(config)
+	switch policy {
+	case PullAlways, PullIfNotPresent, PullNever:
+	default:
+		return fmt.Errorf("%w: unknown pull policy %s", ErrImagePull, policy)
+	}
+
+	if policy != PullAlways {
+		exists, err := d.imageExists(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrImagePull, err)
+		}
+
+		if exists {
+			return nil
+		}
+
+		if policy == PullNever {
+			return fmt.Errorf("%w: image %s is not present and pull policy is %s", ErrImagePull, config.Image, PullNever)
+		}
+	}
+
+	return d.pullImage(ctx, ref)
+}
+
+func (d *Docker) pullImage(ctx context.Context, ref reference.Named) error {
+	if d.PullTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.PullTimeout)
+		defer cancel()
+	}
+
+	opts := image.PullOptions{}
+	if auth, ok := d.Credentials.lookup(ref); ok {
+		encoded, err := registry.EncodeAuthConfig(auth)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrImagePull, err)
+		}
+		opts.RegistryAuth = encoded
+	}
+
+	log.Printf("Pulling image %s\n", ref)
+	reader, err := d.Client.ImagePull(ctx, ref.String(), opts)
+	if err != nil {
+		log.Printf("Error pulling the image %s: %v\n", ref, err)
+		return fmt.Errorf("%w: %v", ErrImagePull, err)
+	}
+	defer reader.Close()
+
+	// Errors such as a missing manifest only show up in the progress stream.
+	err = jsonmessage.DisplayJSONMessagesStream(reader, io.Discard, 0, false, nil)
+	if err != nil {
+		log.Printf("Error pulling the image %s: %v\n", ref, err)
+		return fmt.Errorf("%w: %v", ErrImagePull, err)
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %v", ErrImagePull, ctx.Err())
+	}
+
+	log.Printf("Pulled image %s\n", ref)
+	return nil
+}
+
+func (d *Docker) imageExists(ctx context.Context, ref reference.Named) (bool, error) {
+	images, err := d.Client.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	canonical, pinned := ref.(reference.Canonical)
+
+	for _, img := range images {
+		if pinned {
+			want := reference.FamiliarName(ref) + "@" + canonical.Digest().String()
+			for _, d := range img.RepoDigests {
+				if d == want || d == ref.Name()+"@"+canonical.Digest().String() {
+					return true, nil
+				}
+			}
+			continue
+		}
+
+		for _, tag := range img.RepoTags {
+			if tag == reference.FamiliarString(ref) || tag == ref.String() {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
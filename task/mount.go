@@ -0,0 +1,38 @@
+package task
+
+import "slices"
+
+const (
+	MountVolume = "volume"
+	MountBind   = "bind"
+	MountTmpfs  = "tmpfs"
+)
+
+// Mount attaches storage to a task. Source is the volume name for named
+// volumes and the host path for bind mounts, and is unused for tmpfs, whose
+// size is capped by Size bytes.
+type Mount struct {
+	Type     string `json:"type" yaml:"type"`
+	Source   string `json:"source,omitempty" yaml:"source"`
+	Target   string `json:"target" yaml:"target"`
+	ReadOnly bool   `json:"readOnly,omitempty" yaml:"readOnly"`
+	Size     int64  `json:"size,omitempty" yaml:"size"`
+}
+
+// Volumes returns the names of the named volumes the task, or any of its
+// init containers and sidecars, mounts. Each name appears once.
+func (t *Task) Volumes() []string {
+	mounts := slices.Clone(t.Mounts)
+	for _, c := range slices.Concat(t.InitContainers, t.Sidecars) {
+		mounts = append(mounts, c.Mounts...)
+	}
+
+	var names []string
+	for _, m := range mounts {
+		if m.Type == MountVolume && m.Source != "" && !slices.Contains(names, m.Source) {
+			names = append(names, m.Source)
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,77 @@
+package task
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// ParsePortBindings turns the PortBindings of a task, e.g.
+// {"7777/tcp": "7777"} or {"53/udp": "127.0.0.1:5353"}, into a nat.PortMap.
+func ParsePortBindings(bindings map[string]string) (nat.PortMap, error) {
+	pm := nat.PortMap{}
+
+	for cp, hp := range bindings {
+		proto, port := nat.SplitProtoPort(cp)
+		p, err := nat.NewPort(proto, port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid container port %q: %v", cp, err)
+		}
+
+		var ip string
+		if i := strings.LastIndex(hp, ":"); i >= 0 {
+			ip, hp = hp[:i], hp[i+1:]
+		}
+
+		_, err = nat.ParsePort(hp)
+		if err != nil || hp == "" {
+			return nil, fmt.Errorf("invalid host port %q for %s", hp, cp)
+		}
+
+		pm[p] = append(pm[p], nat.PortBinding{HostIP: ip, HostPort: hp})
+	}
+
+	return pm, nil
+}
+
+// RequiredHostPorts returns the host ports the task needs on whichever node
+// it runs on, formatted as "port/proto". Bindings to host port 0, which get
+// a random one, need none.
+func (t *Task) RequiredHostPorts() ([]string, error) {
+	pm, err := ParsePortBindings(t.PortBindings)
+	if err != nil {
+		return nil, err
+	}
+
+	var ports []string
+	for p, bindings := range pm {
+		for _, b := range bindings {
+			if b.HostPort == "" || b.HostPort == "0" {
+				continue
+			}
+			ports = append(ports, fmt.Sprintf("%s/%s", b.HostPort, p.Proto()))
+		}
+	}
+
+	return ports, nil
+}
+
+// HostPort returns where the task's lowest published container port is
+// reachable on its node, which its health check and pre-stop hook are sent
+// to, or nil if it publishes none.
+func (t *Task) HostPort() *nat.PortBinding {
+	ports := slices.SortedFunc(maps.Keys(t.HostPorts), func(a, b nat.Port) int {
+		return cmp.Or(cmp.Compare(a.Int(), b.Int()), cmp.Compare(a.Proto(), b.Proto()))
+	})
+	for _, p := range ports {
+		if len(t.HostPorts[p]) > 0 {
+			return &t.HostPorts[p][0]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package task
+
+import (
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+)
+
+func TestHostPort(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports nat.PortMap
+		want  string
+	}{
+		{"none", nil, ""},
+		{"unpublished", nat.PortMap{"80/tcp": nil}, ""},
+		{"one", nat.PortMap{"80/tcp": {{HostPort: "32768"}}}, "32768"},
+		{
+			name: "lowest port first",
+			ports: nat.PortMap{
+				"9090/tcp":  {{HostPort: "32770"}},
+				"10000/tcp": {{HostPort: "32771"}},
+				"8080/tcp":  {{HostPort: "32769"}},
+			},
+			want: "32769",
+		},
+		{
+			name: "tcp before udp",
+			ports: nat.PortMap{
+				"53/udp": {{HostPort: "32772"}},
+				"53/tcp": {{HostPort: "32773"}},
+			},
+			want: "32773",
+		},
+		{
+			name: "skipping unpublished",
+			ports: nat.PortMap{
+				"80/tcp":   nil,
+				"8080/tcp": {{HostPort: "32774"}},
+			},
+			want: "32774",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Map order varies between runs, so ask a few times.
+			for range 10 {
+				tk := Task{HostPorts: tt.ports}
+				var got string
+				if b := tk.HostPort(); b != nil {
+					got = b.HostPort
+				}
+				if got != tt.want {
+					t.Fatalf("host port is %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
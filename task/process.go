@@ -0,0 +1,612 @@
+package task
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
+)
+
+const cgroupPeriod = 100000
+
+var signals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// Process runs a Task as a supervised OS process instead of a container.
+// Config.Image is the executable (a path, or a name looked up in PATH) and
+// Config.Cmd its arguments, unless an Entrypoint is given, in which case it
+// is run with Cmd appended. Output is captured to files under Dir and, when
+// the cgroup v2 hierarchy at CgroupRoot is writable, each process is placed
+// in its own cgroup with cpu.max and memory.max derived from the task.
+type Process struct {
+	Dir        string
+	CgroupRoot string
+
+	mu    sync.Mutex
+	procs map[string]*process
+}
+
+type process struct {
+	id         string
+	config     Config
+	cmd        *exec.Cmd
+	cgroup     string
+	status     string
+	exitCode   int
+	startedAt  time.Time
+	finishedAt time.Time
+	done       chan struct{}
+}
+
+func NewProcess(dir string, cgroupRoot string) *Process {
+	return &Process{
+		Dir:        dir,
+		CgroupRoot: cgroupRoot,
+		procs:      make(map[string]*process),
+	}
+}
+
+func (p *Process) Run(ctx context.Context, config Config) Result {
+	name, args := config.Image, config.Cmd
+	if len(config.Entrypoint) > 0 {
+		name = config.Entrypoint[0]
+		args = append(append([]string{}, config.Entrypoint[1:]...), config.Cmd...)
+	}
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		log.Printf("[Process] Unable to find executable %s: %v\n", name, err)
+		return Result{Error: fmt.Errorf("%w: %v", ErrImagePull, err)}
+	}
+
+	if config.User != "" {
+		log.Printf("[Process] Ignoring user %s for %s, processes run as the worker's user\n", config.User, config.Name)
+	}
+
+	if len(config.Mounts) > 0 {
+		log.Printf("[Process] Ignoring mounts for %s, volumes are available under %s\n", config.Name, p.volumeDir(""))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	action := "start"
+	if old := p.findByName(config.Name); old != nil {
+		switch {
+		case old.status == "running" && old.config.Labels[LabelTaskID] != config.Labels[LabelTaskID]:
+			return Result{Error: fmt.Errorf("process name %s is in use by task %s", config.Name, old.config.Labels[LabelTaskID])}
+		case old.status == "running":
+			return Result{ContainerId: old.id, Action: "start", Result: "success"}
+		}
+		delete(p.procs, old.id)
+		action = "restart"
+	}
+
+	proc := &process{
+		id:     uuid.New().String(),
+		config: config,
+		done:   make(chan struct{}),
+	}
+
+	dir := filepath.Join(p.Dir, proc.id)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return Result{Error: err}
+	}
+
+	stdout, err := os.Create(filepath.Join(dir, "stdout.log"))
+	if err != nil {
+		return Result{Error: err}
+	}
+
+	stderr, err := os.Create(filepath.Join(dir, "stderr.log"))
+	if err != nil {
+		stdout.Close()
+		return Result{Error: err}
+	}
+
+	command := func() *exec.Cmd {
+		cmd := exec.Command(path, args...)
+		cmd.Dir = config.WorkingDir
+		cmd.Env = append(os.Environ(), config.Env...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		return cmd
+	}
+
+	// The process starts right in its cgroup, so that nothing of it runs
+	// unconstrained, not even for a moment.
+	cmd := command()
+	proc.cgroup = p.limit(proc)
+	if proc.cgroup != "" {
+		err = startInCgroup(cmd, proc.cgroup)
+		if err != nil {
+			log.Printf("[Process] Unable to start %s in its cgroup, running it without limits: %v\n", proc.id, err)
+			os.Remove(proc.cgroup)
+			proc.cgroup = ""
+			cmd = command()
+		}
+	}
+	if proc.cgroup == "" {
+		err = cmd.Start()
+	}
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		log.Printf("[Process] Failed to start %s: %v\n", config.Image, err)
+		return Result{Error: err}
+	}
+	proc.cmd = cmd
+
+	proc.status = "running"
+	proc.startedAt = time.Now().UTC()
+	p.procs[proc.id] = proc
+
+	go func() {
+		err := cmd.Wait()
+		stdout.Close()
+		stderr.Close()
+
+		p.mu.Lock()
+		proc.status = "exited"
+		proc.finishedAt = time.Now().UTC()
+		proc.exitCode = exitCode(err)
+		p.mu.Unlock()
+
+		if proc.cgroup != "" {
+			os.Remove(proc.cgroup)
+		}
+		close(proc.done)
+	}()
+
+	return Result{ContainerId: proc.id, Action: action, Result: "success"}
+}
+
+func (p *Process) Stop(ctx context.Context, id string, opts StopOptions) Result {
+	p.mu.Lock()
+	proc, ok := p.procs[id]
+	p.mu.Unlock()
+
+	if !ok {
+		return Result{Error: fmt.Errorf("no such process: %s", id)}
+	}
+
+	sig, err := parseSignal(opts.Signal)
+	if err != nil {
+		return Result{Error: err}
+	}
+
+	log.Printf("[Process] Attempting to stop process %s with %v\n", id, sig)
+	proc.cmd.Process.Signal(sig)
+
+	select {
+	case <-proc.done:
+	case <-time.After(opts.Timeout):
+		proc.cmd.Process.Kill()
+		<-proc.done
+	case <-ctx.Done():
+		// The caller can't wait out the grace period.
+		proc.cmd.Process.Kill()
+		<-proc.done
+	}
+
+	return Result{Action: "stop", ContainerId: id, Result: "success"}
+}
+
+func (p *Process) Remove(ctx context.Context, id string) error {
+	p.mu.Lock()
+	proc, ok := p.procs[id]
+	if ok && proc.status == "running" {
+		p.mu.Unlock()
+		return fmt.Errorf("process %s is still running", id)
+	}
+	delete(p.procs, id)
+	p.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no such process: %s", id)
+	}
+
+	return os.RemoveAll(filepath.Join(p.Dir, id))
+}
+
+func (p *Process) Inspect(ctx context.Context, id string) (*Status, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	proc, ok := p.procs[id]
+	if !ok {
+		return nil, fmt.Errorf("no such process: %s", id)
+	}
+
+	return &Status{
+		ID:         proc.id,
+		Name:       proc.config.Name,
+		Image:      proc.config.Image,
+		State:      proc.status,
+		ExitCode:   proc.exitCode,
+		Pid:        proc.cmd.Process.Pid,
+		StartedAt:  proc.startedAt,
+		FinishedAt: proc.finishedAt,
+		Ports:      processPorts(proc.config),
+	}, nil
+}
+
+// Logs replays the captured output of a process. Since and Timestamps are
+// not supported, the output files carry no timing information.
+func (p *Process) Logs(ctx context.Context, id string, opts LogOptions, stdout io.Writer, stderr io.Writer) error {
+	p.mu.Lock()
+	proc, ok := p.procs[id]
+	p.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no such process: %s", id)
+	}
+
+	dir := filepath.Join(p.Dir, id)
+	if !opts.Follow {
+		err := copyLog(filepath.Join(dir, "stderr.log"), opts.Tail, stderr)
+		if err != nil {
+			return err
+		}
+
+		return copyLog(filepath.Join(dir, "stdout.log"), opts.Tail, stdout)
+	}
+
+	errf, err := os.Open(filepath.Join(dir, "stderr.log"))
+	if err != nil {
+		return err
+	}
+	defer errf.Close()
+
+	outf, err := os.Open(filepath.Join(dir, "stdout.log"))
+	if err != nil {
+		return err
+	}
+	defer outf.Close()
+
+	err = copyTail(errf, opts.Tail, stderr)
+	if err == nil {
+		err = copyTail(outf, opts.Tail, stdout)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Both outputs are followed in turn, so stdout and stderr may well be
+	// the same writer.
+	follow := func() error {
+		_, err := io.Copy(stderr, errf)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(stdout, outf)
+		return err
+	}
+
+	for {
+		err := follow()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-proc.done:
+			return follow()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func (p *Process) Stats(ctx context.Context, id string) (*ContainerStats, error) {
+	p.mu.Lock()
+	proc, ok := p.procs[id]
+	p.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no such process: %s", id)
+	}
+
+	if proc.cgroup == "" {
+		return nil, errors.New("process is not running in a cgroup")
+	}
+
+	usage, err := readCgroupInt(filepath.Join(proc.cgroup, "memory.current"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ContainerStats{MemoryUsage: usage, MemoryLimit: uint64(proc.config.Memory)}
+
+	cpu, err := readCpuUsage(filepath.Join(proc.cgroup, "cpu.stat"))
+	if err == nil {
+		elapsed := time.Since(proc.startedAt)
+		if elapsed > 0 {
+			s.CpuPercent = float64(cpu) / float64(elapsed.Microseconds())
+		}
+	}
+
+	return s, nil
+}
+
+// Exec runs a command next to the task's process: same working directory,
+// environment and cgroup, as processes have no container to enter.
+func (p *Process) Exec(ctx context.Context, id string, opts ExecOptions, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	p.mu.Lock()
+	proc, ok := p.procs[id]
+	p.mu.Unlock()
+
+	if !ok {
+		return 0, fmt.Errorf("no such process: %s", id)
+	}
+	if len(opts.Cmd) == 0 {
+		return 0, errors.New("no command given")
+	}
+
+	cmd := exec.CommandContext(ctx, opts.Cmd[0], opts.Cmd[1:]...)
+	cmd.Dir = proc.config.WorkingDir
+	if opts.WorkingDir != "" {
+		cmd.Dir = opts.WorkingDir
+	}
+	cmd.Env = append(append(os.Environ(), proc.config.Env...), opts.Env...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	var in io.WriteCloser
+	if stdin != nil {
+		var err error
+		in, err = cmd.StdinPipe()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var err error
+	if proc.cgroup != "" {
+		err = startInCgroup(cmd, proc.cgroup)
+	} else {
+		err = cmd.Start()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if in != nil {
+		go func() {
+			io.Copy(in, stdin)
+			in.Close()
+		}()
+	}
+
+	return exitCode(cmd.Wait()), nil
+}
+
+// List returns the processes started by this Process that run a task; it
+// knows no others. Unlike containers, they are children of the worker and
+// don't outlive it.
+func (p *Process) List(ctx context.Context) ([]Container, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	res := []Container{}
+	for _, proc := range p.procs {
+		if _, ok := proc.config.Labels[LabelTaskID]; !ok {
+			continue
+		}
+
+		res = append(res, Container{
+			ID:     proc.id,
+			Name:   proc.config.Name,
+			Image:  proc.config.Image,
+			Status: proc.status,
+			Labels: proc.config.Labels,
+		})
+	}
+
+	return res, nil
+}
+
+// CreateVolume creates a plain directory, processes share the host's
+// filesystem so there is nothing to mount.
+func (p *Process) CreateVolume(ctx context.Context, name string) error {
+	return os.MkdirAll(p.volumeDir(name), 0755)
+}
+
+func (p *Process) RemoveVolume(ctx context.Context, name string) error {
+	return os.RemoveAll(p.volumeDir(name))
+}
+
+func (p *Process) volumeDir(name string) string {
+	return filepath.Join(p.Dir, "volumes", name)
+}
+
+func (p *Process) findByName(name string) *process {
+	for _, proc := range p.procs {
+		if proc.config.Name == name {
+			return proc
+		}
+	}
+
+	return nil
+}
+
+// limit creates a cgroup of the process's own with the task's CPU and
+// memory limits, for it to be started in. Failing to do so isn't fatal, the
+// process simply runs unconstrained, which is the case whenever the worker
+// lacks write access to the cgroup hierarchy.
+func (p *Process) limit(proc *process) string {
+	if p.CgroupRoot == "" {
+		return ""
+	}
+
+	err := os.MkdirAll(p.CgroupRoot, 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(p.CgroupRoot, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644)
+	}
+	if err != nil {
+		log.Printf("[Process] Unable to set up cgroup %s, running %s without limits: %v\n", p.CgroupRoot, proc.id, err)
+		return ""
+	}
+
+	cg := filepath.Join(p.CgroupRoot, proc.id)
+	err = os.Mkdir(cg, 0755)
+	if err != nil {
+		log.Printf("[Process] Unable to create cgroup for %s: %v\n", proc.id, err)
+		return ""
+	}
+
+	if proc.config.CPU > 0 {
+		quota := int64(proc.config.CPU * cgroupPeriod)
+		err = os.WriteFile(filepath.Join(cg, "cpu.max"), []byte(fmt.Sprintf("%d %d", quota, cgroupPeriod)), 0644)
+		if err != nil {
+			log.Printf("[Process] Unable to set cpu.max for %s: %v\n", proc.id, err)
+		}
+	}
+
+	if proc.config.Memory > 0 {
+		err = os.WriteFile(filepath.Join(cg, "memory.max"), []byte(strconv.FormatInt(proc.config.Memory, 10)), 0644)
+		if err != nil {
+			log.Printf("[Process] Unable to set memory.max for %s: %v\n", proc.id, err)
+		}
+	}
+
+	return cg
+}
+
+// processPorts reports the ports a process listens on. There is no address
+// translation for processes, so an exposed port is published on the same
+// port of the host unless a binding says otherwise.
+func processPorts(config Config) nat.PortMap {
+	pm, err := ParsePortBindings(config.PortBindings)
+	if err != nil {
+		pm = nat.PortMap{}
+	}
+
+	for p := range config.ExposedPorts {
+		if _, ok := pm[p]; !ok {
+			pm[p] = []nat.PortBinding{{HostPort: p.Port()}}
+		}
+	}
+
+	return pm
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return syscall.SIGTERM, nil
+	}
+
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	sig, ok := signals[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported stop signal %s", name)
+	}
+
+	return sig, nil
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if code := exitErr.ExitCode(); code >= 0 {
+			return code
+		}
+		// Killed by a signal, report it the way a shell would.
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+	}
+
+	return 1
+}
+
+func copyLog(path string, tail string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return copyTail(f, tail, w)
+}
+
+// copyTail copies the last tail lines of r to w, or all of it when tail is
+// empty or "all".
+func copyTail(r io.Reader, tail string, w io.Writer) error {
+	n, err := strconv.Atoi(tail)
+	if tail == "" || tail == "all" || err != nil || n < 0 {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	lines := []string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+
+	for _, l := range lines {
+		_, err := io.WriteString(w, l+"\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.Err()
+}
+
+func readCgroupInt(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func readCpuUsage(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+
+	return 0, errors.New("usage_usec not found in cpu.stat")
+}
@@ -0,0 +1,283 @@
+package task
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// run starts a shell command as a process task and returns its id.
+func run(t *testing.T, p *Process, script string) string {
+	t.Helper()
+
+	res := p.Run(context.Background(), Config{
+		Name:   "test-" + t.Name(),
+		Image:  "sh",
+		Cmd:    []string{"-c", script},
+		Labels: map[string]string{LabelTaskID: t.Name()},
+	})
+	if res.Error != nil {
+		t.Fatalf("unable to run %q: %v", script, res.Error)
+	}
+
+	return res.ContainerId
+}
+
+// wait waits for a process to exit.
+func wait(t *testing.T, p *Process, id string) {
+	t.Helper()
+
+	p.mu.Lock()
+	done := p.procs[id].done
+	p.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("process %s didn't exit", id)
+	}
+}
+
+// syncBuffer is a buffer safe for the test to read while a process's logs
+// are still being written to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// cgroupRoot returns a cgroup of the test's own to place processes under,
+// skipping the test unless the cgroup v2 hierarchy is writable.
+func cgroupRoot(t *testing.T) string {
+	t.Helper()
+
+	_, err := os.Stat("/sys/fs/cgroup/cgroup.controllers")
+	if err != nil {
+		t.Skip("cgroup v2 is not available")
+	}
+
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		t.Skipf("unable to read the test's cgroup: %v", err)
+	}
+	var self string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			self = path
+		}
+	}
+
+	root := filepath.Join("/sys/fs/cgroup", self, "cube-test-"+strings.ReplaceAll(t.Name(), "/", "-"))
+	err = os.Mkdir(root, 0755)
+	if err != nil {
+		t.Skipf("cgroup v2 is not writable: %v", err)
+	}
+	t.Cleanup(func() { os.Remove(root) })
+
+	err = os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+cpu +memory"), 0644)
+	if err != nil {
+		t.Skipf("unable to enable the cpu and memory controllers: %v", err)
+	}
+
+	return root
+}
+
+func TestProcessReportsExitCode(t *testing.T) {
+	tests := []struct {
+		script string
+		code   int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -KILL $$", 137},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.script, func(t *testing.T) {
+			p := NewProcess(t.TempDir(), "")
+			id := run(t, p, tt.script)
+			wait(t, p, id)
+
+			st, err := p.Inspect(context.Background(), id)
+			if err != nil {
+				t.Fatalf("unable to inspect process: %v", err)
+			}
+			if st.State != "exited" {
+				t.Errorf("expected the process to have exited, got %s", st.State)
+			}
+			if st.ExitCode != tt.code {
+				t.Errorf("expected exit code %d, got %d", tt.code, st.ExitCode)
+			}
+		})
+	}
+}
+
+func TestProcessCapturesOutput(t *testing.T) {
+	p := NewProcess(t.TempDir(), "")
+	id := run(t, p, "echo one; echo two >&2; echo three")
+	wait(t, p, id)
+
+	var stdout, stderr bytes.Buffer
+	err := p.Logs(context.Background(), id, LogOptions{}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("unable to get logs: %v", err)
+	}
+	if stdout.String() != "one\nthree\n" {
+		t.Errorf("expected stdout %q, got %q", "one\nthree\n", stdout.String())
+	}
+	if stderr.String() != "two\n" {
+		t.Errorf("expected stderr %q, got %q", "two\n", stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	err = p.Logs(context.Background(), id, LogOptions{Tail: "1"}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("unable to get logs: %v", err)
+	}
+	if stdout.String() != "three\n" {
+		t.Errorf("expected the last line of stdout, got %q", stdout.String())
+	}
+}
+
+func TestProcessFollowsBothOutputs(t *testing.T) {
+	p := NewProcess(t.TempDir(), "")
+	id := run(t, p, "echo out; echo err >&2; sleep 1; echo late-out; echo late-err >&2")
+
+	// Both outputs go to the same writer, as they do for the worker's logs
+	// endpoint.
+	var out syncBuffer
+	err := p.Logs(context.Background(), id, LogOptions{Follow: true}, &out, &out)
+	if err != nil {
+		t.Fatalf("unable to follow logs: %v", err)
+	}
+
+	for _, line := range []string{"out", "err", "late-out", "late-err"} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected the followed logs to contain %q, got %q", line, out.String())
+		}
+	}
+}
+
+func TestProcessStop(t *testing.T) {
+	t.Run("signal", func(t *testing.T) {
+		p := NewProcess(t.TempDir(), "")
+		id := run(t, p, "sleep 60")
+
+		start := time.Now()
+		res := p.Stop(context.Background(), id, StopOptions{Signal: "SIGTERM", Timeout: 10 * time.Second})
+		if res.Error != nil {
+			t.Fatalf("unable to stop process: %v", res.Error)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("expected the process to stop on SIGTERM, took %v", d)
+		}
+
+		st, _ := p.Inspect(context.Background(), id)
+		if code := st.ExitCode; code != 143 {
+			t.Errorf("expected exit code 143, got %d", code)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		p := NewProcess(t.TempDir(), "")
+		id := run(t, p, "trap '' TERM; echo ready; while :; do sleep 0.1; done")
+
+		// The trap has to be set before the signal is sent.
+		for i := 0; ; i++ {
+			var out bytes.Buffer
+			p.Logs(context.Background(), id, LogOptions{}, &out, &out)
+			if strings.Contains(out.String(), "ready") {
+				break
+			}
+			if i == 100 {
+				t.Fatal("process didn't start")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		start := time.Now()
+		res := p.Stop(context.Background(), id, StopOptions{Signal: "SIGTERM", Timeout: 500 * time.Millisecond})
+		if res.Error != nil {
+			t.Fatalf("unable to stop process: %v", res.Error)
+		}
+		if d := time.Since(start); d < 500*time.Millisecond {
+			t.Errorf("expected the process to be killed after the timeout, took %v", d)
+		}
+
+		st, _ := p.Inspect(context.Background(), id)
+		if code := st.ExitCode; code != 137 {
+			t.Errorf("expected exit code 137, got %d", code)
+		}
+	})
+}
+
+func TestProcessStartsInItsCgroup(t *testing.T) {
+	root := cgroupRoot(t)
+
+	p := NewProcess(t.TempDir(), root)
+	res := p.Run(context.Background(), Config{
+		Name:   "test-cgroup",
+		Image:  "sh",
+		Cmd:    []string{"-c", "cat /proc/self/cgroup; sleep 60"},
+		Memory: 64 << 20,
+		CPU:    0.5,
+		Labels: map[string]string{LabelTaskID: t.Name()},
+	})
+	if res.Error != nil {
+		t.Fatalf("unable to run process: %v", res.Error)
+	}
+	id := res.ContainerId
+	defer p.Stop(context.Background(), id, StopOptions{Signal: "SIGKILL"})
+
+	memory, err := os.ReadFile(filepath.Join(root, id, "memory.max"))
+	if err != nil {
+		t.Fatalf("expected the process to have a cgroup: %v", err)
+	}
+	if strings.TrimSpace(string(memory)) != "67108864" {
+		t.Errorf("expected memory.max of 67108864, got %q", memory)
+	}
+	cpu, err := os.ReadFile(filepath.Join(root, id, "cpu.max"))
+	if err != nil {
+		t.Fatalf("unable to read cpu.max: %v", err)
+	}
+	if strings.TrimSpace(string(cpu)) != "50000 100000" {
+		t.Errorf("expected cpu.max of 50000 100000, got %q", cpu)
+	}
+
+	// Whatever the process runs inherits the cgroup it was started in.
+	var out bytes.Buffer
+	for i := 0; !strings.Contains(out.String(), "\n"); i++ {
+		if i == 100 {
+			t.Fatal("process didn't report its cgroup")
+		}
+		time.Sleep(50 * time.Millisecond)
+		out.Reset()
+		p.Logs(context.Background(), id, LogOptions{}, &out, &out)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(out.String()), "/"+id) {
+		t.Errorf("expected the process to start in cgroup %s, it started in %q", id, out.String())
+	}
+
+	p.Stop(context.Background(), id, StopOptions{Signal: "SIGKILL"})
+	_, err = os.Stat(filepath.Join(root, id))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the cgroup to be removed once the process exited, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// Runtime is the backend a worker uses to run the workload behind a Task.
+// Docker is the default implementation.
+//
+// The context passed to each method bounds the call itself. Containers
+// started by Run keep running after it is cancelled.
+type Runtime interface {
+	Run(ctx context.Context, config Config) Result
+	Stop(ctx context.Context, id string, opts StopOptions) Result
+	Remove(ctx context.Context, id string) error
+	Inspect(ctx context.Context, id string) (*Status, error)
+	Logs(ctx context.Context, id string, opts LogOptions, stdout io.Writer, stderr io.Writer) error
+	Stats(ctx context.Context, id string) (*ContainerStats, error)
+	CreateVolume(ctx context.Context, name string) error
+	RemoveVolume(ctx context.Context, name string) error
+	Exec(ctx context.Context, id string, opts ExecOptions, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error)
+	// List returns every container, running or not, that was created for
+	// a task, i.e. carries the LabelTaskID label.
+	List(ctx context.Context) ([]Container, error)
+}
+
+// LabelTaskID is set on every container to the ID of the task it runs, so a
+// restarted worker can find its containers again.
+const LabelTaskID = "cube.task.id"
+
+// Result is the outcome of starting or stopping a container.
+type Result struct {
+	Error       error
+	Action      string
+	ContainerId string
+	Result      string
+}
+
+// Status is what a runtime knows of one of its containers. State is
+// "running" while it runs and "exited" once it has stopped, when ExitCode
+// and FinishedAt are set. Ports maps each published container port to the
+// host ports it is reachable on.
+type Status struct {
+	ID         string
+	Name       string
+	Image      string
+	State      string
+	ExitCode   int
+	Pid        int
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Ports      nat.PortMap
+}
+
+type Container struct {
+	ID     string
+	Name   string
+	Image  string
+	Status string
+	Labels map[string]string
+}
+
+// ExecOptions describes a one-off command run inside a task's container.
+// Stdin may be nil for commands that don't read input.
+type ExecOptions struct {
+	Cmd        []string
+	Env        []string
+	WorkingDir string
+	User       string
+	Tty        bool
+}
+
+const DefaultStopTimeout = 10 * time.Second
+
+// StopOptions says how to stop a task: Signal (SIGTERM when empty) is sent
+// first and the task is killed if it is still running after Timeout.
+type StopOptions struct {
+	Signal  string
+	Timeout time.Duration
+}
+
+type LogOptions struct {
+	Follow     bool
+	Tail       string
+	Since      string
+	Timestamps bool
+}
+
+type ContainerStats struct {
+	CpuPercent  float64
+	MemoryUsage uint64
+	MemoryLimit uint64
+}
+
+func NewRuntime(kind string) (Runtime, error) {
+	switch kind {
+	case "", "docker":
+		return NewDocker()
+	case "fake":
+		return NewFake("127.0.0.1"), nil
+	case "process":
+		return NewProcess(filepath.Join(os.TempDir(), "cube"), "/sys/fs/cgroup/cube"), nil
+	default:
+		return nil, fmt.Errorf("unknown runtime %s", kind)
+	}
+}
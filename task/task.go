@@ -1,18 +1,9 @@
 package task
 
 import (
-	"context"
 	"fmt"
-	"io"
-	"log"
-	"math"
-	"os"
 	"time"
 
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/image"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	"github.com/google/uuid"
 )
@@ -27,23 +18,90 @@ const (
 	Failed
 )
 
+var stateNames = map[TaskState]string{
+	Pending:   "Pending",
+	Scheduled: "Scheduled",
+	Running:   "Running",
+	Completed: "Completed",
+	Failed:    "Failed",
+}
+
+func (s TaskState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("TaskState(%d)", int(s))
+}
+
+// ReasonWorkerShutdown is the FailureReason of a task its worker stopped on
+// shutting down, under ShutdownStopTasks.
+const ReasonWorkerShutdown = "WorkerShutdown"
+
 type Task struct {
 	ID            uuid.UUID
 	ContainerId   string
 	Name          string
 	State         TaskState
 	Image         string
+	PullPolicy    string
+	Cmd           []string
+	Entrypoint    []string
+	Env           []string
+	WorkingDir    string
+	User          string
 	CPU           float64
 	Memory        int64
 	Disk          int64
 	ExposedPorts  nat.PortSet
 	HostPorts     nat.PortMap
 	PortBindings  map[string]string
+	Mounts        []Mount
 	RestartPolicy string
+	StopSignal    string
+	StopTimeout   int
+	PreStopHook   string
 	StartTime     time.Time
 	EndTime       time.Time
 	HealthCheck   string
 	RestartCount  int
+	ExitCode      int
+	FailureReason string
+
+	// Stopped marks a Completed task as stopped, by the user or by the
+	// manager scaling, updating or moving it, rather than run to
+	// completion. ExitCode is then what its container exited with on
+	// being stopped.
+	Stopped bool
+
+	// Owner is the applied task spec ("task/<name>"), service
+	// ("service/<name>"), job ("job/<name>") or daemon set on a node
+	// ("daemonset/<name>@<node>") the task was built for and
+	// SpecHash the hash of the spec it was built from, both empty for
+	// tasks submitted directly.
+	// Revision is the service revision the task was rolled out in, or
+	// the run of the job it was started for.
+	Owner    string
+	SpecHash string
+	Revision int
+
+	// RunToCompletion marks a task that is done once its container exits
+	// 0, as a job's tasks are, rather than one meant to keep running.
+	RunToCompletion bool
+
+	// Node pins the task to the named worker node, as a daemon set's
+	// tasks are. Empty lets the scheduler choose.
+	Node string
+
+	// InitContainers run one after the other, each to completion, before
+	// the task's main container starts; the task stays Scheduled until
+	// then. Sidecars run alongside the main container. All of them share
+	// its network and are stopped and restarted with it, and the task
+	// fails as a whole when any of them does. Containers holds the state
+	// of each, for tasks that have any.
+	InitContainers []ContainerSpec
+	Sidecars       []ContainerSpec
+	Containers     []ContainerStatus
 }
 
 type TaskEvent struct {
@@ -60,218 +118,57 @@ type Config struct {
 	AttachStderr  bool
 	ExposedPorts  nat.PortSet
 	Cmd           []string
+	Entrypoint    []string
 	Image         string
+	PullPolicy    string
 	CPU           float64
 	Memory        int64
 	Disk          int64
 	Env           []string
+	WorkingDir    string
+	User          string
+	PortBindings  map[string]string
+	Mounts        []Mount
 	RestartPolicy string
-}
-
-type Docker struct {
-	Client *client.Client
-	Config Config
-}
-
-type DockerResult struct {
-	Error       error
-	Action      string
-	ContainerId string
-	Result      string
-}
+	StopSignal    string
+	StopTimeout   int
+	Labels        map[string]string
 
-type DockerInspectResponse struct {
-	Error     error
-	Container *container.InspectResponse
-}
-
-func (d *Docker) Run() DockerResult {
-	ctx := context.Background()
-
-	imageExists, err := checkImageExists(d.Client, d.Config.Image)
-	if err != nil {
-		log.Printf("Error checking image %s from the image list %v\n", d.Config.Image, err)
-		return DockerResult{Error: err}
-	}
-
-	if !imageExists {
-		reader, err := d.Client.ImagePull(ctx, d.Config.Image, image.PullOptions{})
-		if err != nil {
-			log.Printf("Error pulling the image %s: %v\n", d.Config.Image, err)
-			return DockerResult{Error: err}
-		}
-
-		io.Copy(os.Stdout, reader)
-	}
-
-	rp := container.RestartPolicy{
-		Name: container.RestartPolicyMode(d.Config.RestartPolicy),
-	}
-
-	r := container.Resources{
-		NanoCPUs: int64(d.Config.CPU * math.Pow(10, 9)),
-		Memory:   d.Config.Memory,
-	}
-
-	cc := container.Config{
-		Env:          d.Config.Env,
-		Image:        d.Config.Image,
-		ExposedPorts: d.Config.ExposedPorts,
-		Tty:          false,
-	}
-
-	hc := container.HostConfig{
-		PublishAllPorts: true,
-		RestartPolicy:   rp,
-		Resources:       r,
-	}
-
-	containerExists, res, err := checkContainerExists(d.Client, d.Config.Name)
-	if err != nil {
-		log.Printf("Error checking if container existed with name %s\n", d.Config.Name)
-		return DockerResult{Error: err}
-	}
-
-	var cID string
-	if containerExists {
-		err := d.Client.ContainerRestart(ctx, res.ID, container.StopOptions{})
-		if err != nil {
-			log.Printf("Error restarting container with ID %v and name %s\n", res.ID, d.Config.Name)
-			return DockerResult{Error: err}
-		}
-		cID = res.ID
-		log.Printf("Restarted container with ID %v\n", cID)
-
-		return DockerResult{ContainerId: cID, Action: "restart", Result: "success"}
-
-	} else {
-		res, err := d.Client.ContainerCreate(ctx, &cc, &hc, nil, nil, d.Config.Name)
-
-		if err != nil {
-			log.Printf("Failed to create container with Image %s: %v\n", d.Config.Image, err)
-			return DockerResult{Error: err}
-		}
-
-		err = d.Client.ContainerStart(ctx, res.ID, container.StartOptions{})
-
-		if err != nil {
-			log.Printf("Failed to start container with Image %s: %v\n", d.Config.Image, err)
-			return DockerResult{Error: err}
-		}
-
-		cID = res.ID
-	}
-
-	out, err := d.Client.ContainerLogs(ctx, cID, container.LogsOptions{ShowStderr: true, ShowStdout: true})
-
-	if err != nil {
-		log.Printf("Error getting logs for the container %s: %v\n", res.ID, err)
-		return DockerResult{Error: err}
-	}
-
-	stdcopy.StdCopy(os.Stdout, os.Stderr, out)
-
-	return DockerResult{ContainerId: cID, Action: "start", Result: "success"}
-}
-
-func (d *Docker) Stop(id string) DockerResult {
-	log.Printf("Attempting to stop container: %s\n", id)
-	ctx := context.Background()
-	err := d.Client.ContainerStop(ctx, id, container.StopOptions{})
-
-	if err != nil {
-		log.Printf("Failed to stop the container %s: %v\n", id, err)
-		return DockerResult{Error: err}
-	}
-
-	err = d.Client.ContainerRemove(ctx, id, container.RemoveOptions{})
-
-	if err != nil {
-		log.Printf("Failed to remove the container %s: %v\n", id, err)
-		return DockerResult{Error: err}
-	}
-
-	return DockerResult{Error: nil, Action: "stop", ContainerId: id, Result: "success"}
-}
-
-func (d *Docker) Inspect(containerID string) DockerInspectResponse {
-	dc, _ := client.NewClientWithOpts(client.FromEnv)
-	ctx := context.Background()
-	res, err := dc.ContainerInspect(ctx, containerID)
-	if err != nil {
-		log.Printf("Error inspecting container: %v\n", err)
-		return DockerInspectResponse{Error: err}
-	}
-
-	return DockerInspectResponse{
-		Container: &res,
-	}
+	// NetworkMode joins the container to another one's network, as
+	// "container:<id>". Empty gives it a network of its own.
+	NetworkMode string
 }
 
 func NewConfig(task *Task) Config {
 	return Config{
 		Name:          task.Name,
 		Image:         task.Image,
+		PullPolicy:    task.PullPolicy,
+		Cmd:           task.Cmd,
+		Entrypoint:    task.Entrypoint,
+		Env:           task.Env,
+		WorkingDir:    task.WorkingDir,
+		User:          task.User,
 		RestartPolicy: task.RestartPolicy,
 		CPU:           task.CPU,
 		Memory:        task.Memory,
 		Disk:          task.Disk,
 		ExposedPorts:  task.ExposedPorts,
+		PortBindings:  task.PortBindings,
+		Mounts:        task.Mounts,
+		StopSignal:    task.StopSignal,
+		StopTimeout:   task.StopTimeout,
+		Labels:        map[string]string{LabelTaskID: task.ID.String()},
 	}
 }
 
-func NewDocker(config Config) Docker {
-	newC, err := client.NewClientWithOpts(client.FromEnv)
-
-	if err != nil {
-		fmt.Printf("Error creating a new Docker struct: %v\n", err)
-		return Docker{
-			Client: nil,
-			Config: Config{},
-		}
-	}
-
-	return Docker{
-		Client: newC,
-		Config: config,
-	}
-}
-
-func checkImageExists(cli *client.Client, imageName string) (bool, error) {
-	ctx := context.Background()
-
-	images, err := cli.ImageList(ctx, image.ListOptions{})
-	if err != nil {
-		return false, err
-	}
-
-	for _, img := range images {
-		for _, tag := range img.RepoTags {
-			if tag == imageName || tag == imageName+":latest" {
-				return true, nil
-			}
-		}
-	}
-
-	return false, nil
-}
-
-func checkContainerExists(cli *client.Client, containerName string) (bool, container.Summary, error) {
-	ctx := context.Background()
-
-	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
-
-	if err != nil {
-		return false, container.Summary{}, err
-	}
-
-	for _, c := range containers {
-		for _, name := range c.Names {
-			if name == "/"+containerName || name == containerName {
-				return true, c, nil
-			}
-		}
+// StopOptions returns how the task asks to be stopped, StopTimeout being
+// its grace period in seconds.
+func (t *Task) StopOptions() StopOptions {
+	opts := StopOptions{Signal: t.StopSignal, Timeout: DefaultStopTimeout}
+	if t.StopTimeout > 0 {
+		opts.Timeout = time.Duration(t.StopTimeout) * time.Second
 	}
 
-	return false, container.Summary{}, err
+	return opts
 }
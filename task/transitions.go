@@ -2,10 +2,10 @@ package task
 
 var stateTransitionMap = map[TaskState][]TaskState{
 	Pending:   {Scheduled},
-	Scheduled: {Scheduled, Running, Failed},
+	Scheduled: {Scheduled, Running, Completed, Failed},
 	Running:   {Running, Completed, Failed, Scheduled},
 	Completed: {},
-	Failed:    {Scheduled},
+	Failed:    {Scheduled, Completed},
 }
 
 func Contains(states []TaskState, state TaskState) bool {
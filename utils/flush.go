@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"net/http"
+	"sync"
+)
+
+// FlushWriter writes to an http.ResponseWriter and flushes after every
+// write, so streamed output reaches the client as it is produced. It is
+// safe to share between the stdout and stderr copies of a stream.
+type FlushWriter struct {
+	W       http.ResponseWriter
+	mu      sync.Mutex
+	written bool
+}
+
+func (f *FlushWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.written = true
+	n, err := f.W.Write(p)
+	if fl, ok := f.W.(http.Flusher); ok {
+		fl.Flush()
+	}
+
+	return n, err
+}
+
+// Written reports whether anything, and so the response header, has been
+// sent yet.
+func (f *FlushWriter) Written() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.written
+}
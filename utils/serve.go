@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Serve runs srv until ctx is cancelled and then shuts it down, giving
+// in-flight requests up to timeout to finish. Hijacked connections, such as
+// interactive exec sessions, are not waited for.
+func Serve(ctx context.Context, srv *http.Server, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if serveErr := <-errs; !errors.Is(serveErr, http.ErrServerClosed) {
+		return serveErr
+	}
+
+	return err
+}
@@ -1,13 +1,18 @@
 package worker
 
 import (
+	"context"
+	"cube/utils"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
 
+const ShutdownTimeout = 30 * time.Second
+
 type Api struct {
 	Address string
 	Port    int
@@ -22,6 +27,9 @@ func (a *Api) InitRouter() {
 		r.Get("/", a.GetTaskHandler)
 		r.Route("/{taskID}", func(r chi.Router) {
 			r.Delete("/", a.DeleteTaskHandler)
+			r.Get("/stats", a.GetTaskStatsHandler)
+			r.Get("/logs", a.GetTaskLogsHandler)
+			r.Post("/exec", a.ExecTaskHandler)
 		})
 	})
 	a.Router.Route("/stats", func(r chi.Router) {
@@ -29,8 +37,16 @@ func (a *Api) InitRouter() {
 	})
 }
 
-func (a *Api) Start() {
+// Start serves the API until ctx is cancelled, then waits up to
+// ShutdownTimeout for in-flight requests to finish.
+func (a *Api) Start(ctx context.Context) error {
 	a.InitRouter()
 	log.Printf("Serving on %s:%d", a.Address, a.Port)
-	http.ListenAndServe(fmt.Sprintf("%s:%d", a.Address, a.Port), a.Router)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", a.Address, a.Port),
+		Handler: a.Router,
+	}
+
+	return utils.Serve(ctx, srv, ShutdownTimeout)
 }
@@ -0,0 +1,295 @@
+package worker
+
+import (
+	"context"
+	"cube/task"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// startInit starts the task's i-th init container. The task stays Scheduled
+// until its last init container has exited 0.
+func (w *Worker) startInit(ctx context.Context, t *task.Task, i int) task.Result {
+	s := t.InitContainers[i]
+	res := w.Runtime.Run(ctx, t.ContainerConfig(s))
+	if res.Error != nil {
+		log.Printf("Error starting init container %s of task %v: %v\n", s.Name, t.ID, res.Error)
+		return res
+	}
+
+	setContainer(t, s.Name, res.ContainerId)
+	log.Printf("[Worker] started init container %s of task %v\n", s.Name, t.ID)
+
+	return res
+}
+
+// startContainers starts the task's main container, then its sidecars in
+// the main container's network. If a sidecar can't be started, the
+// containers already started are stopped again.
+func (w *Worker) startContainers(ctx context.Context, t *task.Task) task.Result {
+	res := w.Runtime.Run(ctx, task.NewConfig(t))
+	if res.Error != nil {
+		return res
+	}
+
+	t.State = task.Running
+	t.ContainerId = res.ContainerId
+	setContainer(t, task.MainContainer, res.ContainerId)
+
+	for _, s := range t.Sidecars {
+		config := t.ContainerConfig(s)
+		config.NetworkMode = "container:" + t.ContainerId
+
+		sres := w.Runtime.Run(ctx, config)
+		if sres.Error != nil {
+			log.Printf("Error starting sidecar %s of task %v: %v\n", s.Name, t.ID, sres.Error)
+			w.Runtime.Stop(ctx, t.ContainerId, t.StopOptions())
+			setExited(t, task.MainContainer, 0)
+			w.stopContainers(ctx, t)
+			return sres
+		}
+
+		setContainer(t, s.Name, sres.ContainerId)
+	}
+
+	return res
+}
+
+// stopContainers stops the task's init container or sidecars still running,
+// leaving its main container to the caller.
+func (w *Worker) stopContainers(ctx context.Context, t *task.Task) {
+	for i, c := range t.Containers {
+		if c.Name == task.MainContainer || c.State != task.ContainerRunning {
+			continue
+		}
+
+		res := w.Runtime.Stop(ctx, c.ContainerId, t.StopOptions())
+		if res.Error != nil {
+			log.Printf("Error stopping container %s of task %v: %v\n", c.Name, t.ID, res.Error)
+			continue
+		}
+		t.Containers[i].State = task.ContainerExited
+	}
+}
+
+// syncInit moves an initializing task on once its running init container
+// has exited: to the next init container or, after the last, to its main
+// container and sidecars. The task fails if an init container exits
+// non-zero or the next containers can't be started.
+func (w *Worker) syncInit(ctx context.Context, id uuid.UUID) {
+	w.mu.Lock()
+	prev, release := w.claim(id)
+	w.mu.Unlock()
+	defer release()
+
+	if prev != nil {
+		<-prev
+	}
+
+	// The task may have been stopped or restarted while waiting.
+	t, ok := w.GetTask(id)
+	if !ok || t.State != task.Scheduled {
+		return
+	}
+	i := slices.IndexFunc(t.Containers, func(c task.ContainerStatus) bool {
+		return c.Init && c.State == task.ContainerRunning
+	})
+	if i < 0 {
+		return
+	}
+	c := t.Containers[i]
+
+	st, ierr := w.Runtime.Inspect(ctx, c.ContainerId)
+	if ierr != nil {
+		log.Printf("Error inspecting init container %s of task %v: %v\n", c.Name, id, ierr)
+	}
+	if st != nil && st.State != "exited" {
+		return
+	}
+
+	code := -1
+	if st != nil {
+		code = st.ExitCode
+	}
+	setExited(&t, c.Name, code)
+
+	var err error
+	switch {
+	case code != 0:
+		log.Printf("Init container %s of task %v exited with code %d\n", c.Name, id, code)
+		err = fmt.Errorf("init container %s exited with code %d", c.Name, code)
+		t.FailureReason = task.ReasonInitFailed
+	case i+1 < len(t.InitContainers):
+		err = w.startInit(ctx, &t, i+1).Error
+		t.FailureReason = startFailure(err)
+	default:
+		err = w.startContainers(ctx, &t).Error
+		t.FailureReason = startFailure(err)
+		if err == nil {
+			log.Printf("[Worker] started task %v\n", t.ID)
+		}
+	}
+
+	if err != nil {
+		t.State = task.Failed
+		t.ExitCode = code
+		t.EndTime = time.Now().UTC()
+	}
+	w.setTask(&t)
+}
+
+// syncContainers records the state of the sidecars of a running task, whose
+// main container was inspected already, and fails the task if one has
+// exited while the main container still runs.
+func (w *Worker) syncContainers(ctx context.Context, t *task.Task) {
+	for _, c := range t.Containers {
+		if c.Init || c.Name == task.MainContainer || c.State != task.ContainerRunning {
+			continue
+		}
+
+		st, err := w.Runtime.Inspect(ctx, c.ContainerId)
+		if err != nil {
+			log.Printf("Error inspecting sidecar %s of task %v: %v\n", c.Name, t.ID, err)
+		}
+		if st != nil && st.State != "exited" {
+			continue
+		}
+
+		code := -1
+		if st != nil {
+			code = st.ExitCode
+		}
+		setExited(t, c.Name, code)
+
+		if t.State == task.Running {
+			log.Printf("Sidecar %s of task %v exited with code %d\n", c.Name, t.ID, code)
+			t.State = task.Failed
+			t.FailureReason = task.ReasonSidecarExited
+			t.EndTime = time.Now().UTC()
+		}
+	}
+}
+
+// stopGroup stops what is left running of a task that has stopped or
+// failed, so none of its containers outlives it.
+func (w *Worker) stopGroup(ctx context.Context, id uuid.UUID) {
+	w.mu.Lock()
+	prev, release := w.claim(id)
+	w.mu.Unlock()
+	defer release()
+
+	if prev != nil {
+		<-prev
+	}
+
+	t, ok := w.GetTask(id)
+	if !ok || t.State == task.Scheduled || t.State == task.Running {
+		return
+	}
+
+	if i := slices.IndexFunc(t.Containers, func(c task.ContainerStatus) bool {
+		return c.Name == task.MainContainer && c.State == task.ContainerRunning
+	}); i >= 0 {
+		res := w.Runtime.Stop(ctx, t.ContainerId, t.StopOptions())
+		if res.Error != nil {
+			log.Printf("Error stopping container %s of task %v: %v\n", t.ContainerId, id, res.Error)
+		} else {
+			t.Containers[i].State = task.ContainerExited
+		}
+	}
+	w.stopContainers(ctx, &t)
+
+	w.mu.Lock()
+	if persisted, ok := w.Db[id]; ok && persisted.State == t.State {
+		persisted.Containers = t.Containers
+		w.saveTask(persisted)
+	}
+	w.mu.Unlock()
+}
+
+// adoptContainers records the state the runtime has the init containers and
+// sidecars of a task loaded from the store in, cs by their name. One that
+// kept running while the worker was down is tracked again, so it goes down
+// with its task, and one that went away is taken as exited. The running
+// init container is left for syncInit to inspect.
+func (w *Worker) adoptContainers(ctx context.Context, t *task.Task, cs map[string]task.Container) {
+	for i, s := range t.Containers {
+		if s.Name == task.MainContainer {
+			continue
+		}
+
+		c, ok := cs[s.Name]
+		switch {
+		case ok && c.Status == "running":
+			log.Printf("[Worker] Adopting container %s of task %v\n", s.Name, t.ID)
+			t.Containers[i].ContainerId = c.ID
+			t.Containers[i].State = task.ContainerRunning
+		case ok && s.Init && s.State == task.ContainerRunning:
+			t.Containers[i].ContainerId = c.ID
+		case ok && s.State == task.ContainerRunning:
+			code := -1
+			if st, err := w.Runtime.Inspect(ctx, c.ID); err == nil {
+				code = st.ExitCode
+			}
+			setExited(t, s.Name, code)
+		case s.State == task.ContainerRunning:
+			setExited(t, s.Name, -1)
+		}
+	}
+}
+
+// initializing reports whether one of the task's init containers runs.
+func initializing(t *task.Task) bool {
+	return slices.ContainsFunc(t.Containers, func(c task.ContainerStatus) bool {
+		return c.Init && c.State == task.ContainerRunning
+	})
+}
+
+// sidecarsRunning reports whether all of the task's sidecars run.
+func sidecarsRunning(t *task.Task) bool {
+	return !slices.ContainsFunc(t.Containers, func(c task.ContainerStatus) bool {
+		return !c.Init && c.Name != task.MainContainer && c.State != task.ContainerRunning
+	})
+}
+
+// running reports whether any container of the task's group still runs.
+func running(t *task.Task) bool {
+	return slices.ContainsFunc(t.Containers, func(c task.ContainerStatus) bool {
+		return c.State == task.ContainerRunning
+	})
+}
+
+func startFailure(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, task.ErrImagePull):
+		return task.ReasonImagePull
+	default:
+		return task.ReasonStartFailed
+	}
+}
+
+func setContainer(t *task.Task, name string, id string) {
+	for i, c := range t.Containers {
+		if c.Name == name {
+			t.Containers[i].ContainerId = id
+			t.Containers[i].State = task.ContainerRunning
+			t.Containers[i].ExitCode = 0
+		}
+	}
+}
+
+func setExited(t *task.Task, name string, code int) {
+	for i, c := range t.Containers {
+		if c.Name == name {
+			t.Containers[i].State = task.ContainerExited
+			t.Containers[i].ExitCode = code
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package worker
 
 import (
+	"bytes"
 	"cube/task"
+	"cube/utils"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -16,6 +18,12 @@ type ErrResponse struct {
 	Message        string
 }
 
+type ExecResponse struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
 func (a *Api) StartTaskHandler(w http.ResponseWriter, r *http.Request) {
 	d := json.NewDecoder(r.Body)
 	d.DisallowUnknownFields()
@@ -79,7 +87,7 @@ func (a *Api) DeleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, ok := a.Worker.Db[taskUUID]
+	taskToStop, ok := a.Worker.GetTask(taskUUID)
 
 	if !ok {
 		msg := fmt.Sprintf("Cannot find valid task with ID: %s\n", taskID)
@@ -93,8 +101,7 @@ func (a *Api) DeleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	taskToStop := a.Worker.Db[taskUUID]
-	taskCopy := *taskToStop
+	taskCopy := taskToStop
 	taskCopy.State = task.Completed
 	a.Worker.AddTask(taskCopy)
 
@@ -105,5 +112,163 @@ func (a *Api) DeleteTaskHandler(w http.ResponseWriter, r *http.Request) {
 func (a *Api) GetStatsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	json.NewEncoder(w).Encode(a.Worker.Stats)
+	json.NewEncoder(w).Encode(a.Worker.GetStats())
+}
+
+func (a *Api) GetTaskStatsHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := a.findTask(w, r)
+	if !ok {
+		return
+	}
+
+	s, err := a.Worker.TaskStats(r.Context(), *t)
+	if err != nil {
+		msg := fmt.Sprintf("Error retrieving stats for task %v: %v", t.ID, err)
+		log.Println(msg)
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 500, Message: msg})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(s)
+}
+
+func (a *Api) GetTaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := a.findTask(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	opts := task.LogOptions{
+		Follow:     q.Get("follow") == "true",
+		Tail:       q.Get("tail"),
+		Since:      q.Get("since"),
+		Timestamps: q.Get("timestamps") == "true",
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	out := &utils.FlushWriter{W: w}
+
+	err := a.Worker.TaskLogs(r.Context(), *t, opts, out, out)
+	if err != nil {
+		msg := fmt.Sprintf("Error retrieving logs for task %v: %v", t.ID, err)
+		log.Println(msg)
+		if !out.Written() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 500, Message: msg})
+		}
+	}
+}
+
+// ExecTaskHandler runs a command in the task's container and replies with
+// its output and exit code. With interactive=true the connection is
+// hijacked after a 101 response instead: whatever the client sends becomes
+// the command's stdin, stdout and stderr are streamed back raw, and the
+// worker closes the connection once the command exits.
+func (a *Api) ExecTaskHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := a.findTask(w, r)
+	if !ok {
+		return
+	}
+
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+
+	opts := task.ExecOptions{}
+	err := d.Decode(&opts)
+	if err == nil && len(opts.Cmd) == 0 {
+		err = fmt.Errorf("no command given")
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Error decoding exec request: %v", err)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return
+	}
+
+	if t.State != task.Running {
+		msg := fmt.Sprintf("Task %v is not running", t.ID)
+		log.Println(msg)
+		w.WriteHeader(409)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 409, Message: msg})
+		return
+	}
+
+	if r.URL.Query().Get("interactive") == "true" {
+		a.execInteractive(w, r, *t, opts)
+		return
+	}
+
+	var stdout, stderr bytes.Buffer
+	code, err := a.Worker.ExecTask(r.Context(), *t, opts, nil, &stdout, &stderr)
+	if err != nil {
+		msg := fmt.Sprintf("Error running exec in task %v: %v", t.ID, err)
+		log.Println(msg)
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 500, Message: msg})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(ExecResponse{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: code,
+	})
+}
+
+func (a *Api) execInteractive(w http.ResponseWriter, r *http.Request, t task.Task, opts task.ExecOptions) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking exec connection for task %v: %v\n", t.ID, err)
+		return
+	}
+	defer conn.Close()
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	brw.Flush()
+
+	code, err := a.Worker.ExecTask(r.Context(), t, opts, brw.Reader, conn, conn)
+	if err != nil {
+		log.Printf("Error running interactive exec in task %v: %v\n", t.ID, err)
+		return
+	}
+
+	log.Printf("Interactive exec %v in task %v exited with code %d\n", opts.Cmd, t.ID, code)
+}
+
+func (a *Api) findTask(w http.ResponseWriter, r *http.Request) (*task.Task, bool) {
+	taskID := chi.URLParam(r, "taskID")
+
+	taskUUID, err := uuid.Parse(taskID)
+	if err != nil {
+		msg := fmt.Sprintf("Had issues parsing task ID of %v", taskID)
+		log.Println(msg)
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 400, Message: msg})
+		return nil, false
+	}
+
+	t, ok := a.Worker.GetTask(taskUUID)
+	if !ok {
+		msg := fmt.Sprintf("Cannot find valid task with ID: %s", taskID)
+		log.Println(msg)
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(ErrResponse{HTTPStatusCode: 404, Message: msg})
+		return nil, false
+	}
+
+	return &t, true
 }
@@ -0,0 +1,115 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"cube/node"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"time"
+)
+
+// errNotRegistered is returned for a heartbeat the manager turned down as
+// it doesn't know the worker.
+var errNotRegistered = errors.New("worker not registered with the manager")
+
+// Heartbeat returns what the worker reports of itself to the manager: its
+// address, capacity and latest stats.
+func (w *Worker) Heartbeat() node.Heartbeat {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	hb := node.Heartbeat{
+		Address: w.Address,
+		Cores:   uint(runtime.NumCPU()),
+	}
+	if w.Stats != nil {
+		hb.Stats = *w.Stats
+		hb.Memory = w.Stats.MemTotalKb()
+		hb.Disk = int64(w.Stats.DiskTotal())
+	}
+
+	return hb
+}
+
+// Register adds the worker to its Manager's cluster.
+func (w *Worker) Register(ctx context.Context) error {
+	return w.postHeartbeat(ctx, http.MethodPost, "/nodes")
+}
+
+// SendHeartbeat tells the worker's Manager it is still up, registering the
+// worker if the manager doesn't know it, as on its first heartbeat or after
+// it was removed.
+func (w *Worker) SendHeartbeat(ctx context.Context) error {
+	err := w.postHeartbeat(ctx, http.MethodPut, "/nodes/"+url.PathEscape(w.Address)+"/heartbeat")
+	if !errors.Is(err, errNotRegistered) {
+		return err
+	}
+
+	err = w.Register(ctx)
+	if err == nil {
+		log.Printf("[Worker] Registered with manager %s as %s\n", w.Manager, w.Address)
+	}
+
+	return err
+}
+
+// SendHeartbeats sends a heartbeat to the worker's Manager every
+// HeartbeatInterval until ctx is cancelled. Workers without a Manager are
+// only known to the managers given their address and send nothing.
+func (w *Worker) SendHeartbeats(ctx context.Context) {
+	if w.Manager == "" {
+		return
+	}
+
+	for {
+		err := w.SendHeartbeat(ctx)
+		if err != nil {
+			log.Printf("[Worker] Error sending heartbeat to manager %s: %v\n", w.Manager, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.HeartbeatInterval):
+		}
+	}
+}
+
+func (w *Worker) postHeartbeat(ctx context.Context, method string, path string) error {
+	data, err := json.Marshal(w.Heartbeat())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.HeartbeatInterval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://%s%s", w.Manager, path), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotRegistered
+	case resp.StatusCode >= 300:
+		e := ErrResponse{}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("manager returned %d: %s", resp.StatusCode, e.Message)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package worker
+
+import (
+	"context"
+	"cube/task"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const tasksBucket = "tasks"
+
+// saveTask expects the caller to hold w.mu.
+func (w *Worker) saveTask(t *task.Task) {
+	err := w.Store.Put(tasksBucket, t.ID.String(), t)
+	if err != nil {
+		log.Printf("[Worker] Error persisting task %v: %v\n", t.ID, err)
+	}
+}
+
+// load restores the worker's tasks from the store and reconciles them with
+// the containers the runtime actually has, which may have kept running, or
+// gone away, while the worker was down.
+func (w *Worker) load(ctx context.Context) error {
+	tasks, err := w.Store.List(tasksBucket)
+	if err != nil {
+		return err
+	}
+	for key, data := range tasks {
+		t := task.Task{}
+		err := json.Unmarshal(data, &t)
+		if err != nil {
+			return fmt.Errorf("decoding task %s: %v", key, err)
+		}
+		w.Db[t.ID] = &t
+	}
+
+	containers, err := w.Runtime.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing containers: %v", err)
+	}
+
+	byTask := map[uuid.UUID]task.Container{}
+	groups := map[uuid.UUID]map[string]task.Container{}
+	for _, c := range containers {
+		id, err := uuid.Parse(c.Labels[task.LabelTaskID])
+		if err != nil {
+			log.Printf("[Worker] Ignoring container %s with invalid task label: %v\n", c.ID, err)
+			continue
+		}
+
+		// A task's init containers and sidecars are told from its main
+		// container by their name.
+		if name := c.Labels[task.LabelContainer]; name != "" {
+			if groups[id] == nil {
+				groups[id] = map[string]task.Container{}
+			}
+			groups[id][name] = c
+			continue
+		}
+		byTask[id] = c
+	}
+
+	for id, t := range w.Db {
+		if t.Containers != nil {
+			w.adoptContainers(ctx, t, groups[id])
+			w.saveTask(t)
+		}
+		if t.State != task.Scheduled && t.State != task.Running {
+			continue
+		}
+
+		c, ok := byTask[id]
+
+		// An initializing task carries on with its init container, which
+		// syncInit inspects as usual. Without one, it was stopped halfway
+		// between two of its containers and is failed, leaving SyncTasks
+		// to stop whatever of it runs.
+		if t.State == task.Scheduled && t.Containers != nil {
+			if ok && c.Status == "running" {
+				t.ContainerId = c.ID
+				setContainer(t, task.MainContainer, c.ID)
+			}
+			if !initializing(t) {
+				log.Printf("[Worker] Task %v has no init container left, marking task failed\n", id)
+				t.State = task.Failed
+				t.FailureReason = task.ReasonInitFailed
+				t.EndTime = time.Now().UTC()
+			}
+			w.saveTask(t)
+			continue
+		}
+
+		switch {
+		case ok && c.Status == "running":
+			log.Printf("[Worker] Adopting container %s of task %v\n", c.ID, id)
+			t.ContainerId = c.ID
+			t.State = task.Running
+			setContainer(t, task.MainContainer, c.ID)
+			if t.Containers != nil && !sidecarsRunning(t) {
+				log.Printf("[Worker] A sidecar of task %v has exited, marking task failed\n", id)
+				t.State = task.Failed
+				t.FailureReason = task.ReasonSidecarExited
+				t.EndTime = time.Now().UTC()
+			}
+		case ok:
+			// A job may well have run to completion while the worker
+			// was down.
+			log.Printf("[Worker] Container %s of task %v is %s\n", c.ID, id, c.Status)
+			t.ContainerId = c.ID
+			code := -1
+			if st, err := w.Runtime.Inspect(ctx, c.ID); err == nil {
+				code = st.ExitCode
+			}
+			exited(t, code)
+		default:
+			log.Printf("[Worker] Container of task %v has vanished, marking task failed\n", id)
+			t.ContainerId = ""
+			t.State = task.Failed
+			setExited(t, task.MainContainer, -1)
+		}
+		w.saveTask(t)
+	}
+
+	// Containers of tasks the worker has no record of, say because its
+	// state was lost, are still adopted so they stay visible and managed,
+	// together with the sidecars running beside them.
+	for id, c := range byTask {
+		if _, ok := w.Db[id]; ok || c.Status != "running" {
+			continue
+		}
+
+		log.Printf("[Worker] Adopting unknown container %s of task %v\n", c.ID, id)
+		t := &task.Task{
+			ID:          id,
+			ContainerId: c.ID,
+			Name:        c.Name,
+			Image:       c.Image,
+			State:       task.Running,
+		}
+		if cs := groups[id]; len(cs) > 0 {
+			t.Containers = []task.ContainerStatus{{Name: task.MainContainer, ContainerId: c.ID, State: task.ContainerRunning}}
+			for name, sc := range cs {
+				if sc.Status == "running" {
+					t.Containers = append(t.Containers, task.ContainerStatus{Name: name, ContainerId: sc.ID, State: task.ContainerRunning})
+				}
+			}
+		}
+		w.Db[id] = t
+		w.saveTask(t)
+	}
+
+	// What runs of an unknown task without its main container can't be
+	// told apart from a leftover, and is stopped.
+	for id, cs := range groups {
+		if _, ok := w.Db[id]; ok {
+			continue
+		}
+		for name, c := range cs {
+			if c.Status != "running" {
+				continue
+			}
+			log.Printf("[Worker] Stopping container %s of unknown task %v\n", name, id)
+			if res := w.Runtime.Stop(ctx, c.ID, task.StopOptions{Timeout: task.DefaultStopTimeout}); res.Error != nil {
+				log.Printf("[Worker] Error stopping container %s: %v\n", c.ID, res.Error)
+			}
+		}
+	}
+
+	log.Printf("[Worker] Loaded %d tasks from the store\n", len(w.Db))
+
+	return nil
+}
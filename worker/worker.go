@@ -1,176 +1,642 @@
 package worker
 
 import (
+	"context"
 	"cube/stats"
+	"cube/store"
 	"cube/task"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/golang-collections/collections/queue"
 	"github.com/google/uuid"
 )
 
+// Worker's Db, Queue and Stats are shared by the API handlers and the
+// background loops, so every access goes through mu. It is never held while
+// waiting on the runtime.
 type Worker struct {
+	mu sync.Mutex
+
 	Db        map[uuid.UUID]*task.Task
 	TaskCount uint64
 	Queue     queue.Queue
 	Name      string
 	Stats     *stats.Stats
+	Runtime   task.Runtime
+	Store     store.Store
+	// Retention is how long the container of a stopped task is kept
+	// before being removed. Zero removes it as soon as it stops.
+	Retention time.Duration
+	// Concurrency bounds how many queued tasks are started or stopped at
+	// once. Queued tasks are run as soon as they are added, but always in
+	// order for any one task.
+	Concurrency   int
+	SyncInterval  time.Duration
+	StatsInterval time.Duration
+	// ShutdownPolicy says what happens to running tasks when the worker
+	// shuts down: ShutdownLeaveTasks, the default, leaves them running to
+	// be adopted on restart and ShutdownStopTasks stops them, failing them
+	// with ReasonWorkerShutdown.
+	ShutdownPolicy string
+	// Manager is the host:port of the manager the worker registers with
+	// and sends a heartbeat every HeartbeatInterval, as Address, the
+	// host:port the manager reaches it at. Empty leaves the worker to
+	// managers given its address.
+	Manager           string
+	Address           string
+	HeartbeatInterval time.Duration
+
+	notify chan struct{}
+	// last holds, for each task with work in flight, a channel closed when
+	// the most recent piece of work for it is done.
+	last map[uuid.UUID]chan struct{}
+}
+
+const (
+	ShutdownLeaveTasks = "leave"
+	ShutdownStopTasks  = "stop"
+)
+
+const (
+	DefaultRetention     = time.Hour
+	DefaultConcurrency   = 4
+	DefaultSyncInterval  = 15 * time.Second
+	DefaultStatsInterval = 15 * time.Second
+
+	DefaultHeartbeatInterval = 10 * time.Second
+)
+
+// New creates a worker running tasks on runtime, restoring the tasks it knew
+// about from s and adopting their containers. A nil store keeps the worker's
+// tasks in memory only.
+func New(ctx context.Context, name string, runtime task.Runtime, s store.Store) (*Worker, error) {
+	if s == nil {
+		s = store.NewMemory()
+	}
+
+	w := &Worker{
+		Name:      name,
+		Queue:     *queue.New(),
+		Db:        make(map[uuid.UUID]*task.Task),
+		Runtime:   runtime,
+		Store:     s,
+		Retention: DefaultRetention,
+
+		Concurrency:       DefaultConcurrency,
+		SyncInterval:      DefaultSyncInterval,
+		StatsInterval:     DefaultStatsInterval,
+		ShutdownPolicy:    ShutdownLeaveTasks,
+		HeartbeatInterval: DefaultHeartbeatInterval,
+		notify:            make(chan struct{}, 1),
+		last:              make(map[uuid.UUID]chan struct{}),
+	}
+
+	err := w.load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading worker state: %v", err)
+	}
+
+	return w, nil
 }
 
-func (w *Worker) runTask() task.DockerResult {
+func (w *Worker) RunTask(ctx context.Context) task.Result {
+	w.mu.Lock()
 	t := w.Queue.Dequeue()
 
 	if t == nil {
+		w.mu.Unlock()
 		log.Println("No tasks in the queue")
-		return task.DockerResult{Error: nil}
+		return task.Result{Error: nil}
 	}
 
 	taskQueued := t.(task.Task)
 
+	// Wait for earlier work on the same task, which may still be running
+	// in another goroutine, so a stop never overtakes its start.
+	prev, release := w.claim(taskQueued.ID)
+	w.mu.Unlock()
+	defer release()
+
+	if prev != nil {
+		<-prev
+	}
+
+	w.mu.Lock()
 	taskPersisted := w.Db[taskQueued.ID]
 	if taskPersisted == nil {
-		taskPersisted = &taskQueued
-		w.Db[taskQueued.ID] = &taskQueued
+		persisted := taskQueued
+		taskPersisted = &persisted
+		w.Db[taskQueued.ID] = taskPersisted
 	}
+	persistedState := taskPersisted.State
+	w.mu.Unlock()
 
-	var result task.DockerResult
+	var result task.Result
 
-	if task.ValidStateTransition(taskPersisted.State, taskQueued.State) {
+	if task.ValidStateTransition(persistedState, taskQueued.State) {
 		switch taskQueued.State {
 		case task.Scheduled:
-			result = w.StartTask(taskQueued)
+			result = w.StartTask(ctx, taskQueued)
 		case task.Completed:
-			result = w.StopTask(taskQueued)
+			result = w.StopTask(ctx, taskQueued)
 		default:
 			result.Error = errors.New("we should not be here tf")
 		}
 	} else {
-		err := fmt.Errorf("invalid transitioning task state from %v to %v", taskPersisted.State, taskQueued.State)
+		err := fmt.Errorf("invalid transitioning task state from %v to %v", persistedState, taskQueued.State)
 		result.Error = err
 	}
 
 	return result
 }
 
-func (w *Worker) updateTasks() {
-	for id, t := range w.Db {
-		if t.State == task.Running {
-			res := w.InspectTask(*t)
-			if res.Error != nil {
-				log.Printf("Error with updating task through inspection %v\n", res.Error)
-			}
+// claim makes the caller the last to work on the task, returning the
+// earlier work to wait for, nil if none, and a func to call once done. It
+// expects the caller to hold w.mu.
+func (w *Worker) claim(id uuid.UUID) (chan struct{}, func()) {
+	prev := w.last[id]
+	done := make(chan struct{})
+	w.last[id] = done
+
+	return prev, func() {
+		w.mu.Lock()
+		if w.last[id] == done {
+			delete(w.last, id)
+		}
+		w.mu.Unlock()
+		close(done)
+	}
+}
 
-			if res.Container == nil {
-				log.Printf("No container found for running task %v\n", id)
-				w.Db[id].State = task.Failed
-			}
+func (w *Worker) SyncTasks(ctx context.Context) {
+	w.removeExpiredTasks(ctx)
 
-			if res.Container.State.Status == "exited" {
-				log.Printf("Container for task %s is not in running state %s\n", id, res.Container.State.Status)
-				w.Db[id].State = task.Failed
+	for _, t := range w.GetTasks() {
+		if t.State == task.Scheduled && t.Containers != nil {
+			w.syncInit(ctx, t.ID)
+			continue
+		}
+		if t.State != task.Running {
+			if running(t) {
+				w.stopGroup(ctx, t.ID)
 			}
+			continue
+		}
+
+		id := t.ID
+		st, err := w.InspectTask(ctx, *t)
+		if err != nil {
+			log.Printf("Error with updating task through inspection %v\n", err)
+		}
+		if st != nil && st.State != "exited" {
+			w.syncContainers(ctx, t)
+		}
+
+		w.mu.Lock()
+		persisted, ok := w.Db[id]
+		if !ok || persisted.State != task.Running || persisted.ContainerId != t.ContainerId {
+			// The task was stopped or restarted while it was inspected.
+			w.mu.Unlock()
+			continue
+		}
+
+		if st == nil {
+			log.Printf("No container found for running task %v\n", id)
+			persisted.State = task.Failed
+			setExited(persisted, task.MainContainer, -1)
+			w.saveTask(persisted)
+			w.mu.Unlock()
+			continue
+		}
+
+		old := *persisted
+		old.Containers = slices.Clone(persisted.Containers)
+		if t.Containers != nil {
+			persisted.Containers = t.Containers
+			persisted.State = t.State
+			persisted.FailureReason = t.FailureReason
+			persisted.EndTime = t.EndTime
+		}
+
+		if st.State == "exited" {
+			exited(persisted, st.ExitCode)
+		}
+
+		persisted.HostPorts = st.Ports
 
-			w.Db[id].HostPorts = res.Container.NetworkSettings.NetworkSettingsBase.Ports
+		if !reflect.DeepEqual(old, *persisted) {
+			w.saveTask(persisted)
+		}
+		// The rest of its group goes down with the task.
+		stopped := persisted.State != task.Running && running(persisted)
+		w.mu.Unlock()
 
+		if stopped {
+			w.stopGroup(ctx, id)
 		}
 	}
 }
 
-func (w *Worker) StartTask(t task.Task) task.DockerResult {
+// exited records that the task's main container exited with code. A task
+// run to completion that exited 0 is Completed, any other task Failed.
+func exited(t *task.Task, code int) {
+	setExited(t, task.MainContainer, code)
+	t.ExitCode = code
+	t.EndTime = time.Now().UTC()
+	if t.RunToCompletion && code == 0 {
+		log.Printf("Task %s ran to completion\n", t.ID)
+		t.State = task.Completed
+	} else {
+		log.Printf("Container for task %s exited with code %d\n", t.ID, code)
+		t.State = task.Failed
+	}
+}
+
+func (w *Worker) StartTask(ctx context.Context, t task.Task) task.Result {
 	t.StartTime = time.Now().UTC()
-	config := task.NewConfig(&t)
-	d := task.NewDocker(config)
 
-	res := d.Run()
+	// Init containers run before anything else of the task does, so what
+	// is left running from an earlier start is stopped first.
+	if prev, ok := w.GetTask(t.ID); ok && len(t.InitContainers) > 0 && running(&prev) {
+		if prev.ContainerId != "" {
+			w.Runtime.Stop(ctx, prev.ContainerId, prev.StopOptions())
+		}
+		w.stopContainers(ctx, &prev)
+	}
+
+	t.Containers = nil
+	if t.Grouped() {
+		t.Containers = t.NewContainerStatuses()
+	}
+
+	for _, v := range t.Volumes() {
+		err := w.Runtime.CreateVolume(ctx, v)
+		if err != nil {
+			log.Printf("Error creating volume %s for task %v: %v\n", v, t.ID, err)
+			t.State = task.Failed
+			w.setTask(&t)
+			return task.Result{Error: err}
+		}
+	}
+
+	// A task with init containers stays Scheduled, without a container of
+	// its own, until SyncTasks has seen them all complete.
+	var res task.Result
+	if len(t.InitContainers) > 0 {
+		t.ContainerId = ""
+		res = w.startInit(ctx, &t, 0)
+	} else {
+		res = w.startContainers(ctx, &t)
+	}
 
 	if res.Error != nil {
 		log.Printf("Error starting container with ID: %s, %v\n", t.ContainerId, res.Error)
 		t.State = task.Failed
-		w.Db[t.ID] = &t
+		t.FailureReason = startFailure(res.Error)
+		w.setTask(&t)
 		return res
 	}
 
-	t.State = task.Running
-	t.ContainerId = res.ContainerId
-	w.Db[t.ID] = &t
+	t.ExitCode = 0
+	t.FailureReason = ""
+	t.Stopped = false
+	w.setTask(&t)
 
-	log.Printf("[Worker] started task %v\n", t.ID)
+	if t.State == task.Running {
+		log.Printf("[Worker] started task %v\n", t.ID)
+	}
 
 	return res
 }
 
-func (w *Worker) StopTask(t task.Task) task.DockerResult {
-	config := task.NewConfig(&t)
-	d := task.NewDocker(config)
+func (w *Worker) StopTask(ctx context.Context, t task.Task) task.Result {
+	opts := t.StopOptions()
 
-	res := d.Stop(t.ContainerId)
+	if t.PreStopHook != "" {
+		start := time.Now()
+		w.runPreStopHook(ctx, t, opts.Timeout)
+		// The hook's time comes out of the grace period.
+		opts.Timeout = max(opts.Timeout-time.Since(start), 0)
+	}
+
+	if persisted, ok := w.GetTask(t.ID); ok {
+		if t.ContainerId == "" {
+			t.ContainerId = persisted.ContainerId
+		}
+		t.Containers = persisted.Containers
+	}
+
+	// A task whose container was never created, such as one whose image
+	// could not be pulled, has nothing to stop.
+	res := task.Result{Action: "stop", Result: "success"}
+	if t.ContainerId != "" {
+		res = w.Runtime.Stop(ctx, t.ContainerId, opts)
+	}
 
 	if res.Error != nil {
 		log.Printf("Error stopping container with ID: %s, %v\n", t.ContainerId, res.Error)
 		return res
 	}
+	code := 0
+	if t.ContainerId != "" {
+		if st, err := w.Runtime.Inspect(ctx, t.ContainerId); err == nil {
+			code = st.ExitCode
+		}
+	}
+	setExited(&t, task.MainContainer, code)
+	w.stopContainers(ctx, &t)
 
+	t.ExitCode = code
 	t.EndTime = time.Now().UTC()
-	t.State = task.Completed
-	w.Db[t.ID] = &t
-	log.Printf("Stopped and removed container with id %v and Task with id %v\n", t.ContainerId, t.ID)
+	// A task the worker stops of its own accord is passed in Failed, with
+	// the reason; any other was stopped on request.
+	if t.State != task.Failed {
+		t.State = task.Completed
+		t.Stopped = true
+	}
+	w.setTask(&t)
+	log.Printf("Stopped container with id %v and Task with id %v\n", t.ContainerId, t.ID)
+
+	if w.Retention == 0 {
+		w.removeTask(ctx, t)
+	}
 
 	return res
 }
 
+// runPreStopHook calls the task's pre-stop HTTP hook, giving it at most the
+// task's grace period. Failures are logged and the stop carries on.
+func (w *Worker) runPreStopHook(ctx context.Context, t task.Task, timeout time.Duration) {
+	hostPort := t.HostPort()
+	if hostPort == nil {
+		log.Printf("No host port published for pre-stop hook of task %v\n", t.ID)
+		return
+	}
+
+	host := hostPort.HostIP
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	}
+	url := fmt.Sprintf("http://%s%s", net.JoinHostPort(host, hostPort.HostPort), t.PreStopHook)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		log.Printf("Error creating pre-stop hook request %s of task %v: %v\n", url, t.ID, err)
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Error calling pre-stop hook %s of task %v: %v\n", url, t.ID, err)
+		return
+	}
+	resp.Body.Close()
+
+	log.Printf("Pre-stop hook %s of task %v returned %d\n", url, t.ID, resp.StatusCode)
+}
+
+// removeExpiredTasks removes the containers of tasks that stopped longer
+// than the retention period ago. Until then their containers, and so their
+// logs, are kept around for inspection.
+func (w *Worker) removeExpiredTasks(ctx context.Context) {
+	for _, t := range w.GetTasks() {
+		if t.State == task.Completed && len(t.ContainerIds()) > 0 && time.Since(t.EndTime) >= w.Retention {
+			w.removeTask(ctx, *t)
+		}
+	}
+}
+
+// removeTask removes every container of the task, its main container's
+// first.
+func (w *Worker) removeTask(ctx context.Context, t task.Task) {
+	for _, id := range t.ContainerIds() {
+		err := w.Runtime.Remove(ctx, id)
+		if err != nil {
+			log.Printf("Error removing container %s of task %v: %v\n", id, t.ID, err)
+			return
+		}
+		log.Printf("Removed container %s of task %v\n", id, t.ID)
+	}
+
+	w.mu.Lock()
+	if persisted, ok := w.Db[t.ID]; ok && persisted.ContainerId == t.ContainerId {
+		persisted.ContainerId = ""
+		for i := range persisted.Containers {
+			persisted.Containers[i].ContainerId = ""
+		}
+		w.saveTask(persisted)
+	}
+	w.mu.Unlock()
+
+	w.removeVolumes(ctx, t)
+}
+
+// removeVolumes deletes the named volumes of a removed task that no other
+// task on the worker still mounts.
+func (w *Worker) removeVolumes(ctx context.Context, t task.Task) {
+	inUse := map[string]bool{}
+	for _, other := range w.GetTasks() {
+		if other.ID == t.ID || len(other.ContainerIds()) == 0 {
+			continue
+		}
+		for _, v := range other.Volumes() {
+			inUse[v] = true
+		}
+	}
+
+	for _, v := range t.Volumes() {
+		if inUse[v] {
+			continue
+		}
+
+		err := w.Runtime.RemoveVolume(ctx, v)
+		if err != nil {
+			log.Printf("Error removing volume %s of task %v: %v\n", v, t.ID, err)
+		}
+	}
+}
+
+// GetTasks returns copies of every task, safe to use after the worker has
+// moved on.
 func (w *Worker) GetTasks() []*task.Task {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	res := []*task.Task{}
 
 	for _, t := range w.Db {
-		res = append(res, t)
+		tc := *t
+		tc.Containers = slices.Clone(t.Containers)
+		res = append(res, &tc)
 	}
 
 	return res
 }
 
+func (w *Worker) GetTask(id uuid.UUID) (task.Task, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t, ok := w.Db[id]
+	if !ok {
+		return task.Task{}, false
+	}
+
+	tc := *t
+	tc.Containers = slices.Clone(t.Containers)
+
+	return tc, true
+}
+
+// setTask records t in the Db and the store.
+func (w *Worker) setTask(t *task.Task) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.Db[t.ID] = t
+	w.saveTask(t)
+}
+
 func (w *Worker) AddTask(t task.Task) {
+	w.mu.Lock()
 	w.Queue.Enqueue(t)
+	w.mu.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Worker) QueueLen() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.Queue.Len()
 }
 
-func (w *Worker) CollectStats() {
+func (w *Worker) GetStats() *stats.Stats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.Stats
+}
+
+func (w *Worker) CollectStats(ctx context.Context) {
 	for {
 		log.Println("Collecting stats")
-		w.Stats = stats.GetStats()
-		w.Stats.TaskCount = w.TaskCount
-		time.Sleep(15 * time.Second)
+		s := stats.GetStats()
+
+		w.mu.Lock()
+		s.TaskCount = w.TaskCount
+		w.Stats = s
+		w.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.StatsInterval):
+		}
 	}
 }
 
-func (w *Worker) RunTasks() {
+// RunTasks runs queued tasks as soon as they are added, up to Concurrency
+// at a time, until ctx is cancelled. Tasks already being started or stopped
+// then run to completion before it returns; those still queued are not
+// picked up.
+func (w *Worker) RunTasks(ctx context.Context) {
+	sem := make(chan struct{}, w.Concurrency)
+	// Work in flight outlives ctx, so a container isn't left half started.
+	runCtx := context.WithoutCancel(ctx)
+
 	for {
-		if w.Queue.Len() != 0 {
-			result := w.runTask()
-			if result.Error != nil {
-				log.Printf("Error running task: %v\n", result.Error)
+		for n := w.QueueLen(); n > 0 && ctx.Err() == nil; n-- {
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem }()
+				result := w.RunTask(runCtx)
+				if result.Error != nil {
+					log.Printf("Error running task: %v\n", result.Error)
+				}
+			}()
+		}
+
+		select {
+		case <-ctx.Done():
+			for i := 0; i < cap(sem); i++ {
+				sem <- struct{}{}
 			}
-		} else {
-			log.Printf("No tasks to process currently.\n")
+			return
+		case <-w.notify:
 		}
-		log.Println("Sleeping for 10 seconds.")
-		time.Sleep(10 * time.Second)
 	}
 }
 
-func (w *Worker) UpdateTasks() {
+func (w *Worker) UpdateTasks(ctx context.Context) {
 	for {
 		log.Println("Checking status of tasks")
-		w.updateTasks()
+		w.SyncTasks(ctx)
 		log.Println("Task updates completed")
-		log.Println("Sleeping for 15 seconds")
-		time.Sleep(15 * time.Second)
+		log.Printf("Sleeping for %v\n", w.SyncInterval)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.SyncInterval):
+		}
 	}
 }
 
-func (w *Worker) InspectTask(t task.Task) task.DockerInspectResponse {
-	config := task.NewConfig(&t)
-	d := task.NewDocker(config)
-	return d.Inspect(t.ContainerId)
+// Shutdown applies the worker's ShutdownPolicy once its loops have stopped,
+// stopping every running task when the policy asks for it, and closes its
+// store. ctx bounds how long stopping may take.
+func (w *Worker) Shutdown(ctx context.Context) error {
+	if w.ShutdownPolicy == ShutdownStopTasks {
+		for _, t := range w.GetTasks() {
+			if t.State != task.Running {
+				continue
+			}
+
+			// The task didn't finish and wasn't asked to stop, so it
+			// fails, leaving the manager to place it again.
+			log.Printf("Stopping task %v on shutdown\n", t.ID)
+			stopped := *t
+			stopped.State = task.Failed
+			stopped.FailureReason = task.ReasonWorkerShutdown
+			res := w.StopTask(ctx, stopped)
+			if res.Error != nil {
+				log.Printf("Error stopping task %v on shutdown: %v\n", t.ID, res.Error)
+			}
+		}
+	}
+
+	return w.Store.Close()
+}
+
+func (w *Worker) InspectTask(ctx context.Context, t task.Task) (*task.Status, error) {
+	return w.Runtime.Inspect(ctx, t.ContainerId)
+}
+
+func (w *Worker) TaskLogs(ctx context.Context, t task.Task, opts task.LogOptions, stdout io.Writer, stderr io.Writer) error {
+	return w.Runtime.Logs(ctx, t.ContainerId, opts, stdout, stderr)
+}
+
+func (w *Worker) ExecTask(ctx context.Context, t task.Task, opts task.ExecOptions, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	return w.Runtime.Exec(ctx, t.ContainerId, opts, stdin, stdout, stderr)
+}
+
+func (w *Worker) TaskStats(ctx context.Context, t task.Task) (*task.ContainerStats, error) {
+	return w.Runtime.Stats(ctx, t.ContainerId)
 }